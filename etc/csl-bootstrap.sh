@@ -0,0 +1,45 @@
+#!/bin/sh
+# First-boot set-up of a workspace cloned from a Proxmox template: fetches the SSH
+# keys, code-server authentication and git identity of the owner from the
+# launcher. Install it in the template as a oneshot unit running as root, with
+# CSL_LAUNCHER_URL pointing at the launcher directly, e.g. http://10.0.0.2:8080.
+# The launcher answers once per clone, to the address the container was given; the
+# datacenter firewall has to be on for the container IP filter to enforce it.
+# Needs curl and jq.
+set -eu
+
+: "${CSL_LAUNCHER_URL:?CSL_LAUNCHER_URL is not set}"
+CSL_USER="${CSL_USER:-coder}"
+MARKER=/var/lib/csl-bootstrap.done
+
+[ -e "$MARKER" ] && exit 0
+
+boot=$(curl -fsS --retry 10 --retry-delay 3 --retry-all-errors "$CSL_LAUNCHER_URL/bootstrap")
+home=$(getent passwd "$CSL_USER" | cut -d: -f6)
+
+hostnamectl set-hostname "$(echo "$boot" | jq -r .hostname)" 2>/dev/null || true
+
+install -d -m 700 -o "$CSL_USER" -g "$CSL_USER" "$home/.ssh"
+echo "$boot" | jq -r '.ssh_keys[]' > "$home/.ssh/authorized_keys"
+chown "$CSL_USER:$CSL_USER" "$home/.ssh/authorized_keys"
+chmod 600 "$home/.ssh/authorized_keys"
+
+install -d -o "$CSL_USER" -g "$CSL_USER" "$home/.config" "$home/.config/code-server"
+{
+	echo "bind-addr: 0.0.0.0:8080"
+	echo "auth: $(echo "$boot" | jq -r .auth)"
+	echo "password: $(echo "$boot" | jq -r '.password // ""')"
+	echo "cert: false"
+} > "$home/.config/code-server/config.yaml"
+chown "$CSL_USER:$CSL_USER" "$home/.config/code-server/config.yaml"
+chmod 600 "$home/.config/code-server/config.yaml"
+
+git config --file "$home/.gitconfig" user.name "$(echo "$boot" | jq -r .git_name)"
+email=$(echo "$boot" | jq -r '.git_email // ""')
+if [ -n "$email" ]; then
+	git config --file "$home/.gitconfig" user.email "$email"
+fi
+chown "$CSL_USER:$CSL_USER" "$home/.gitconfig"
+
+systemctl restart "code-server@$CSL_USER" 2>/dev/null || true
+touch "$MARKER"
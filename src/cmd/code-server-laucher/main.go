@@ -1,135 +1,43 @@
 package main
 
 import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/server"
 	"context"
-	"fmt"
-	"log"
-	"net/http"
-	"strings"
-
-	"encoding/json"
-
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
-)
-
-var (
-	oauthConf = &oauth2.Config{
-		Scopes:      []string{"user:email"},
-		Endpoint:    github.Endpoint,
-		RedirectURL: "https://code.learnops.duckdns.org/callback",
-	}
-
-	// Lista de usuários permitidos (login do GitHub)
-	allowedUsers = map[string]int{}
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	allowedUsers = loadUsers()
-
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/login", handleLogin)
-	http.HandleFunc("/callback", handleCallback)
-	http.HandleFunc("/users", handleUsers)
-
-	fmt.Println("Server started at http://0.0.0.0:8080/")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
+	log := logger.NewLogger("Main")
 
-func handleHome(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, `<a href="/login">Login with GitHub</a>`)
-	log.Println("Home page accessed")
-}
-
-func handleLogin(w http.ResponseWriter, r *http.Request) {
-	log.Println("Login page accessed")
-	url := oauthConf.AuthCodeURL("state-token", oauth2.AccessTypeOnline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-}
+	configPath := flag.String("config", "etc/local-config.json", "path to the launcher config file")
+	flag.Parse()
 
-func handleCallback(w http.ResponseWriter, r *http.Request) {
-	log.Println("Callback page accessed")
-	code := r.URL.Query().Get("code")
-	token, err := oauthConf.Exchange(context.Background(), code)
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
-		return
-	}
-
-	client := oauthConf.Client(context.Background(), token)
-	resp, err := client.Get("https://api.github.com/user")
-	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	var user struct {
-		Login string `json:"login"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
-		return
+		log.Error("Failed to load config %s: %v", *configPath, err)
+		os.Exit(1)
 	}
 
-	user.Login = strings.ToLower(user.Login)
-
-	log.Printf("User info: %+v\n", user)
-
-	if !authUser(user.Login) {
-		log.Printf("Access denied for user: %s", user.Login)
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
-	}
-
-	// Sessão fake: salva o usuário em um cookie
-	http.SetCookie(w, &http.Cookie{Name: "user", Value: user.Login})
-
-	target := fmt.Sprintf("https://%s.vm.learnops.duckdns.org", user.Login)
-	http.Redirect(w, r, target, http.StatusSeeOther)
-}
-
-func handleUsers(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("user")
+	srv, err := server.NewServer(cfg)
 	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
-	}
-
-	user := cookie.Value
-
-	if !authUser(user) {
-		log.Printf("Access denied for user: %s", user)
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
+		log.Error("Failed to create server: %v", err)
+		os.Exit(1)
 	}
 
-	users := make([]string, 0, len(allowedUsers))
-	for u := range allowedUsers {
-		users = append(users, u)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	json.NewEncoder(w).Encode(users)
-}
+	go srv.WatchConfig(ctx, *configPath)
 
-func authUser(user string) bool {
-	log.Printf("Auth user: %s", user)
-
-	if port, ok := allowedUsers[user]; ok {
-		log.Printf("User %s is allowed with port %d", user, port)
-		return true
+	if err := srv.Start(ctx); err != nil {
+		log.Error("Server stopped: %v", err)
+		os.Exit(1)
 	}
 
-	log.Printf("User %s is not allowed", user)
-	return false
-}
-
-func loadUsers() map[string]int {
-	return map[string]int{
-		"rafaelfino": 7500,
-	}
-}
-
-func startDocker(user string, port int) error {
-	return nil
+	log.Info("Server stopped")
 }
@@ -5,7 +5,9 @@ go 1.24.0
 require (
 	github.com/Telmate/proxmox-api-go v0.0.0-20250503175408-7fbd372efd64
 	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.3.10
 	golang.org/x/oauth2 v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,516 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "CSL_"
+
+// Load reads the config file at path, JSON or YAML depending on the extension,
+// overlays CSL_* environment variables and secret files, fills defaults and
+// validates the result.
+func Load(path string) (*AppConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Parse(data, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	envErr := cfg.applyEnv(os.LookupEnv)
+	secretErr := cfg.readSecretFiles()
+
+	cfg.SetDefaults()
+
+	if err := errors.Join(envErr, secretErr, cfg.Validate()); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Parse decodes a config document. YAML is converted to JSON first so both
+// formats share the json field names.
+func Parse(data []byte, ext string) (*AppConfig, error) {
+	if ext == ".yaml" || ext == ".yml" {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		data = converted
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	cfg := &AppConfig{}
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// UnmarshalJSON maps the snake_case keys used in config files onto the embedded
+// oauth2.Config, which carries no json tags.
+func (g *GithubConfig) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ClientID         string   `json:"client_id"`
+		ClientSecret     string   `json:"client_secret"`
+		ClientSecretFile string   `json:"client_secret_file"`
+		RedirectURL      string   `json:"redirect_url"`
+		Scopes           []string `json:"scopes"`
+		GithubUrl        string   `json:"github_url"`
+		AllowedOrgs      []string `json:"allowed_orgs"`
+		AllowedTeams     []string `json:"allowed_teams"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	g.ClientID = raw.ClientID
+	g.ClientSecret = raw.ClientSecret
+	g.ClientSecretFile = raw.ClientSecretFile
+	g.RedirectURL = raw.RedirectURL
+	g.Scopes = raw.Scopes
+	g.GithubUrl = raw.GithubUrl
+	g.AllowedOrgs = raw.AllowedOrgs
+	g.AllowedTeams = raw.AllowedTeams
+
+	return nil
+}
+
+// applyEnv overlays CSL_* variables on the file values, creating the sections they
+// belong to when the file left them out.
+func (c *AppConfig) applyEnv(lookup func(string) (string, bool)) error {
+	if c.Github == nil {
+		c.Github = &GithubConfig{}
+	}
+	if c.Workspace == nil {
+		c.Workspace = &WorkspaceConfig{}
+	}
+	if c.Proxmox == nil {
+		c.Proxmox = &ProxmoxConfig{}
+	}
+	if c.Docker == nil {
+		c.Docker = &DockerConfig{}
+	}
+	if c.Server == nil {
+		c.Server = &ServerConfig{}
+	}
+	if c.Caddy == nil {
+		c.Caddy = &CaddyConfig{}
+	}
+	if c.Session == nil {
+		c.Session = &SessionConfig{}
+	}
+
+	stringVars := map[string]*string{
+		"GITHUB_CLIENT_ID":          &c.Github.ClientID,
+		"GITHUB_CLIENT_SECRET":      &c.Github.ClientSecret,
+		"GITHUB_CLIENT_SECRET_FILE": &c.Github.ClientSecretFile,
+		"GITHUB_REDIRECT_URL":       &c.Github.RedirectURL,
+		"GITHUB_URL":                &c.Github.GithubUrl,
+		"DOCKER_SOCKET":             &c.Docker.Socket,
+		"DOCKER_NETWORK":            &c.Docker.Network,
+		"DOCKER_IMAGE":              &c.Docker.Image,
+		"PROXMOX_HOST":              &c.Proxmox.Host,
+		"PROXMOX_NODE":              &c.Proxmox.Node,
+		"PROXMOX_USERNAME":          &c.Proxmox.Username,
+		"PROXMOX_PASSWORD":          &c.Proxmox.Password,
+		"PROXMOX_PASSWORD_FILE":     &c.Proxmox.PasswordFile,
+		"PROXMOX_TOKEN_ID":          &c.Proxmox.TokenID,
+		"PROXMOX_TOKEN_SECRET":      &c.Proxmox.TokenSecret,
+		"PROXMOX_TOKEN_SECRET_FILE": &c.Proxmox.TokenSecretFile,
+		"PROXMOX_CA_FILE":           &c.Proxmox.CAFile,
+		"PROXMOX_FINGERPRINT":       &c.Proxmox.Fingerprint,
+		"WORKSPACE_IP_POOL":         &c.Workspace.IPPool,
+		"WORKSPACE_GATEWAY":         &c.Workspace.Gateway,
+		"SERVER_HOST":               &c.Server.Host,
+		"SERVER_PUBLIC_URL":         &c.Server.PublicURL,
+		"CADDY_HOST":                &c.Caddy.Host,
+		"CADDY_BASE_URL":            &c.Caddy.BaseURL,
+		"CADDY_AUTH_UPSTREAM":       &c.Caddy.AuthUpstream,
+		"CADDY_SERVER_NAME":         &c.Caddy.ServerName,
+		"SESSION_SECRET":            &c.Session.Secret,
+		"SESSION_COOKIE_DOMAIN":     &c.Session.CookieDomain,
+		"USER_LIST_URL":             &c.UserListUrl,
+		"STATE_FILE":                &c.StateFile,
+	}
+
+	intVars := map[string]*int{
+		"PROXMOX_TEMPLATE_ID": &c.Proxmox.TemplateID,
+		"SERVER_PORT":         &c.Server.Port,
+		"CADDY_PORT":          &c.Caddy.Port,
+		"CADDY_UPSTREAM_PORT": &c.Caddy.UpstreamPort,
+	}
+
+	for name, field := range stringVars {
+		if value, ok := lookup(envPrefix + name); ok {
+			*field = value
+		}
+	}
+
+	if value, ok := lookup(envPrefix + "BACKEND"); ok {
+		c.Backend = Backend(value)
+	}
+
+	// A secret given directly in the environment wins over a file named in the config.
+	if _, ok := lookup(envPrefix + "GITHUB_CLIENT_SECRET"); ok {
+		c.Github.ClientSecretFile = ""
+	}
+	if _, ok := lookup(envPrefix + "PROXMOX_PASSWORD"); ok {
+		c.Proxmox.PasswordFile = ""
+	}
+	if _, ok := lookup(envPrefix + "PROXMOX_TOKEN_SECRET"); ok {
+		c.Proxmox.TokenSecretFile = ""
+	}
+
+	var errs []error
+	for name, field := range intVars {
+		value, ok := lookup(envPrefix + name)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: %q is not a number", envPrefix, name, value))
+			continue
+		}
+
+		*field = n
+	}
+
+	return errors.Join(errs...)
+}
+
+// readSecretFiles replaces secrets with the contents of their *_file counterparts,
+// as mounted by Docker or Kubernetes secrets.
+func (c *AppConfig) readSecretFiles() error {
+	var errs []error
+
+	read := func(name, path string, target *string) {
+		if path == "" {
+			return
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			return
+		}
+
+		*target = strings.TrimSpace(string(data))
+	}
+
+	read("github.client_secret_file", c.Github.ClientSecretFile, &c.Github.ClientSecret)
+	read("proxmox.password_file", c.Proxmox.PasswordFile, &c.Proxmox.Password)
+	read("proxmox.token_secret_file", c.Proxmox.TokenSecretFile, &c.Proxmox.TokenSecret)
+
+	for i, provider := range c.Providers {
+		read(fmt.Sprintf("providers[%d].client_secret_file", i), provider.ClientSecretFile, &provider.ClientSecret)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *AppConfig) SetDefaults() {
+	if c.StateFile == "" {
+		c.StateFile = "code-server-launcher.db"
+	}
+
+	if c.Backend == "" {
+		c.Backend = BackendProxmox
+	}
+	if c.Docker.Socket == "" {
+		c.Docker.Socket = "/var/run/docker.sock"
+	}
+
+	if c.Server.Host == "" {
+		c.Server.Host = "0.0.0.0"
+	}
+	if c.Server.Port == 0 {
+		c.Server.Port = 8080
+	}
+	if c.Server.ReadyTimeout == 0 {
+		c.Server.ReadyTimeout = 120
+	}
+	if c.Server.ReconcileInterval == 0 {
+		c.Server.ReconcileInterval = 60
+	}
+	if c.Server.RequestTimeout == 0 {
+		c.Server.RequestTimeout = 10
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 120
+	}
+
+	if c.Caddy.Host == "" {
+		c.Caddy.Host = "localhost"
+	}
+	if c.Caddy.Port == 0 {
+		c.Caddy.Port = 2019
+	}
+	if c.Caddy.UpstreamPort == 0 {
+		c.Caddy.UpstreamPort = 8080
+	}
+	if c.Caddy.RequestTimeout == 0 {
+		c.Caddy.RequestTimeout = 10
+	}
+	if c.Caddy.ServerName == "" {
+		c.Caddy.ServerName = "srv0"
+	}
+
+	if c.Workspace.MemSize == 0 {
+		c.Workspace.MemSize = 2048
+	}
+	if c.Workspace.CPUCores == 0 {
+		c.Workspace.CPUCores = 2
+	}
+	if c.Workspace.CodeServerAuth == "" {
+		c.Workspace.CodeServerAuth = CodeServerAuthNone
+	}
+
+	if c.Proxmox.NetworkInterface == "" {
+		c.Proxmox.NetworkInterface = "vmbr0"
+	}
+	if c.Proxmox.TimetoStart == 0 {
+		c.Proxmox.TimetoStart = 15
+	}
+	if c.Proxmox.TaskTimeout == 0 {
+		c.Proxmox.TaskTimeout = 600
+	}
+}
+
+// Validate reports every missing or malformed field at once.
+func (c *AppConfig) Validate() error {
+	var errs []error
+
+	missing := func(field, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", field))
+		}
+	}
+
+	absoluteURL := func(field, value string) {
+		if value == "" {
+			return
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: %q is not an absolute URL", field, value))
+		}
+	}
+
+	port := func(field string, value int) {
+		if value < 1 || value > 65535 {
+			errs = append(errs, fmt.Errorf("%s: %d is not a valid port", field, value))
+		}
+	}
+
+	if c.Github.ClientID == "" && len(c.Providers) == 0 {
+		errs = append(errs, errors.New("github.client_id or at least one providers entry is required"))
+	}
+
+	if c.Github.ClientID != "" {
+		missing("github.client_secret", c.Github.ClientSecret)
+		missing("github.redirect_url", c.Github.RedirectURL)
+		absoluteURL("github.redirect_url", c.Github.RedirectURL)
+	}
+
+	for i, provider := range c.Providers {
+		prefix := fmt.Sprintf("providers[%d]", i)
+		missing(prefix+".name", provider.Name)
+		missing(prefix+".client_id", provider.ClientID)
+		missing(prefix+".client_secret", provider.ClientSecret)
+		missing(prefix+".redirect_url", provider.RedirectURL)
+		absoluteURL(prefix+".redirect_url", provider.RedirectURL)
+
+		switch provider.Type {
+		case ProviderTypeGithub, ProviderTypeGitlab:
+		case ProviderTypeOIDC:
+			missing(prefix+".issuer_url", provider.IssuerURL)
+		default:
+			errs = append(errs, fmt.Errorf("%s.type: unknown provider type %q", prefix, provider.Type))
+		}
+	}
+
+	missing("user_list_url", c.UserListUrl)
+	absoluteURL("user_list_url", c.UserListUrl)
+
+	switch c.Backend {
+	case BackendProxmox:
+		errs = append(errs, c.validateProxmox()...)
+	case BackendDocker:
+		errs = append(errs, c.validateDocker()...)
+	default:
+		errs = append(errs, fmt.Errorf("backend: unknown backend %q", c.Backend))
+	}
+
+	for name, template := range c.Workspace.Templates {
+		if template != nil && template.Profile != "" && c.Workspace.Profiles[template.Profile] == nil {
+			errs = append(errs, fmt.Errorf("workspace.templates.%s.profile: profile %q is not defined", name, template.Profile))
+		}
+	}
+
+	if len(c.Workspace.Templates) > 0 && c.Workspace.Templates[c.Workspace.DefaultTemplate] == nil {
+		errs = append(errs, fmt.Errorf("workspace.default_template: template %q is not defined", c.Workspace.DefaultTemplate))
+	}
+
+	if c.Workspace.VMIDRangeStart <= 0 || c.Workspace.VMIDRangeEnd < c.Workspace.VMIDRangeStart {
+		errs = append(errs, fmt.Errorf("workspace.vmid_range_start/vmid_range_end: invalid range %d-%d", c.Workspace.VMIDRangeStart, c.Workspace.VMIDRangeEnd))
+	}
+
+	if _, pool, err := net.ParseCIDR(c.Workspace.IPPool); err != nil || pool.IP.To4() == nil {
+		errs = append(errs, fmt.Errorf("workspace.ip_pool: %q is not an IPv4 CIDR", c.Workspace.IPPool))
+	}
+
+	if c.Workspace.Gateway != "" && net.ParseIP(c.Workspace.Gateway) == nil {
+		errs = append(errs, fmt.Errorf("workspace.gateway: %q is not an IP address", c.Workspace.Gateway))
+	}
+
+	if c.Workspace.DefaultProfile != "" && c.Workspace.Profiles[c.Workspace.DefaultProfile] == nil {
+		errs = append(errs, fmt.Errorf("workspace.default_profile: profile %q is not defined", c.Workspace.DefaultProfile))
+	}
+
+	for name, profile := range c.Workspace.Profiles {
+		if profile == nil || profile.MemSize < 0 || profile.CPUCores < 0 || profile.StorageSize < 0 {
+			errs = append(errs, fmt.Errorf("workspace.profiles.%s: sizes must be positive", name))
+		}
+	}
+
+	switch c.Workspace.CodeServerAuth {
+	case CodeServerAuthNone, CodeServerAuthPassword:
+	default:
+		errs = append(errs, fmt.Errorf("workspace.code_server_auth: unknown mode %q", c.Workspace.CodeServerAuth))
+	}
+
+	if q := c.Workspace.Quota; q != nil && (q.MaxRunning < 0 || q.MaxRunningPerUser < 0 || q.MaxMemory < 0 || q.MaxCores < 0) {
+		errs = append(errs, errors.New("workspace.quota: limits must be positive, or zero to disable"))
+	}
+
+	port("server.port", c.Server.Port)
+	absoluteURL("server.public_url", c.Server.PublicURL)
+
+	port("caddy.port", c.Caddy.Port)
+	port("caddy.upstream_port", c.Caddy.UpstreamPort)
+	missing("caddy.base_url", c.Caddy.BaseURL)
+	missing("caddy.auth_upstream", c.Caddy.AuthUpstream)
+
+	if c.Idle != nil {
+		switch c.Idle.Action {
+		case "", "stop", "hibernate":
+		default:
+			errs = append(errs, fmt.Errorf("idle.action: unknown action %q", c.Idle.Action))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// validateProxmox checks the connection settings and that every template names a
+// Proxmox template container.
+func (c *AppConfig) validateProxmox() []error {
+	var errs []error
+
+	missing := func(field, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", field))
+		}
+	}
+
+	missing("proxmox.host", c.Proxmox.Host)
+	if strings.Contains(c.Proxmox.Host, "://") {
+		errs = append(errs, fmt.Errorf("proxmox.host: %q must be host:port without a scheme", c.Proxmox.Host))
+	}
+	missing("proxmox.node", c.Proxmox.Node)
+	if c.Proxmox.UsesToken() {
+		if !strings.Contains(c.Proxmox.TokenID, "!") {
+			errs = append(errs, fmt.Errorf("proxmox.token_id: %q must be user@realm!tokenid", c.Proxmox.TokenID))
+		}
+		missing("proxmox.token_secret", c.Proxmox.TokenSecret)
+	} else {
+		missing("proxmox.username", c.Proxmox.Username)
+		missing("proxmox.password", c.Proxmox.Password)
+	}
+	if c.Proxmox.Fingerprint != "" {
+		if _, err := ParseFingerprint(c.Proxmox.Fingerprint); err != nil {
+			errs = append(errs, fmt.Errorf("proxmox.fingerprint: %v", err))
+		}
+	}
+	missing("proxmox.storage_name", c.Proxmox.StorageName)
+
+	if c.Proxmox.TemplateID <= 0 && len(c.Workspace.Templates) == 0 {
+		errs = append(errs, errors.New("proxmox.template_id or workspace.templates is required"))
+	}
+
+	for name, template := range c.Workspace.Templates {
+		if template == nil || template.TemplateID <= 0 {
+			errs = append(errs, fmt.Errorf("workspace.templates.%s.template_id is required", name))
+		}
+	}
+
+	if placement := c.Proxmox.Placement; placement != nil {
+		switch placement.Strategy {
+		case PlacementLeastMemory, PlacementRoundRobin, PlacementPinned:
+		default:
+			errs = append(errs, fmt.Errorf("proxmox.placement.strategy: unknown strategy %q", placement.Strategy))
+		}
+	}
+
+	return errs
+}
+
+// validateDocker checks that every template resolves to an image. Docker hands the
+// gateway address to the host, so it has to be known to keep it out of the pool.
+func (c *AppConfig) validateDocker() []error {
+	var errs []error
+
+	if c.Docker.Network == "" {
+		errs = append(errs, errors.New("docker.network is required"))
+	}
+
+	if c.Workspace.Gateway == "" {
+		errs = append(errs, errors.New("workspace.gateway is required with the docker backend"))
+	}
+
+	if len(c.Workspace.Templates) == 0 && c.Docker.Image == "" {
+		errs = append(errs, errors.New("docker.image or workspace.templates is required"))
+	}
+
+	for name, template := range c.Workspace.Templates {
+		if (template == nil || template.Image == "") && c.Docker.Image == "" {
+			errs = append(errs, fmt.Errorf("workspace.templates.%s.image is required without docker.image", name))
+		}
+	}
+
+	return errs
+}
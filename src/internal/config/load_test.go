@@ -0,0 +1,340 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+github:
+  client_id: launcher
+  client_secret: launcher-secret
+  redirect_url: http://launcher.test/callback
+user_list_url: http://launcher.test/users.json
+caddy:
+  base_url: code.test
+  auth_upstream: 127.0.0.1:8080
+workspace:
+  vmid_range_start: 200
+  vmid_range_end: 299
+  ip_pool: 10.0.0.0/24
+  gateway: 10.0.0.1
+proxmox:
+  host: pve.test:8006
+  node: pve
+  username: root@pam
+  password: secret
+  template_id: 100
+  storage_name: local-lvm
+`
+
+// writeConfig writes a YAML config with the given lines appended to the test
+// config and returns its path.
+func writeConfig(t *testing.T, extra ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := testConfig + strings.Join(extra, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	return path
+}
+
+// writeSecret writes a secret file with a trailing newline, as editors leave it.
+func writeSecret(t *testing.T, value string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(value+"\n"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load(writeConfig(t))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if cfg.Backend != BackendProxmox || cfg.Server.Port != 8080 || cfg.Caddy.Port != 2019 {
+		t.Errorf("defaults = %s, %d, %d, want proxmox, 8080, 2019", cfg.Backend, cfg.Server.Port, cfg.Caddy.Port)
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*AppConfig)
+		want   []string
+	}{
+		{
+			name:   "missing user list",
+			modify: func(c *AppConfig) { c.UserListUrl = "" },
+			want:   []string{"user_list_url is required"},
+		},
+		{
+			name: "bad urls and ports",
+			modify: func(c *AppConfig) {
+				c.Github.RedirectURL = "/callback"
+				c.Server.Port = 70000
+				c.Caddy.UpstreamPort = -1
+			},
+			want: []string{
+				`github.redirect_url: "/callback" is not an absolute URL`,
+				"server.port: 70000 is not a valid port",
+				"caddy.upstream_port: -1 is not a valid port",
+			},
+		},
+		{
+			name: "proxmox connection",
+			modify: func(c *AppConfig) {
+				c.Proxmox.Host = "https://pve.test:8006"
+				c.Proxmox.Password = ""
+				c.Proxmox.Fingerprint = "not-hex"
+			},
+			want: []string{
+				"proxmox.host: \"https://pve.test:8006\" must be host:port without a scheme",
+				"proxmox.password is required",
+				"proxmox.fingerprint",
+			},
+		},
+		{
+			name: "network",
+			modify: func(c *AppConfig) {
+				c.Workspace.IPPool = "10.0.0.0"
+				c.Workspace.Gateway = "gateway"
+				c.Workspace.VMIDRangeEnd = 100
+			},
+			want: []string{
+				`workspace.ip_pool: "10.0.0.0" is not an IPv4 CIDR`,
+				`workspace.gateway: "gateway" is not an IP address`,
+				"invalid range 200-100",
+			},
+		},
+		{
+			name: "unknown names",
+			modify: func(c *AppConfig) {
+				c.Backend = "kvm"
+				c.Workspace.DefaultProfile = "large"
+				c.Idle = &IdleConfig{Action: "delete"}
+			},
+			want: []string{
+				`backend: unknown backend "kvm"`,
+				`workspace.default_profile: profile "large" is not defined`,
+				`idle.action: unknown action "delete"`,
+			},
+		},
+		{
+			name: "docker backend",
+			modify: func(c *AppConfig) {
+				c.Backend = BackendDocker
+				c.Workspace.Gateway = ""
+			},
+			want: []string{
+				"docker.network is required",
+				"workspace.gateway is required with the docker backend",
+				"docker.image or workspace.templates is required",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(testConfig), ".yaml")
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			cfg.applyEnv(func(string) (string, bool) { return "", false })
+			cfg.SetDefaults()
+
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("validate of the test config: %v", err)
+			}
+
+			test.modify(cfg)
+
+			err = cfg.Validate()
+			if err == nil {
+				t.Fatalf("validate = nil, want %d errors", len(test.want))
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validate = %v, want it to report %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDockerNeedsNoProxmox(t *testing.T) {
+	cfg, err := Parse([]byte(`
+github:
+  client_id: launcher
+  client_secret: launcher-secret
+  redirect_url: http://launcher.test/callback
+user_list_url: http://launcher.test/users.json
+caddy:
+  base_url: code.test
+  auth_upstream: 127.0.0.1:8080
+backend: docker
+docker:
+  network: launcher
+  image: codercom/code-server
+workspace:
+  vmid_range_start: 200
+  vmid_range_end: 299
+  ip_pool: 172.30.0.0/24
+  gateway: 172.30.0.1
+`), ".yaml")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cfg.applyEnv(func(string) (string, bool) { return "", false })
+	cfg.SetDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("validate = %v, want a Docker config without a proxmox section accepted", err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	passwordFile := writeSecret(t, "from-file")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		extra []string
+		check func(*AppConfig) string
+		err   string
+	}{
+		{
+			name: "strings and numbers",
+			env: map[string]string{
+				"CSL_PROXMOX_HOST": "other.test:8006",
+				"CSL_SERVER_PORT":  "9090",
+			},
+			check: func(c *AppConfig) string {
+				if c.Proxmox.Host != "other.test:8006" || c.Server.Port != 9090 {
+					return "host and port not overridden"
+				}
+				return ""
+			},
+		},
+		{
+			name: "sections missing from the file",
+			env: map[string]string{
+				"CSL_SESSION_SECRET": "env-secret",
+				"CSL_DOCKER_NETWORK": "launcher",
+			},
+			check: func(c *AppConfig) string {
+				if c.Session.Secret != "env-secret" || c.Docker.Network != "launcher" {
+					return "session and docker sections not created"
+				}
+				return ""
+			},
+		},
+		{
+			name:  "secret wins over file",
+			env:   map[string]string{"CSL_PROXMOX_PASSWORD": "from-env"},
+			extra: []string{"  password_file: " + passwordFile},
+			check: func(c *AppConfig) string {
+				if c.Proxmox.Password != "from-env" || c.Proxmox.PasswordFile != "" {
+					return "password file used over the environment"
+				}
+				return ""
+			},
+		},
+		{
+			name: "malformed number",
+			env:  map[string]string{"CSL_CADDY_PORT": "admin"},
+			err:  `CSL_CADDY_PORT: "admin" is not a number`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := Load(writeConfig(t, test.extra...))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("load = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			if problem := test.check(cfg); problem != "" {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name  string
+		extra []string
+		field func(*AppConfig) string
+		want  string
+		err   string
+	}{
+		{
+			name: "proxmox password",
+			extra: []string{
+				"  password_file: " + writeSecret(t, "pve-secret"),
+			},
+			field: func(c *AppConfig) string { return c.Proxmox.Password },
+			want:  "pve-secret",
+		},
+		{
+			name: "provider secret",
+			extra: []string{
+				"providers:",
+				"  - name: gitlab",
+				"    type: gitlab",
+				"    client_id: launcher",
+				"    client_secret_file: " + writeSecret(t, "gitlab-secret"),
+				"    redirect_url: http://launcher.test/callback/gitlab",
+			},
+			field: func(c *AppConfig) string { return c.Providers[0].ClientSecret },
+			want:  "gitlab-secret",
+		},
+		{
+			name:  "missing file",
+			extra: []string{"  token_secret_file: " + missing},
+			err:   "proxmox.token_secret_file",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := Load(writeConfig(t, test.extra...))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("load = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			if got := test.field(cfg); got != test.want {
+				t.Errorf("secret = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
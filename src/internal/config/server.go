@@ -1,48 +1,287 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
 type AppConfig struct {
-	Github      *GithubConfig  `json:"github"`
-	Proxmox     *ProxmoxConfig `json:"proxmox"`
-	Server      *ServerConfig  `json:"server"`
-	UserListUrl string         `json:"user_list_url"`
-	Caddy       *CaddyConfig   `json:"caddy"`
+	Github      *GithubConfig     `json:"github"`
+	Providers   []*ProviderConfig `json:"providers"`
+	Backend     Backend           `json:"backend"`
+	Workspace   *WorkspaceConfig  `json:"workspace"`
+	Proxmox     *ProxmoxConfig    `json:"proxmox"`
+	Docker      *DockerConfig     `json:"docker"`
+	Server      *ServerConfig     `json:"server"`
+	UserListUrl string            `json:"user_list_url"`
+	Caddy       *CaddyConfig      `json:"caddy"`
+	Session     *SessionConfig    `json:"session"`
+	StateFile   string            `json:"state_file"`
+	Idle        *IdleConfig       `json:"idle"`
+	Admins      []string          `json:"admins"`
 }
 
+// Backend selects what workspaces run on.
+type Backend string
+
+const (
+	BackendProxmox Backend = "proxmox"
+	BackendDocker  Backend = "docker"
+)
+
 type GithubConfig struct {
 	oauth2.Config
-	GithubUrl string `json:"github_url"`
+	ClientSecretFile string   `json:"client_secret_file"`
+	GithubUrl        string   `json:"github_url"`
+	AllowedOrgs      []string `json:"allowed_orgs"`
+	AllowedTeams     []string `json:"allowed_teams"`
+}
+
+type ProviderType string
+
+const (
+	ProviderTypeGithub ProviderType = "github"
+	ProviderTypeGitlab ProviderType = "gitlab"
+	ProviderTypeOIDC   ProviderType = "oidc"
+)
+
+type ProviderConfig struct {
+	Name             string       `json:"name"`
+	Type             ProviderType `json:"type"`
+	DisplayName      string       `json:"display_name"`
+	ClientID         string       `json:"client_id"`
+	ClientSecret     string       `json:"client_secret"`
+	ClientSecretFile string       `json:"client_secret_file"`
+	RedirectURL      string       `json:"redirect_url"`
+	BaseURL          string       `json:"base_url"`
+	IssuerURL        string       `json:"issuer_url"`
+	Scopes           []string     `json:"scopes"`
+	AllowedOrgs      []string     `json:"allowed_orgs"`
+	AllowedTeams     []string     `json:"allowed_teams"`
 }
 
 type ServerConfig struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	PublicURL    string `json:"public_url"`
+	ReadyTimeout int    `json:"ready_timeout"`
+	// ReconcileInterval is how often, in seconds, workspaces are compared with
+	// their containers and routes.
+	ReconcileInterval int `json:"reconcile_interval"`
+	// RequestTimeout bounds, in seconds, each call to another service: the OAuth
+	// provider and user list for the server, the admin API for Caddy.
+	RequestTimeout int `json:"request_timeout"`
+	// ShutdownTimeout is how long, in seconds, a shutdown waits for provisioning
+	// jobs in flight before cancelling them.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+}
+
+type SessionConfig struct {
+	Secret          string `json:"secret"`
+	TTL             int    `json:"ttl"`
+	CookieDomain    string `json:"cookie_domain"`
+	InsecureCookies bool   `json:"insecure_cookies"`
+}
+
+type IdleConfig struct {
+	Timeout       int    `json:"timeout"`
+	Action        string `json:"action"`
+	CheckInterval int    `json:"check_interval"`
 }
 
 type CaddyConfig struct {
 	ServerConfig
-	TlsCert        string `json:"tls_cert"`
-	BaseURL        string `json:"base_url"`
-	BaseInternalIP string `json:"base_internal_ip"`
+	TlsCert      string `json:"tls_cert"`
+	BaseURL      string `json:"base_url"`
+	UpstreamPort int    `json:"upstream_port"`
+	AuthUpstream string `json:"auth_upstream"`
+	// ServerName is the HTTP server of the Caddy config the workspace routes are
+	// added to, srv0 for a config adapted from a Caddyfile.
+	ServerName string `json:"server_name"`
+}
+
+// WorkspaceConfig holds the workspace settings every backend shares: catalog,
+// sizes and profiles, quota, VMID range and IP pool.
+type WorkspaceConfig struct {
+	MemSize         int                         `json:"memory_size"`
+	CPUCores        int                         `json:"cpu_cores"`
+	StorageSize     int                         `json:"storage_size"`
+	VMIDRangeStart  int                         `json:"vmid_range_start"`
+	VMIDRangeEnd    int                         `json:"vmid_range_end"`
+	IPPool          string                      `json:"ip_pool"`
+	Gateway         string                      `json:"gateway"`
+	Profiles        map[string]*ResourceProfile `json:"profiles"`
+	DefaultProfile  string                      `json:"default_profile"`
+	Quota           *QuotaConfig                `json:"quota"`
+	Templates       map[string]*TemplateConfig  `json:"templates"`
+	DefaultTemplate string                      `json:"default_template"`
+	CodeServerAuth  CodeServerAuth              `json:"code_server_auth"`
 }
 
+// ProxmoxConfig holds the Proxmox connection and how containers are cloned on it.
 type ProxmoxConfig struct {
-	Host             string `json:"host"`
-	Node             string `json:"node"`
-	Username         string `json:"username"`
-	Password         string `json:"password"`
-	TemplateID       int    `json:"template_id"`
-	MemSize          int    `json:"memory_size"`
-	CPUCores         int    `json:"cpu_cores"`
-	StorageName      string `json:"storage_name"`
-	StorageSize      int    `json:"storage_size"`
-	NetworkInterface string `json:"network_interface"`
-	BaseIP           string `json:"base_ip"`
-	TimetoStart      int    `json:"time_to_start"`
+	Host             string           `json:"host"`
+	Node             string           `json:"node"`
+	Username         string           `json:"username"`
+	Password         string           `json:"password"`
+	PasswordFile     string           `json:"password_file"`
+	TokenID          string           `json:"token_id"`
+	TokenSecret      string           `json:"token_secret"`
+	TokenSecretFile  string           `json:"token_secret_file"`
+	CAFile           string           `json:"ca_file"`
+	Fingerprint      string           `json:"fingerprint"`
+	InsecureTLS      bool             `json:"insecure_skip_verify"`
+	TemplateID       int              `json:"template_id"`
+	StorageName      string           `json:"storage_name"`
+	NetworkInterface string           `json:"network_interface"`
+	TimetoStart      int              `json:"time_to_start"`
+	TaskTimeout      int              `json:"task_timeout"`
+	Placement        *PlacementConfig `json:"placement"`
+}
+
+// DockerConfig runs workspaces as containers of the local Docker Engine, attached
+// to Network with a static address from the IP pool. The network is created with
+// the pool as its subnet when it does not exist.
+type DockerConfig struct {
+	Socket  string `json:"socket"`
+	Network string `json:"network"`
+	Image   string `json:"image"`
+}
+
+// UsesToken reports whether the API is accessed with an API token, given as
+// user@realm!tokenid, instead of a username and password.
+func (p *ProxmoxConfig) UsesToken() bool {
+	return p.TokenID != ""
+}
+
+// ParseFingerprint decodes a SHA-256 certificate fingerprint as shown by Proxmox,
+// hex with or without colons.
+func ParseFingerprint(fingerprint string) ([]byte, error) {
+	ret, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(ret) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a SHA-256 fingerprint", fingerprint)
+	}
+
+	return ret, nil
+}
+
+// CodeServerAuth is the authentication code-server itself applies behind the
+// launcher forward auth.
+type CodeServerAuth string
+
+const (
+	CodeServerAuthNone     CodeServerAuth = "none"
+	CodeServerAuthPassword CodeServerAuth = "password"
+)
+
+type PlacementStrategy string
+
+const (
+	PlacementLeastMemory PlacementStrategy = "least-memory"
+	PlacementRoundRobin  PlacementStrategy = "round-robin"
+	PlacementPinned      PlacementStrategy = "pinned"
+)
+
+// PlacementConfig spreads new workspaces over the cluster. Nodes restricts the
+// candidates, all online nodes otherwise. Without it everything lands on Node.
+type PlacementConfig struct {
+	Strategy PlacementStrategy `json:"strategy"`
+	Nodes    []string          `json:"nodes"`
+}
+
+// TemplateConfig is a catalog entry users pick when creating a workspace. Profile
+// sizes workspaces cloned from it unless the user has a profile of their own.
+// TemplateID and Node are read by the Proxmox backend, Image by the Docker one.
+type TemplateConfig struct {
+	DisplayName string `json:"display_name"`
+	TemplateID  int    `json:"template_id"`
+	Image       string `json:"image"`
+	Profile     string `json:"profile"`
+	Node        string `json:"node"`
+}
+
+type ResourceProfile struct {
+	MemSize     int `json:"memory_size"`
+	CPUCores    int `json:"cpu_cores"`
+	StorageSize int `json:"storage_size"`
+}
+
+// QuotaConfig limits running workspaces; zero disables a limit. MaxMemory, in MB,
+// and MaxCores bound what is committed on each node.
+type QuotaConfig struct {
+	MaxRunning        int `json:"max_running"`
+	MaxRunningPerUser int `json:"max_running_per_user"`
+	MaxMemory         int `json:"max_memory"`
+	MaxCores          int `json:"max_cores"`
+}
+
+// Profile resolves a profile name, falling back to the default profile and then to
+// the top-level sizes for anything a profile leaves unset.
+func (p *WorkspaceConfig) Profile(name string) (string, ResourceProfile) {
+	profile, ok := p.Profiles[name]
+	if !ok {
+		name = p.DefaultProfile
+		profile, ok = p.Profiles[name]
+	}
+
+	if !ok {
+		name = ""
+		profile = &ResourceProfile{}
+	}
+
+	ret := *profile
+	if ret.MemSize == 0 {
+		ret.MemSize = p.MemSize
+	}
+	if ret.CPUCores == 0 {
+		ret.CPUCores = p.CPUCores
+	}
+	if ret.StorageSize == 0 {
+		ret.StorageSize = p.StorageSize
+	}
+
+	return name, ret
+}
+
+// Template resolves a catalog entry, the default template for an empty name. Without
+// a catalog a "default" template is offered, which the backends fill in with
+// proxmox.template_id or docker.image.
+func (p *WorkspaceConfig) Template(name string) (string, *TemplateConfig, bool) {
+	if len(p.Templates) == 0 {
+		if name != "" && name != "default" {
+			return "", nil, false
+		}
+
+		return "default", &TemplateConfig{DisplayName: "Default"}, true
+	}
+
+	if name == "" {
+		name = p.DefaultTemplate
+	}
+
+	template, ok := p.Templates[name]
+	return name, template, ok
+}
+
+// TemplateNames lists the catalog in a stable order.
+func (p *WorkspaceConfig) TemplateNames() []string {
+	if len(p.Templates) == 0 {
+		return []string{"default"}
+	}
+
+	ret := make([]string, 0, len(p.Templates))
+	for name := range p.Templates {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+
+	return ret
 }
 
 func NewGithubAuth(clientID, clientSecret, redirectURL, githubUrl string) *GithubConfig {
@@ -59,6 +298,14 @@ func NewGithubAuth(clientID, clientSecret, redirectURL, githubUrl string) *Githu
 }
 
 func (g *GithubConfig) GetOAuth() *oauth2.Config {
+	if g.Endpoint.AuthURL == "" {
+		g.Endpoint = github.Endpoint
+	}
+
+	if len(g.Scopes) == 0 {
+		g.Scopes = []string{"user:email"}
+	}
+
 	return &g.Config
 }
 
@@ -69,18 +316,14 @@ func NewServer(host string, port int) *ServerConfig {
 	}
 }
 
-func NewProxmox(host, node, username, password string, vmTemplateID, memSize, cpuCores int, storageName string, storageSize int, baseIP string, networkInterface string, timeToStart int) *ProxmoxConfig {
+func NewProxmox(host, node, username, password string, vmTemplateID int, storageName string, networkInterface string, timeToStart int) *ProxmoxConfig {
 	return &ProxmoxConfig{
 		Host:             host,
 		Node:             node,
 		Username:         username,
 		Password:         password,
 		TemplateID:       vmTemplateID,
-		MemSize:          memSize,
-		CPUCores:         cpuCores,
 		StorageName:      storageName,
-		StorageSize:      storageSize,
-		BaseIP:           baseIP,
 		NetworkInterface: networkInterface,
 		TimetoStart:      timeToStart,
 	}
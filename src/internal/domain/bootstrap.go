@@ -0,0 +1,40 @@
+package domain
+
+// Bootstrap is what a new workspace container is set up with for its owner: the
+// SSH keys to log in with, code-server authentication and git identity.
+type Bootstrap struct {
+	Hostname string   `json:"hostname"`
+	Owner    string   `json:"owner"`
+	Login    string   `json:"login"`
+	SSHKeys  []string `json:"ssh_keys"`
+	// Auth is "none" or "password", as accepted by code-server --auth.
+	Auth     string `json:"auth"`
+	Password string `json:"password,omitempty"`
+	GitName  string `json:"git_name"`
+	GitEmail string `json:"git_email,omitempty"`
+}
+
+// NewBootstrap describes ws for user. Password authentication only applies once the
+// workspace has a password; the git name falls back to the login.
+func NewBootstrap(user *User, ws *Workspace) *Bootstrap {
+	ret := &Bootstrap{
+		Hostname: ws.Hostname(),
+		Owner:    user.Key(),
+		Login:    user.Login,
+		SSHKeys:  user.SSHKeys(),
+		Auth:     "none",
+		GitName:  user.Name,
+		GitEmail: user.Email,
+	}
+
+	if ws.Password != "" {
+		ret.Auth = "password"
+		ret.Password = ws.Password
+	}
+
+	if ret.GitName == "" {
+		ret.GitName = user.Login
+	}
+
+	return ret
+}
@@ -0,0 +1,39 @@
+package domain
+
+import "time"
+
+type EventKind string
+
+const (
+	EventLogin           EventKind = "login"
+	EventEnroll          EventKind = "enroll"
+	EventUnenroll        EventKind = "unenroll"
+	EventAllocate        EventKind = "allocate"
+	EventRelease         EventKind = "release"
+	EventContainerStatus EventKind = "container_status"
+	EventRouteInsert     EventKind = "route_insert"
+	EventRouteRemove     EventKind = "route_remove"
+	EventAdminAction     EventKind = "admin_action"
+	EventProvisionReady  EventKind = "provision_ready"
+	EventProvisionFailed EventKind = "provision_failed"
+	EventReconcile       EventKind = "reconcile"
+	EventQuotaExceeded   EventKind = "quota_exceeded"
+	EventMigrate         EventKind = "migrate"
+	EventBootstrap       EventKind = "bootstrap"
+)
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    EventKind `json:"kind"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+}
+
+func NewEvent(kind EventKind, subject, message string) *Event {
+	return &Event{
+		Time:    time.Now(),
+		Kind:    kind,
+		Subject: subject,
+		Message: message,
+	}
+}
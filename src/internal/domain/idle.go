@@ -0,0 +1,40 @@
+package domain
+
+import "time"
+
+type IdleAction string
+
+const (
+	IdleActionHibernate IdleAction = "hibernate"
+	IdleActionStop      IdleAction = "stop"
+)
+
+type IdlePolicy struct {
+	Timeout time.Duration
+	Action  IdleAction
+}
+
+// PolicyFor applies the user overrides on top of the global policy.
+func (p IdlePolicy) PolicyFor(user *User) IdlePolicy {
+	ret := p
+
+	if user == nil {
+		return ret
+	}
+
+	if user.IdleTimeout < 0 {
+		ret.Timeout = 0
+	} else if user.IdleTimeout > 0 {
+		ret.Timeout = time.Duration(user.IdleTimeout) * time.Minute
+	}
+
+	if user.IdleAction != "" {
+		ret.Action = user.IdleAction
+	}
+
+	return ret
+}
+
+func (p IdlePolicy) Enabled() bool {
+	return p.Timeout > 0
+}
@@ -0,0 +1,60 @@
+package domain
+
+import "time"
+
+// JobPhase is the step a provisioning job is at. A job is waiting once its route
+// is in place, until code-server answers behind it.
+type JobPhase string
+
+const (
+	JobPhasePending     JobPhase = "pending"
+	JobPhaseCloning     JobPhase = "cloning"
+	JobPhaseConfiguring JobPhase = "configuring"
+	JobPhaseStarting    JobPhase = "starting"
+	JobPhaseRouting     JobPhase = "routing"
+	JobPhaseWaiting     JobPhase = "waiting"
+	JobPhaseReady       JobPhase = "ready"
+	JobPhaseFailed      JobPhase = "failed"
+)
+
+// TaskRunning is the status of a task that has not finished yet; a finished task
+// has its exit status, "OK" on success.
+const TaskRunning = "running"
+
+// Task is the Proxmox task, such as a clone or a start, a job is waiting on. Log
+// holds the last lines of the task log when it failed.
+type Task struct {
+	UPID      string    `json:"upid"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Log       []string  `json:"log,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type Job struct {
+	Owner     string    `json:"owner"`
+	Login     string    `json:"login"`
+	Workspace string    `json:"workspace"`
+	Phase     JobPhase  `json:"phase"`
+	Task      *Task     `json:"task,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewJob(user *User, workspace string) *Job {
+	now := time.Now()
+	return &Job{
+		Owner:     user.Key(),
+		Login:     user.Login,
+		Workspace: workspace,
+		Phase:     JobPhasePending,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (j *Job) Done() bool {
+	return j.Phase == JobPhaseReady || j.Phase == JobPhaseFailed
+}
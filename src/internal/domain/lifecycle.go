@@ -0,0 +1,56 @@
+package domain
+
+// LifecycleAction is what bringing a workspace up takes from a container status.
+type LifecycleAction string
+
+const (
+	LifecycleNone   LifecycleAction = "none"
+	LifecycleCreate LifecycleAction = "create"
+	LifecycleStart  LifecycleAction = "start"
+	LifecycleResume LifecycleAction = "resume"
+	// LifecycleWait is for transient statuses, which settle on their own.
+	LifecycleWait LifecycleAction = "wait"
+	// LifecycleFail is for statuses no workspace container should be in.
+	LifecycleFail LifecycleAction = "fail"
+)
+
+// lifecycle covers every VmStatus. Unknown means the node did not report, which
+// is waited out like a lock; a template under a workspace VMID needs an admin.
+var lifecycle = map[VmStatus]LifecycleAction{
+	VmStatusRunning:   LifecycleNone,
+	VmStatusMissing:   LifecycleCreate,
+	VmStatusStopped:   LifecycleStart,
+	VmStatusPaused:    LifecycleResume,
+	VmStatusSuspended: LifecycleResume,
+	VmStatusStarting:  LifecycleWait,
+	VmStatusStopping:  LifecycleWait,
+	VmStatusLocked:    LifecycleWait,
+	VmStatusMigration: LifecycleWait,
+	VmStatusUnknown:   LifecycleWait,
+	VmStatusTemplate:  LifecycleFail,
+}
+
+// UpAction returns the next step to get a container in status running. Statuses
+// the backend added since are treated as unknown.
+func UpAction(status VmStatus) LifecycleAction {
+	if action, ok := lifecycle[status]; ok {
+		return action
+	}
+
+	return LifecycleWait
+}
+
+// Transient reports whether the status settles without the launcher acting.
+func (s VmStatus) Transient() bool {
+	return UpAction(s) == LifecycleWait
+}
+
+// DesiredState is what the owner last asked of a workspace, which the reconciler
+// brings the container back to.
+type DesiredState string
+
+const (
+	DesiredRunning    DesiredState = "running"
+	DesiredStopped    DesiredState = "stopped"
+	DesiredHibernated DesiredState = "hibernated"
+)
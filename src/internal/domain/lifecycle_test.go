@@ -0,0 +1,48 @@
+package domain
+
+import "testing"
+
+func TestUpActionCoversEveryStatus(t *testing.T) {
+	tests := map[VmStatus]LifecycleAction{
+		VmStatusRunning:   LifecycleNone,
+		VmStatusMissing:   LifecycleCreate,
+		VmStatusStopped:   LifecycleStart,
+		VmStatusPaused:    LifecycleResume,
+		VmStatusSuspended: LifecycleResume,
+		VmStatusStarting:  LifecycleWait,
+		VmStatusStopping:  LifecycleWait,
+		VmStatusLocked:    LifecycleWait,
+		VmStatusMigration: LifecycleWait,
+		VmStatusUnknown:   LifecycleWait,
+		VmStatusTemplate:  LifecycleFail,
+		"prelaunch":       LifecycleWait,
+	}
+
+	for status, want := range tests {
+		if got := UpAction(status); got != want {
+			t.Errorf("UpAction(%s) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestParseVmInfoLocks(t *testing.T) {
+	tests := []struct {
+		raw  map[string]interface{}
+		want VmStatus
+	}{
+		{map[string]interface{}{"status": "running"}, VmStatusRunning},
+		{map[string]interface{}{"status": "running", "lock": "migrate"}, VmStatusMigration},
+		{map[string]interface{}{"status": "stopped", "lock": "backup"}, VmStatusLocked},
+		{map[string]interface{}{"status": "stopped", "template": 1}, VmStatusTemplate},
+	}
+
+	for _, tt := range tests {
+		info, err := ParseVmInfo(tt.raw)
+		if err != nil {
+			t.Fatalf("ParseVmInfo(%v): %v", tt.raw, err)
+		}
+		if info.Status != tt.want {
+			t.Errorf("ParseVmInfo(%v).Status = %s, want %s", tt.raw, info.Status, tt.want)
+		}
+	}
+}
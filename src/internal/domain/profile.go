@@ -0,0 +1,11 @@
+package domain
+
+type Profile struct {
+	Provider string   `json:"provider"`
+	Login    string   `json:"login"`
+	Email    string   `json:"email"`
+	Name     string   `json:"name"`
+	SSHKeys  []string `json:"ssh_keys"`
+	Orgs     []string `json:"orgs"`
+	Teams    []string `json:"teams"`
+}
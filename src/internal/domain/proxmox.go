@@ -10,6 +10,8 @@ type VmType string
 const (
 	VmTypeQemu VmType = "qemu"
 	VmTypeLXC  VmType = "lxc"
+	// VmTypeDocker marks containers of the Docker backend.
+	VmTypeDocker VmType = "docker"
 )
 
 type VmStatus string
@@ -40,6 +42,9 @@ type VmInfo struct {
 	Mem     uint64   `json:"mem"`
 	Disk    uint64   `json:"disk"`
 	MaxDisk uint64   `json:"maxdisk"`
+	// Lock is the Proxmox lock held on the guest, e.g. migrate or backup.
+	Lock     string `json:"lock,omitempty"`
+	Template int    `json:"template,omitempty"`
 }
 
 func ParseVmInfo(raw map[string]interface{}) (*VmInfo, error) {
@@ -54,5 +59,51 @@ func ParseVmInfo(raw map[string]interface{}) (*VmInfo, error) {
 		return nil, fmt.Errorf("failed to unmarshal VM info: %v", err)
 	}
 
+	// Proxmox keeps reporting running or stopped while a guest is locked.
+	switch {
+	case vmInfo.Template == 1:
+		vmInfo.Status = VmStatusTemplate
+	case vmInfo.Lock == "migrate":
+		vmInfo.Status = VmStatusMigration
+	case vmInfo.Lock != "":
+		vmInfo.Status = VmStatusLocked
+	}
+
 	return &vmInfo, nil
 }
+
+type NodeInfo struct {
+	Node   string  `json:"node"`
+	Status string  `json:"status"`
+	CPU    float64 `json:"cpu"`
+	MaxCPU int     `json:"maxcpu"`
+	Mem    uint64  `json:"mem"`
+	MaxMem uint64  `json:"maxmem"`
+}
+
+func ParseNodeInfo(raw map[string]interface{}) (*NodeInfo, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal node info: %v", err)
+	}
+
+	var nodeInfo NodeInfo
+	err = json.Unmarshal(data, &nodeInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal node info: %v", err)
+	}
+
+	return &nodeInfo, nil
+}
+
+func (n *NodeInfo) Online() bool {
+	return n.Status == "online"
+}
+
+func (n *NodeInfo) FreeMem() uint64 {
+	if n.Mem > n.MaxMem {
+		return 0
+	}
+
+	return n.MaxMem - n.Mem
+}
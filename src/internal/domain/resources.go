@@ -0,0 +1,33 @@
+package domain
+
+// Resources sizes a workspace container: memory in MB, CPU cores and root disk in GB.
+type Resources struct {
+	Memory int `json:"memory"`
+	Cores  int `json:"cores"`
+	Disk   int `json:"disk"`
+}
+
+// Usage is what the running workspaces have committed on the cluster, with memory
+// and cores summed per node.
+type Usage struct {
+	Running  int
+	PerOwner map[string]int
+	PerNode  map[string]Resources
+}
+
+func NewUsage() *Usage {
+	return &Usage{
+		PerOwner: map[string]int{},
+		PerNode:  map[string]Resources{},
+	}
+}
+
+func (u *Usage) Add(ws *Workspace) {
+	u.Running++
+	u.PerOwner[ws.Owner]++
+
+	committed := u.PerNode[ws.Node]
+	committed.Memory += ws.Resources.Memory
+	committed.Cores += ws.Resources.Cores
+	u.PerNode[ws.Node] = committed
+}
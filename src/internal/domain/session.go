@@ -0,0 +1,25 @@
+package domain
+
+import "time"
+
+type Session struct {
+	Provider  string    `json:"provider"`
+	Login     string    `json:"login"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func NewSession(provider, login string, ttl time.Duration) *Session {
+	return &Session{
+		Provider:  provider,
+		Login:     login,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+}
+
+func (s *Session) UserKey() string {
+	return UserKey(s.Provider, s.Login)
+}
+
+func (s *Session) Expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
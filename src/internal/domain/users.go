@@ -1,28 +1,169 @@
 package domain
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const DefaultProvider = "github"
+
 type User struct {
-	Login  string `json:"login"`
-	PubKey string `json:"pubkey"`
-	ID     int    `json:"id"`
+	Login    string `json:"login"`
+	Provider string `json:"provider"`
+	PubKey   string `json:"pubkey"`
+	// Name and Email come from the identity provider profile and set up git in new
+	// workspaces.
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	// IdleTimeout overrides the global idle timeout in minutes; negative disables it.
+	IdleTimeout int        `json:"idle_timeout,omitempty"`
+	IdleAction  IdleAction `json:"idle_action,omitempty"`
+	// Profile names the resource profile of the user's workspace; empty uses the default.
+	Profile string `json:"profile,omitempty"`
+	// Node pins the user's new workspaces to a cluster node under the pinned placement.
+	Node string `json:"node,omitempty"`
+	// Enrolled is set by the launcher on users let in by provider membership rather
+	// than the user list.
+	Enrolled bool `json:"enrolled,omitempty"`
 }
 
 type UserList struct {
-	Users []*User `json:"users"`
+	Users []*User  `json:"users"`
+	Deny  []string `json:"deny"`
 }
 
 func NewUserList() *UserList {
 	return &UserList{
 		Users: make([]*User, 0),
+		Deny:  make([]string, 0),
 	}
 }
 
-func NewUser(login string, id int) *User {
+func (l *UserList) DeniedKeys() map[string]bool {
+	return UserKeySet(l.Deny)
+}
+
+func NewUser(login string) *User {
 	return &User{
-		Login: login,
-		ID:    id,
+		Login:    login,
+		Provider: DefaultProvider,
+	}
+}
+
+func NewUserFromProfile(profile *Profile) *User {
+	return &User{
+		Login:    profile.Login,
+		Provider: profile.Provider,
+		PubKey:   strings.Join(profile.SSHKeys, "\n"),
+		Name:     profile.Name,
+		Email:    profile.Email,
 	}
 }
 
 func (u *User) SetPubKey(pubKey string) {
 	u.PubKey = pubKey
 }
+
+// SetIdentity keeps the name and email of the latest profile, leaving known values
+// in place when the provider returned none.
+func (u *User) SetIdentity(name, email string) {
+	if name != "" {
+		u.Name = name
+	}
+	if email != "" {
+		u.Email = email
+	}
+}
+
+// SSHKeys splits PubKey, which holds one key per line.
+func (u *User) SSHKeys() []string {
+	ret := []string{}
+	for _, line := range strings.Split(u.PubKey, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+
+	return ret
+}
+
+func (u *User) GetProvider() string {
+	if u.Provider == "" {
+		return DefaultProvider
+	}
+
+	return u.Provider
+}
+
+// Key identifies a user across identity providers.
+func (u *User) Key() string {
+	return UserKey(u.GetProvider(), u.Login)
+}
+
+// Slug is the DNS-safe name used for the user's subdomain and container, distinct
+// for every user key. It is made of labels joined by "--", which no label contains:
+// the bare login for the default provider, the login and provider for the others.
+// When either had to be changed to fit a DNS label, a hash of the key is added as a
+// third label, so that logins such as "alice.x" and "alice_x" get slugs of their own.
+func (u *User) Slug() string {
+	login, loginKept := dnsLabel(u.Login)
+	provider, providerKept := dnsLabel(u.GetProvider())
+
+	switch {
+	case loginKept && providerKept && u.GetProvider() == DefaultProvider:
+		return login
+	case loginKept && providerKept:
+		return login + "--" + provider
+	}
+
+	sum := sha256.Sum256([]byte(u.Key()))
+	return login + "--" + provider + "--" + hex.EncodeToString(sum[:4])
+}
+
+func UserKey(provider, login string) string {
+	if provider == "" {
+		provider = DefaultProvider
+	}
+
+	return provider + ":" + strings.ToLower(login)
+}
+
+// UserKeySet normalizes user references, which may be bare logins of the default
+// provider or "<provider>:<login>" keys.
+func UserKeySet(entries []string) map[string]bool {
+	ret := make(map[string]bool, len(entries))
+
+	for _, entry := range entries {
+		provider, login, ok := strings.Cut(entry, ":")
+		if !ok {
+			provider, login = DefaultProvider, entry
+		}
+
+		ret[UserKey(provider, login)] = true
+	}
+
+	return ret
+}
+
+// dnsLabel turns value into a DNS label without consecutive dashes, and reports
+// whether it was kept as it is, case aside.
+func dnsLabel(value string) (string, bool) {
+	var b strings.Builder
+
+	lower := strings.ToLower(value)
+	for _, r := range lower {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else if !strings.HasSuffix(b.String(), "-") {
+			b.WriteRune('-')
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if label == "" {
+		return "x", false
+	}
+
+	return label, label == lower
+}
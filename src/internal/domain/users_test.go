@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserSlug(t *testing.T) {
+	tests := []struct {
+		provider string
+		login    string
+		want     string
+	}{
+		{provider: "github", login: "octocat", want: "octocat"},
+		{provider: "github", login: "OctoCat", want: "octocat"},
+		{provider: "gitlab", login: "alice", want: "alice--gitlab"},
+		{provider: "gitlab", login: "alice-x", want: "alice-x--gitlab"},
+	}
+
+	for _, test := range tests {
+		user := &User{Provider: test.provider, Login: test.login}
+		if got := user.Slug(); got != test.want {
+			t.Errorf("slug of %s = %q, want %q", user.Key(), got, test.want)
+		}
+	}
+}
+
+func TestUserSlugsAreDistinct(t *testing.T) {
+	users := []*User{
+		{Provider: "github", Login: "alice"},
+		{Provider: "gitlab", Login: "alice"},
+		{Provider: "gitlab", Login: "alice-x"},
+		{Provider: "gitlab", Login: "alice.x"},
+		{Provider: "gitlab", Login: "alice_x"},
+		{Provider: "gitlab", Login: "alice--x"},
+		{Provider: "gitlab", Login: "alice-x--gitlab"},
+		{Provider: "oidc", Login: "alice@example.com"},
+		{Provider: "oidc", Login: "alice-example-com"},
+		{Provider: "oidc", Login: "-alice"},
+		{Provider: "oidc", Login: "..."},
+		{Provider: "oidc", Login: "___"},
+		{Provider: "my.idp", Login: "alice"},
+		{Provider: "my-idp", Login: "alice"},
+	}
+
+	seen := map[string]string{}
+	for _, user := range users {
+		slug := user.Slug()
+
+		if other, ok := seen[slug]; ok {
+			t.Errorf("%s and %s share the slug %q", other, user.Key(), slug)
+		}
+		seen[slug] = user.Key()
+
+		if slug == "" || len(slug) > 63 || strings.Trim(slug, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+			strings.HasPrefix(slug, "-") || strings.HasSuffix(slug, "-") {
+			t.Errorf("slug %q of %s is not a DNS label", slug, user.Key())
+		}
+	}
+}
+
+func TestWorkspaceSlugsAreDistinct(t *testing.T) {
+	workspaces := []struct {
+		user *User
+		name string
+	}{
+		{user: &User{Provider: "github", Login: "a"}, name: "dev"},
+		{user: &User{Provider: "github", Login: "dev-a"}},
+		{user: &User{Provider: "github", Login: "dev--a"}},
+		{user: &User{Provider: "github", Login: "dev---a"}},
+		{user: &User{Provider: "github", Login: "dev"}, name: "a"},
+		{user: &User{Provider: "gitlab", Login: "a"}, name: "dev"},
+		{user: &User{Provider: "gitlab", Login: "dev-a"}},
+		{user: &User{Provider: "github", Login: "gitlab"}, name: "a"},
+		{user: &User{Provider: "gitlab", Login: "a"}},
+	}
+
+	seen := map[string]string{}
+	for _, ws := range workspaces {
+		slug := WorkspaceSlug(ws.user, ws.name)
+		id := ws.user.Key() + "/" + ws.name
+
+		if other, ok := seen[slug]; ok {
+			t.Errorf("workspaces %s and %s share the slug %q", other, id, slug)
+		}
+		seen[slug] = id
+	}
+}
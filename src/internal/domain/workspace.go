@@ -0,0 +1,111 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultWorkspace is the workspace provisioned on login. It keeps the bare user slug
+// as its subdomain; the others are served from <name>---<user slug>.
+const DefaultWorkspace = "default"
+
+const maxWorkspaceName = 20
+
+type Workspace struct {
+	Owner    string   `json:"owner"`
+	Name     string   `json:"name"`
+	Template string   `json:"template,omitempty"`
+	Slug     string   `json:"slug"`
+	VMID     int      `json:"vmid"`
+	Node     string   `json:"node"`
+	IP       string   `json:"ip"`
+	Status   VmStatus `json:"status"`
+	// Desired is the state the owner last asked for, empty before the first start.
+	Desired DesiredState `json:"desired,omitempty"`
+	// RouteDisabled is set when an administrator took the route down; the reconciler
+	// leaves it down until the workspace is next started.
+	RouteDisabled bool      `json:"route_disabled,omitempty"`
+	Profile       string    `json:"profile,omitempty"`
+	Resources     Resources `json:"resources"`
+	// Password is the code-server password when code_server_auth is "password".
+	Password string `json:"password,omitempty"`
+	// BootstrappedAt is when the container fetched its set-up, zero until then and
+	// again once it is cloned anew.
+	BootstrappedAt time.Time `json:"bootstrapped_at,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+}
+
+func NewWorkspace(user *User, name, template string, vmid int, ip net.IP) *Workspace {
+	now := time.Now()
+	return &Workspace{
+		Owner:      user.Key(),
+		Name:       name,
+		Template:   template,
+		Slug:       WorkspaceSlug(user, name),
+		VMID:       vmid,
+		IP:         ip.String(),
+		Status:     VmStatusMissing,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+}
+
+// Hostname is the container hostname, also its guest name on Proxmox.
+func (w *Workspace) Hostname() string {
+	return "codeserver-" + w.Slug
+}
+
+// WorkspaceSlug joins the workspace name to the user slug with "---". User slugs
+// never hold three dashes in a row and names hold none, so the slug of a named
+// workspace cannot be the slug of another user's workspace.
+func WorkspaceSlug(user *User, name string) string {
+	if name == "" || name == DefaultWorkspace {
+		return user.Slug()
+	}
+
+	return name + "---" + user.Slug()
+}
+
+// ValidateWorkspaceName accepts short lowercase alphanumeric names, which keeps
+// <name>---<user slug> a valid DNS label.
+func ValidateWorkspaceName(name string) error {
+	if name == "" || len(name) > maxWorkspaceName {
+		return fmt.Errorf("workspace name must be 1 to %d characters long", maxWorkspaceName)
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return fmt.Errorf("workspace name %q may only contain lowercase letters and digits", name)
+		}
+	}
+
+	return nil
+}
+
+type RouteRecord struct {
+	Slug      string    `json:"slug"`
+	Host      string    `json:"host"`
+	Upstream  string    `json:"upstream"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewRouteRecord(slug, host, upstream string) *RouteRecord {
+	return &RouteRecord{
+		Slug:      slug,
+		Host:      host,
+		Upstream:  upstream,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Readiness is the outcome of the last readiness probe of code-server in a
+// workspace. Stage tells which check failed, "tcp" or "http".
+type Readiness struct {
+	Ready     bool      `json:"ready"`
+	Stage     string    `json:"stage,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts"`
+	CheckedAt time.Time `json:"checked_at"`
+}
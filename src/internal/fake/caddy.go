@@ -0,0 +1,249 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Caddy serves the routes array of the Caddy admin API for one or more HTTP
+// servers under /config/apps/http/servers/{server}/routes, with the same array
+// semantics as Caddy: POST appends, PUT inserts at an index, PATCH replaces and
+// DELETE removes. Routes tagged with an @id are also served under /id/{id}, and
+// like Caddy it refuses a second route with the same @id.
+type Caddy struct {
+	Server *httptest.Server
+	routes map[string][]json.RawMessage
+	mu     sync.Mutex
+}
+
+func NewCaddy() *Caddy {
+	ret := &Caddy{routes: map[string][]json.RawMessage{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config/apps/http/servers/{server}/routes", ret.handleList)
+	mux.HandleFunc("POST /config/apps/http/servers/{server}/routes", ret.handleAppend)
+	mux.HandleFunc("PUT /config/apps/http/servers/{server}/routes", ret.handleConflict)
+	mux.HandleFunc("GET /config/apps/http/servers/{server}/routes/{idx}", ret.handleIndex)
+	mux.HandleFunc("PUT /config/apps/http/servers/{server}/routes/{idx}", ret.handleIndex)
+	mux.HandleFunc("PATCH /config/apps/http/servers/{server}/routes/{idx}", ret.handleIndex)
+	mux.HandleFunc("DELETE /config/apps/http/servers/{server}/routes/{idx}", ret.handleIndex)
+	mux.HandleFunc("GET /id/{id}", ret.handleID)
+	mux.HandleFunc("PATCH /id/{id}", ret.handleID)
+	mux.HandleFunc("DELETE /id/{id}", ret.handleID)
+
+	ret.Server = httptest.NewServer(mux)
+
+	return ret
+}
+
+func (c *Caddy) Close() {
+	c.Server.Close()
+}
+
+// Addr returns the host and port to configure as caddy.host and caddy.port.
+func (c *Caddy) Addr() (string, int) {
+	host, port, _ := net.SplitHostPort(c.Server.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// Routes returns the routes of server decoded into out, which must be a pointer
+// to a slice.
+func (c *Caddy) Routes(server string, out any) error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.list(server))
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// AddRoute appends route to the routes of server, as another Caddy client would.
+func (c *Caddy) AddRoute(server string, route any) error {
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.routes[server] = append(c.routes[server], data)
+	return nil
+}
+
+// list returns the routes of server, never nil. The caller holds c.mu.
+func (c *Caddy) list(server string) []json.RawMessage {
+	if routes := c.routes[server]; routes != nil {
+		return routes
+	}
+	return []json.RawMessage{}
+}
+
+func (c *Caddy) handleList(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeJSON(w, c.list(r.PathValue("server")))
+}
+
+func (c *Caddy) handleAppend(w http.ResponseWriter, r *http.Request) {
+	route, ok := readRoute(w, r)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkID(w, route, -1, "") {
+		return
+	}
+
+	server := r.PathValue("server")
+	c.routes[server] = append(c.routes[server], route)
+}
+
+func (c *Caddy) handleID(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := r.PathValue("id")
+	server, idx, ok := c.find(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown object ID '%s'", id))
+		return
+	}
+
+	routes := c.routes[server]
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, routes[idx])
+	case http.MethodDelete:
+		c.routes[server] = append(routes[:idx:idx], routes[idx+1:]...)
+	default:
+		route, ok := readRoute(w, r)
+		if !ok || !c.checkID(w, route, idx, server) {
+			return
+		}
+
+		routes[idx] = route
+	}
+}
+
+// find returns where the route tagged id is. The caller holds c.mu.
+func (c *Caddy) find(id string) (string, int, bool) {
+	for server, routes := range c.routes {
+		for idx, route := range routes {
+			if routeID(route) == id {
+				return server, idx, true
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// checkID refuses route when another route than the one at idx of server already
+// carries its @id. The caller holds c.mu.
+func (c *Caddy) checkID(w http.ResponseWriter, route json.RawMessage, idx int, server string) bool {
+	id := routeID(route)
+	if id == "" {
+		return true
+	}
+
+	if other, at, ok := c.find(id); ok && (other != server || at != idx) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("loading new config: duplicate ID '%s' found", id))
+		return false
+	}
+
+	return true
+}
+
+func routeID(route json.RawMessage) string {
+	var tagged struct {
+		ID string `json:"@id"`
+	}
+	json.Unmarshal(route, &tagged)
+
+	return tagged.ID
+}
+
+func (c *Caddy) handleConflict(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusConflict, fmt.Sprintf("[%s] key already exists: routes", r.URL.Path))
+}
+
+func (c *Caddy) handleIndex(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	server := r.PathValue("server")
+	routes := c.routes[server]
+
+	idx, err := strconv.Atoi(r.PathValue("idx"))
+	limit := len(routes)
+	if r.Method == http.MethodPut {
+		limit++
+	}
+	if err != nil || idx < 0 || idx >= limit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("[%s] invalid traversal path at: %s", r.URL.Path, r.PathValue("idx")))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, routes[idx])
+	case http.MethodDelete:
+		c.routes[server] = append(routes[:idx:idx], routes[idx+1:]...)
+	default:
+		route, ok := readRoute(w, r)
+		if !ok {
+			return
+		}
+
+		replaced := -1
+		if r.Method == http.MethodPatch {
+			replaced = idx
+		}
+		if !c.checkID(w, route, replaced, server) {
+			return
+		}
+
+		if r.Method == http.MethodPatch {
+			routes[idx] = route
+			return
+		}
+
+		c.routes[server] = append(routes[:idx:idx], append([]json.RawMessage{route}, routes[idx:]...)...)
+	}
+}
+
+func readRoute(w http.ResponseWriter, r *http.Request) (json.RawMessage, bool) {
+	var route json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		writeError(w, http.StatusBadRequest, "decoding request body: "+err.Error())
+		return nil, false
+	}
+
+	return route, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,663 @@
+// Package fake provides in-process stand-ins for the Proxmox and Caddy APIs the
+// launcher talks to, for tests that exercise the real services end to end.
+package fake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Guest is a container known to the fake Proxmox cluster.
+type Guest struct {
+	VMID     int
+	Node     string
+	Name     string
+	Status   string
+	Template bool
+	MaxDisk  uint64
+	Config   map[string]any
+	// Firewall holds the container firewall options.
+	Firewall map[string]string
+}
+
+// Proxmox serves the subset of the Proxmox VE API used by the launcher: login,
+// cluster resources, LXC clone, config, firewall options, resize, status changes,
+// migration, delete and task status and log. Every task completes immediately, successfully unless
+// it was made to fail with FailTask.
+type Proxmox struct {
+	Server   *httptest.Server
+	Username string
+	Password string
+	// Token is the accepted API token as user@realm!tokenid=secret.
+	Token    string
+	nodes    []string
+	offline  map[string]bool
+	nodeMem  map[string]uint64
+	guests   map[int]*Guest
+	tickets  map[string]bool
+	calls    []string
+	tasks    map[string]*task
+	failures map[string]*task
+	nextID   int
+	mu       sync.Mutex
+}
+
+// NodeMemory is the memory, in bytes, of every node of the fake cluster.
+const NodeMemory = uint64(64) << 30
+
+// task is a finished task with its exit status and log.
+type task struct {
+	exitStatus string
+	log        []string
+}
+
+// NewProxmox starts a fake cluster made of nodes, the first one holding templates
+// added with AddTemplate.
+func NewProxmox(nodes ...string) *Proxmox {
+	if len(nodes) == 0 {
+		nodes = []string{"pve"}
+	}
+
+	ret := &Proxmox{
+		Username: "root@pam",
+		Password: "secret",
+		nodes:    nodes,
+		offline:  map[string]bool{},
+		nodeMem:  map[string]uint64{},
+		guests:   map[int]*Guest{},
+		tickets:  map[string]bool{},
+		tasks:    map[string]*task{},
+		failures: map[string]*task{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api2/json/access/ticket", ret.handleLogin)
+	mux.HandleFunc("GET /api2/json/cluster/resources", ret.authed(ret.handleResources))
+	mux.HandleFunc("GET /api2/json/nodes/{node}/tasks/{upid}/status", ret.authed(ret.handleTask))
+	mux.HandleFunc("GET /api2/json/nodes/{node}/tasks/{upid}/log", ret.authed(ret.handleTaskLog))
+	mux.HandleFunc("POST /api2/json/nodes/{node}/lxc/{vmid}/clone", ret.authed(ret.handleClone))
+	mux.HandleFunc("GET /api2/json/nodes/{node}/lxc/{vmid}/config", ret.authed(ret.handleGetConfig))
+	mux.HandleFunc("PUT /api2/json/nodes/{node}/lxc/{vmid}/config", ret.authed(ret.handleSetConfig))
+	mux.HandleFunc("PUT /api2/json/nodes/{node}/lxc/{vmid}/resize", ret.authed(ret.handleResize))
+	mux.HandleFunc("PUT /api2/json/nodes/{node}/lxc/{vmid}/firewall/options", ret.authed(ret.handleFirewall))
+	mux.HandleFunc("GET /api2/json/nodes/{node}/lxc/{vmid}/status/current", ret.authed(ret.handleCurrent))
+	mux.HandleFunc("POST /api2/json/nodes/{node}/lxc/{vmid}/status/{action}", ret.authed(ret.handleStatus))
+	mux.HandleFunc("POST /api2/json/nodes/{node}/lxc/{vmid}/migrate", ret.authed(ret.handleMigrate))
+	mux.HandleFunc("DELETE /api2/json/nodes/{node}/lxc/{vmid}", ret.authed(ret.handleDelete))
+
+	ret.Server = httptest.NewTLSServer(formBody(mux))
+
+	return ret
+}
+
+// formBody reads untyped request bodies as forms, as Proxmox does: the client
+// library sends the login request without a Content-Type.
+func formBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Header.Get("Content-Type") == "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxmox) Close() {
+	p.Server.Close()
+}
+
+// Host is the host:port to configure as proxmox.host.
+func (p *Proxmox) Host() string {
+	return strings.TrimPrefix(p.Server.URL, "https://")
+}
+
+// Fingerprint is the SHA-256 fingerprint of the server certificate, to pin it with
+// proxmox.fingerprint.
+func (p *Proxmox) Fingerprint() string {
+	sum := sha256.Sum256(p.Server.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// AddTemplate registers an LXC template on the first node.
+func (p *Proxmox) AddTemplate(vmid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.guests[vmid] = &Guest{
+		VMID:     vmid,
+		Node:     p.nodes[0],
+		Name:     fmt.Sprintf("template-%d", vmid),
+		Status:   "stopped",
+		Template: true,
+		MaxDisk:  4 << 30,
+		Config: map[string]any{
+			"arch":     "amd64",
+			"cores":    1.0,
+			"memory":   512.0,
+			"swap":     512.0,
+			"hostname": fmt.Sprintf("template-%d", vmid),
+			"ostype":   "debian",
+			"rootfs":   fmt.Sprintf("local:vm-%d-disk-0,size=4G", vmid),
+			"net0":     "name=eth0,bridge=vmbr0,ip=dhcp",
+		},
+	}
+}
+
+// Guest returns a copy of the container vmid.
+func (p *Proxmox) Guest(vmid int) (Guest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guests[vmid]
+	if !ok {
+		return Guest{}, false
+	}
+
+	ret := *guest
+	ret.Config = map[string]any{}
+	for k, v := range guest.Config {
+		ret.Config[k] = v
+	}
+	ret.Firewall = map[string]string{}
+	for k, v := range guest.Firewall {
+		ret.Firewall[k] = v
+	}
+
+	return ret, true
+}
+
+// SetStatus changes the status of container vmid behind the launcher's back, as
+// an admin or a crash would.
+func (p *Proxmox) SetStatus(vmid int, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if guest, ok := p.guests[vmid]; ok {
+		guest.Status = status
+	}
+}
+
+// SetNodeOnline takes node out of the cluster, or brings it back.
+func (p *Proxmox) SetNodeOnline(node string, online bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.offline[node] = !online
+}
+
+// SetNodeMemory sets the memory, in bytes, used on node besides its running
+// containers, as other guests of the cluster would.
+func (p *Proxmox) SetNodeMemory(node string, used uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nodeMem[node] = used
+}
+
+// Calls lists the requests received so far as "METHOD /path", login excluded.
+func (p *Proxmox) Calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string{}, p.calls...)
+}
+
+// ExpireTickets invalidates every login ticket handed out so far.
+func (p *Proxmox) ExpireTickets() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tickets = map[string]bool{}
+}
+
+func (p *Proxmox) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("username") != p.Username || r.FormValue("password") != p.Password {
+		http.Error(w, "authentication failure", http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	ticket := fmt.Sprintf("PVE:%s:%08X", p.Username, p.nextID)
+	p.tickets[ticket] = true
+	p.mu.Unlock()
+
+	writeData(w, map[string]any{
+		"ticket":              ticket,
+		"CSRFPreventionToken": "csrf",
+		"username":            p.Username,
+	})
+}
+
+// authed rejects requests without a valid ticket or API token, as Proxmox does
+// with a 401, and records the others.
+func (p *Proxmox) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+
+		p.mu.Lock()
+		ok := false
+		if ticket, found := strings.CutPrefix(auth, "PVEAuthCookie="); found {
+			ok = p.tickets[ticket]
+		} else if token, found := strings.CutPrefix(auth, "PVEAPIToken="); found {
+			ok = p.Token != "" && token == p.Token
+		}
+		if ok {
+			p.calls = append(p.calls, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api2/json"))
+		}
+		p.mu.Unlock()
+
+		if !ok {
+			http.Error(w, "permission denied - invalid PVE ticket", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (p *Proxmox) handleResources(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := []map[string]any{}
+
+	if kind := r.URL.Query().Get("type"); kind == "node" {
+		for _, node := range p.nodes {
+			used := p.nodeMem[node]
+			for _, guest := range p.guests {
+				if guest.Node == node && guest.Status == "running" {
+					used += uint64(number(guest.Config["memory"])) << 20
+				}
+			}
+
+			status := "online"
+			if p.offline[node] {
+				status = "offline"
+			}
+
+			ret = append(ret, map[string]any{
+				"id":     "node/" + node,
+				"type":   "node",
+				"node":   node,
+				"status": status,
+				"cpu":    0.1,
+				"maxcpu": 16,
+				"mem":    used,
+				"maxmem": NodeMemory,
+			})
+		}
+
+		writeData(w, ret)
+		return
+	}
+
+	ids := make([]int, 0, len(p.guests))
+	for vmid := range p.guests {
+		ids = append(ids, vmid)
+	}
+	sort.Ints(ids)
+
+	for _, vmid := range ids {
+		guest := p.guests[vmid]
+
+		entry := map[string]any{
+			"id":      fmt.Sprintf("lxc/%d", vmid),
+			"type":    "lxc",
+			"vmid":    vmid,
+			"node":    guest.Node,
+			"name":    guest.Name,
+			"status":  guest.Status,
+			"maxmem":  uint64(number(guest.Config["memory"])) << 20,
+			"maxcpu":  number(guest.Config["cores"]),
+			"maxdisk": guest.MaxDisk,
+		}
+		if guest.Template {
+			entry["template"] = 1
+		}
+		if guest.Status == "running" {
+			entry["uptime"] = 60
+			entry["mem"] = uint64(number(guest.Config["memory"])) << 19
+		}
+
+		ret = append(ret, entry)
+	}
+
+	writeData(w, ret)
+}
+
+func (p *Proxmox) handleTask(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upid := r.PathValue("upid")
+	task, ok := p.tasks[upid]
+	if !ok {
+		http.Error(w, "no such task", http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, map[string]any{
+		"upid":       upid,
+		"node":       r.PathValue("node"),
+		"status":     "stopped",
+		"exitstatus": task.exitStatus,
+	})
+}
+
+func (p *Proxmox) handleTaskLog(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	task, ok := p.tasks[r.PathValue("upid")]
+	if !ok {
+		http.Error(w, "no such task", http.StatusInternalServerError)
+		return
+	}
+
+	lines := []map[string]any{}
+	for i, line := range task.log {
+		lines = append(lines, map[string]any{"n": i + 1, "t": line})
+	}
+
+	writeData(w, lines)
+}
+
+func (p *Proxmox) handleClone(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	source, ok := p.guest(w, r)
+	if !ok || !knownParams(w, r, "newid", "hostname", "full", "storage", "target", "description", "pool", "snapname") {
+		return
+	}
+
+	newID, err := strconv.Atoi(r.FormValue("newid"))
+	if err != nil {
+		http.Error(w, "invalid newid", http.StatusBadRequest)
+		return
+	}
+
+	if p.failTask(w, source.Node, "vzclone", newID) {
+		return
+	}
+
+	if _, exists := p.guests[newID]; exists {
+		http.Error(w, fmt.Sprintf("CT %d already exists", newID), http.StatusInternalServerError)
+		return
+	}
+
+	node := r.FormValue("target")
+	if node == "" {
+		node = source.Node
+	}
+
+	config := map[string]any{}
+	for k, v := range source.Config {
+		config[k] = v
+	}
+	config["hostname"] = r.FormValue("hostname")
+
+	p.guests[newID] = &Guest{
+		VMID:    newID,
+		Node:    node,
+		Name:    r.FormValue("hostname"),
+		Status:  "stopped",
+		MaxDisk: source.MaxDisk,
+		Config:  config,
+	}
+
+	p.writeTask(w, source.Node, "vzclone", newID)
+}
+
+func (p *Proxmox) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	writeData(w, guest.Config)
+}
+
+func (p *Proxmox) handleSetConfig(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	for _, key := range strings.Split(r.PostForm.Get("delete"), ",") {
+		delete(guest.Config, strings.TrimSpace(key))
+	}
+	r.PostForm.Del("delete")
+
+	for key, values := range r.PostForm {
+		if n, err := strconv.ParseFloat(values[0], 64); err == nil {
+			guest.Config[key] = n
+			continue
+		}
+		guest.Config[key] = values[0]
+	}
+
+	writeData(w, nil)
+}
+
+func (p *Proxmox) handleFirewall(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok || !knownParams(w, r, "enable", "ipfilter", "macfilter", "dhcp", "ndp", "radv", "policy_in", "policy_out", "log_level_in", "log_level_out") {
+		return
+	}
+
+	if guest.Firewall == nil {
+		guest.Firewall = map[string]string{}
+	}
+	for key, values := range r.PostForm {
+		guest.Firewall[key] = values[0]
+	}
+
+	writeData(w, nil)
+}
+
+func (p *Proxmox) handleResize(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.FormValue("size"), "+"), "G"))
+	if err != nil {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+
+	guest.MaxDisk = uint64(size) << 30
+	p.writeTask(w, guest.Node, "resize", guest.VMID)
+}
+
+func (p *Proxmox) handleCurrent(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	writeData(w, map[string]any{"vmid": guest.VMID, "status": guest.Status, "name": guest.Name})
+}
+
+func (p *Proxmox) handleStatus(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	if guest.Template {
+		http.Error(w, "cannot change the status of a template", http.StatusInternalServerError)
+		return
+	}
+
+	action := r.PathValue("action")
+	if p.failTask(w, guest.Node, "vz"+action, guest.VMID) {
+		return
+	}
+
+	switch action {
+	case "start", "resume", "reboot":
+		guest.Status = "running"
+	case "stop", "shutdown":
+		guest.Status = "stopped"
+	case "suspend":
+		guest.Status = "suspended"
+	default:
+		http.Error(w, "unknown action "+action, http.StatusNotImplemented)
+		return
+	}
+
+	p.writeTask(w, guest.Node, "vz"+action, guest.VMID)
+}
+
+func (p *Proxmox) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok || !knownParams(w, r, "target", "restart", "online", "timeout", "bwlimit", "target-storage") {
+		return
+	}
+
+	if guest.Status == "running" && r.FormValue("restart") != "1" && r.FormValue("online") != "1" {
+		http.Error(w, fmt.Sprintf("CT %d is running - use online or restart migration", guest.VMID), http.StatusInternalServerError)
+		return
+	}
+
+	target := r.FormValue("target")
+	known := false
+	for _, node := range p.nodes {
+		known = known || node == target
+	}
+
+	if !known {
+		http.Error(w, "no such node "+target, http.StatusInternalServerError)
+		return
+	}
+
+	source := guest.Node
+	guest.Node = target
+	p.writeTask(w, source, "vzmigrate", guest.VMID)
+}
+
+func (p *Proxmox) handleDelete(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	guest, ok := p.guest(w, r)
+	if !ok {
+		return
+	}
+
+	if guest.Status == "running" {
+		http.Error(w, fmt.Sprintf("CT %d is running", guest.VMID), http.StatusInternalServerError)
+		return
+	}
+
+	delete(p.guests, guest.VMID)
+	p.writeTask(w, guest.Node, "vzdestroy", guest.VMID)
+}
+
+// FailTask makes the next task of kind, such as vzstart or vzclone, fail with
+// exitStatus and log without changing any guest.
+func (p *Proxmox) FailTask(kind, exitStatus string, log ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures[kind] = &task{exitStatus: exitStatus, log: append(log, "TASK ERROR: "+exitStatus)}
+}
+
+// failTask answers with the failing task set up by FailTask for kind, if any. The
+// caller holds p.mu.
+func (p *Proxmox) failTask(w http.ResponseWriter, node, kind string, vmid int) bool {
+	failure, ok := p.failures[kind]
+	if !ok {
+		return false
+	}
+
+	delete(p.failures, kind)
+	p.startTask(w, node, kind, vmid, failure)
+
+	return true
+}
+
+// knownParams answers 400 when the request body carries a parameter the endpoint
+// does not take, as the Proxmox API schema check does.
+func knownParams(w http.ResponseWriter, r *http.Request, names ...string) bool {
+	r.ParseForm()
+
+	for name := range r.PostForm {
+		if !slices.Contains(names, name) {
+			http.Error(w, fmt.Sprintf("parameter verification failed: %s: property is not defined in schema", name), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	return true
+}
+
+// guest looks up the container addressed by the request path, which must name the
+// node it lives on. The caller holds p.mu.
+func (p *Proxmox) guest(w http.ResponseWriter, r *http.Request) (*Guest, bool) {
+	vmid, _ := strconv.Atoi(r.PathValue("vmid"))
+
+	guest, ok := p.guests[vmid]
+	if !ok || guest.Node != r.PathValue("node") {
+		http.Error(w, fmt.Sprintf("Configuration file 'nodes/%s/lxc/%d.conf' does not exist", r.PathValue("node"), vmid), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return guest, true
+}
+
+func (p *Proxmox) writeTask(w http.ResponseWriter, node, kind string, vmid int) {
+	p.startTask(w, node, kind, vmid, &task{exitStatus: "OK", log: []string{"TASK OK"}})
+}
+
+func (p *Proxmox) startTask(w http.ResponseWriter, node, kind string, vmid int, t *task) {
+	p.nextID++
+	upid := fmt.Sprintf("UPID:%s:%08X:00000000:00000000:%s:%d:%s:", node, p.nextID, kind, vmid, p.Username)
+	p.tasks[upid] = t
+	writeData(w, upid)
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func number(v any) float64 {
+	n, _ := v.(float64)
+	return n
+}
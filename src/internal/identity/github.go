@@ -0,0 +1,162 @@
+package identity
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+const githubAPIURL = "https://api.github.com"
+
+type GithubProvider struct {
+	oauthProvider
+	apiURL       string
+	allowedOrgs  []string
+	allowedTeams []string
+}
+
+func NewGithubProvider(cfg *config.ProviderConfig) *GithubProvider {
+	endpoint := github.Endpoint
+	apiURL := githubAPIURL
+
+	// GitHub Enterprise Server keeps OAuth on the base URL and the REST API under /api/v3.
+	if cfg.BaseURL != "" {
+		base := strings.TrimSuffix(cfg.BaseURL, "/")
+		endpoint = oauth2.Endpoint{
+			AuthURL:  base + "/login/oauth/authorize",
+			TokenURL: base + "/login/oauth/access_token",
+		}
+		apiURL = base + "/api/v3"
+	}
+
+	ret := &GithubProvider{
+		oauthProvider: newOAuthProvider(cfg, "GitHub", endpoint, []string{"user:email"}),
+		apiURL:        apiURL,
+		allowedOrgs:   lowerAll(cfg.AllowedOrgs),
+		allowedTeams:  lowerAll(cfg.AllowedTeams),
+	}
+
+	if ret.checksMembership() && !slices.Contains(ret.oauth2.Scopes, "read:org") {
+		ret.oauth2.Scopes = append(ret.oauth2.Scopes, "read:org")
+	}
+
+	return ret
+}
+
+func (g *GithubProvider) checksMembership() bool {
+	return len(g.allowedOrgs) > 0 || len(g.allowedTeams) > 0
+}
+
+// Authorize grants access to members of any allowed organization or team ("org/team-slug").
+func (g *GithubProvider) Authorize(profile *domain.Profile) bool {
+	for _, org := range profile.Orgs {
+		if slices.Contains(g.allowedOrgs, org) {
+			return true
+		}
+	}
+
+	for _, team := range profile.Teams {
+		if slices.Contains(g.allowedTeams, team) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *GithubProvider) Profile(ctx context.Context, token *oauth2.Token) (*domain.Profile, error) {
+	client := g.client(ctx, token)
+
+	var user struct {
+		Login string `json:"login"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(client, g.apiURL+"/user", &user); err != nil {
+		return nil, err
+	}
+
+	profile := &domain.Profile{
+		Provider: g.Name(),
+		Login:    strings.ToLower(user.Login),
+		Email:    user.Email,
+		Name:     user.Name,
+	}
+
+	if profile.Email == "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := getJSON(client, g.apiURL+"/user/emails", &emails); err == nil {
+			for _, email := range emails {
+				if email.Primary && email.Verified {
+					profile.Email = email.Email
+				}
+			}
+		}
+	}
+
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	if err := getJSON(client, g.apiURL+"/users/"+user.Login+"/keys", &keys); err == nil {
+		for _, key := range keys {
+			profile.SSHKeys = append(profile.SSHKeys, key.Key)
+		}
+	}
+
+	if g.checksMembership() {
+		if err := g.loadMemberships(client, profile); err != nil {
+			return nil, err
+		}
+	}
+
+	return profile, nil
+}
+
+func (g *GithubProvider) loadMemberships(client *http.Client, profile *domain.Profile) error {
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := getJSON(client, g.apiURL+"/user/orgs?per_page=100", &orgs); err != nil {
+		return fmt.Errorf("failed to list organizations: %v", err)
+	}
+
+	for _, org := range orgs {
+		profile.Orgs = append(profile.Orgs, strings.ToLower(org.Login))
+	}
+
+	var teams []struct {
+		Slug         string `json:"slug"`
+		Organization struct {
+			Login string `json:"login"`
+		} `json:"organization"`
+	}
+	if err := getJSON(client, g.apiURL+"/user/teams?per_page=100", &teams); err != nil {
+		return fmt.Errorf("failed to list teams: %v", err)
+	}
+
+	for _, team := range teams {
+		profile.Teams = append(profile.Teams, strings.ToLower(team.Organization.Login+"/"+team.Slug))
+	}
+
+	return nil
+}
+
+func lowerAll(values []string) []string {
+	ret := make([]string, 0, len(values))
+	for _, value := range values {
+		ret = append(ret, strings.ToLower(value))
+	}
+
+	return ret
+}
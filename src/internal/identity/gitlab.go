@@ -0,0 +1,65 @@
+package identity
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"context"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const gitlabBaseURL = "https://gitlab.com"
+
+type GitlabProvider struct {
+	oauthProvider
+	apiURL string
+}
+
+func NewGitlabProvider(cfg *config.ProviderConfig) *GitlabProvider {
+	base := gitlabBaseURL
+	if cfg.BaseURL != "" {
+		base = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+
+	endpoint := oauth2.Endpoint{
+		AuthURL:  base + "/oauth/authorize",
+		TokenURL: base + "/oauth/token",
+	}
+
+	return &GitlabProvider{
+		oauthProvider: newOAuthProvider(cfg, "GitLab", endpoint, []string{"read_user"}),
+		apiURL:        base + "/api/v4",
+	}
+}
+
+func (g *GitlabProvider) Profile(ctx context.Context, token *oauth2.Token) (*domain.Profile, error) {
+	client := g.client(ctx, token)
+
+	var user struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Name     string `json:"name"`
+	}
+	if err := getJSON(client, g.apiURL+"/user", &user); err != nil {
+		return nil, err
+	}
+
+	profile := &domain.Profile{
+		Provider: g.Name(),
+		Login:    strings.ToLower(user.Username),
+		Email:    user.Email,
+		Name:     user.Name,
+	}
+
+	var keys []struct {
+		Key string `json:"key"`
+	}
+	if err := getJSON(client, g.apiURL+"/user/keys", &keys); err == nil {
+		for _, key := range keys {
+			profile.SSHKeys = append(profile.SSHKeys, key.Key)
+		}
+	}
+
+	return profile, nil
+}
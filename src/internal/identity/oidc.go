@@ -0,0 +1,76 @@
+package identity
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type OIDCProvider struct {
+	oauthProvider
+	userInfoURL string
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// NewOIDCProvider reads the issuer discovery document, so it needs the issuer
+// (e.g. https://keycloak.example.com/realms/dev) reachable at startup.
+func NewOIDCProvider(cfg *config.ProviderConfig) (*OIDCProvider, error) {
+	if cfg.IssuerURL == "" {
+		return nil, fmt.Errorf("oidc provider %s has no issuer_url", cfg.Name)
+	}
+
+	discoveryURL := strings.TrimSuffix(cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+
+	var discovery oidcDiscovery
+	client := &http.Client{Timeout: 10 * time.Second}
+	if err := getJSON(client, discoveryURL, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to read oidc discovery from %s: %v", discoveryURL, err)
+	}
+
+	endpoint := oauth2.Endpoint{
+		AuthURL:  discovery.AuthorizationEndpoint,
+		TokenURL: discovery.TokenEndpoint,
+	}
+
+	return &OIDCProvider{
+		oauthProvider: newOAuthProvider(cfg, cfg.Name, endpoint, []string{"openid", "profile", "email"}),
+		userInfoURL:   discovery.UserInfoEndpoint,
+	}, nil
+}
+
+func (o *OIDCProvider) Profile(ctx context.Context, token *oauth2.Token) (*domain.Profile, error) {
+	var claims struct {
+		Subject           string   `json:"sub"`
+		PreferredUsername string   `json:"preferred_username"`
+		Email             string   `json:"email"`
+		Name              string   `json:"name"`
+		SSHKeys           []string `json:"ssh_keys"`
+	}
+	if err := getJSON(o.client(ctx, token), o.userInfoURL, &claims); err != nil {
+		return nil, err
+	}
+
+	login := claims.PreferredUsername
+	if login == "" {
+		login = claims.Subject
+	}
+
+	return &domain.Profile{
+		Provider: o.Name(),
+		Login:    strings.ToLower(login),
+		Email:    claims.Email,
+		Name:     claims.Name,
+		SSHKeys:  claims.SSHKeys,
+	}, nil
+}
@@ -0,0 +1,173 @@
+package identity
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+type Provider interface {
+	Name() string
+	DisplayName() string
+	AuthCodeURL(state string) string
+	Exchange(ctx context.Context, code string) (*oauth2.Token, error)
+	Profile(ctx context.Context, token *oauth2.Token) (*domain.Profile, error)
+	// Authorize reports whether provider side rules, such as organization
+	// membership, grant access to a user missing from the static user list.
+	Authorize(profile *domain.Profile) bool
+}
+
+type Registry struct {
+	log       *logger.Logger
+	providers map[string]Provider
+	order     []string
+}
+
+func NewRegistry(cfg *config.AppConfig) (*Registry, error) {
+	ret := &Registry{
+		log:       logger.NewLogger("IdentityRegistry"),
+		providers: map[string]Provider{},
+	}
+
+	if cfg.Github != nil && cfg.Github.ClientID != "" {
+		ret.add(NewGithubProvider(&config.ProviderConfig{
+			Name:         domain.DefaultProvider,
+			Type:         config.ProviderTypeGithub,
+			ClientID:     cfg.Github.ClientID,
+			ClientSecret: cfg.Github.ClientSecret,
+			RedirectURL:  cfg.Github.RedirectURL,
+			Scopes:       cfg.Github.Scopes,
+			AllowedOrgs:  cfg.Github.AllowedOrgs,
+			AllowedTeams: cfg.Github.AllowedTeams,
+		}))
+	}
+
+	for _, pc := range cfg.Providers {
+		provider, err := newProvider(pc)
+		if err != nil {
+			ret.log.Error("Failed to create identity provider %s: %v", pc.Name, err)
+			return nil, err
+		}
+
+		ret.add(provider)
+	}
+
+	if len(ret.order) == 0 {
+		return nil, fmt.Errorf("no identity provider configured")
+	}
+
+	return ret, nil
+}
+
+func newProvider(cfg *config.ProviderConfig) (Provider, error) {
+	if cfg.Name == "" {
+		cfg.Name = string(cfg.Type)
+	}
+
+	switch cfg.Type {
+	case config.ProviderTypeGithub:
+		return NewGithubProvider(cfg), nil
+	case config.ProviderTypeGitlab:
+		return NewGitlabProvider(cfg), nil
+	case config.ProviderTypeOIDC:
+		return NewOIDCProvider(cfg)
+	}
+
+	return nil, fmt.Errorf("unknown identity provider type: %q", cfg.Type)
+}
+
+func (r *Registry) add(provider Provider) {
+	if _, ok := r.providers[provider.Name()]; !ok {
+		r.order = append(r.order, provider.Name())
+	}
+
+	r.providers[provider.Name()] = provider
+	r.log.Info("Identity provider registered: %s", provider.Name())
+}
+
+func (r *Registry) Get(name string) (Provider, bool) {
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+func (r *Registry) List() []Provider {
+	ret := make([]Provider, 0, len(r.order))
+	for _, name := range r.order {
+		ret = append(ret, r.providers[name])
+	}
+
+	return ret
+}
+
+// oauthProvider holds the parts shared by every OAuth2 based provider.
+type oauthProvider struct {
+	name        string
+	displayName string
+	oauth2      oauth2.Config
+}
+
+func newOAuthProvider(cfg *config.ProviderConfig, displayName string, endpoint oauth2.Endpoint, scopes []string) oauthProvider {
+	if cfg.DisplayName != "" {
+		displayName = cfg.DisplayName
+	}
+
+	if len(cfg.Scopes) > 0 {
+		scopes = cfg.Scopes
+	}
+
+	return oauthProvider{
+		name:        cfg.Name,
+		displayName: displayName,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     endpoint,
+			Scopes:       scopes,
+		},
+	}
+}
+
+func (o *oauthProvider) Name() string {
+	return o.name
+}
+
+func (o *oauthProvider) DisplayName() string {
+	return o.displayName
+}
+
+func (o *oauthProvider) AuthCodeURL(state string) string {
+	return o.oauth2.AuthCodeURL(state, oauth2.AccessTypeOnline)
+}
+
+func (o *oauthProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	return o.oauth2.Exchange(ctx, code)
+}
+
+func (o *oauthProvider) Authorize(profile *domain.Profile) bool {
+	return false
+}
+
+func (o *oauthProvider) client(ctx context.Context, token *oauth2.Token) *http.Client {
+	return o.oauth2.Client(ctx, token)
+}
+
+func getJSON(client *http.Client, url string, out interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,152 @@
+package identity
+
+import (
+	"code-server-launcher/internal/config"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newProviderStub serves the token endpoint of both provider types, the GitLab API
+// and an OIDC issuer. Its user info answers with userinfo.
+func newProviderStub(t *testing.T, userinfo string) *httptest.Server {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+
+	token := func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"test-token","token_type":"bearer"}`)
+	}
+
+	authed := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer test-token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, body)
+		}
+	}
+
+	mux.HandleFunc("POST /oauth/token", token)
+	mux.HandleFunc("GET /api/v4/user", authed(`{"username":"Alice.X","email":"alice@example.com","name":"Alice X"}`))
+	mux.HandleFunc("GET /api/v4/user/keys", authed(`[{"id":1,"key":"ssh-ed25519 AAAA alice"}]`))
+
+	mux.HandleFunc("GET /realms/dev/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"authorization_endpoint":%q,"token_endpoint":%q,"userinfo_endpoint":%q}`,
+			srv.URL+"/realms/dev/auth", srv.URL+"/realms/dev/token", srv.URL+"/realms/dev/userinfo")
+	})
+	mux.HandleFunc("POST /realms/dev/token", token)
+	mux.HandleFunc("GET /realms/dev/userinfo", authed(userinfo))
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestProviders(t *testing.T) {
+	tests := []struct {
+		name      string
+		userinfo  string
+		cfg       func(base string) *config.ProviderConfig
+		authorize string
+		login     string
+		email     string
+		fullName  string
+		keys      []string
+	}{
+		{
+			name: "gitlab",
+			cfg: func(base string) *config.ProviderConfig {
+				return &config.ProviderConfig{Name: "gitlab", Type: config.ProviderTypeGitlab, BaseURL: base + "/"}
+			},
+			authorize: "/oauth/authorize",
+			login:     "alice.x",
+			email:     "alice@example.com",
+			fullName:  "Alice X",
+			keys:      []string{"ssh-ed25519 AAAA alice"},
+		},
+		{
+			name:     "oidc",
+			userinfo: `{"sub":"f3b1","preferred_username":"Alice_X","email":"alice@example.com","name":"Alice X","ssh_keys":["ssh-ed25519 BBBB alice"]}`,
+			cfg: func(base string) *config.ProviderConfig {
+				return &config.ProviderConfig{Name: "keycloak", Type: config.ProviderTypeOIDC, IssuerURL: base + "/realms/dev"}
+			},
+			authorize: "/realms/dev/auth",
+			login:     "alice_x",
+			email:     "alice@example.com",
+			fullName:  "Alice X",
+			keys:      []string{"ssh-ed25519 BBBB alice"},
+		},
+		{
+			name:     "oidc without username",
+			userinfo: `{"sub":"F3B1"}`,
+			cfg: func(base string) *config.ProviderConfig {
+				return &config.ProviderConfig{Name: "keycloak", Type: config.ProviderTypeOIDC, IssuerURL: base + "/realms/dev"}
+			},
+			authorize: "/realms/dev/auth",
+			login:     "f3b1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newProviderStub(t, test.userinfo)
+
+			cfg := test.cfg(stub.URL)
+			cfg.ClientID = "launcher"
+			cfg.ClientSecret = "launcher-secret"
+			cfg.RedirectURL = "http://launcher.test/callback/" + cfg.Name
+
+			provider, err := newProvider(cfg)
+			if err != nil {
+				t.Fatalf("new provider: %v", err)
+			}
+
+			authorize, err := url.Parse(provider.AuthCodeURL("state-1"))
+			if err != nil || !strings.HasPrefix(authorize.String(), stub.URL+test.authorize) {
+				t.Fatalf("authorize URL = %q, want it under %s", authorize, stub.URL+test.authorize)
+			}
+			if query := authorize.Query(); query.Get("state") != "state-1" || query.Get("client_id") != "launcher" {
+				t.Errorf("authorize query = %v, want the state and client id", query)
+			}
+
+			if _, err := provider.Exchange(t.Context(), "bad-code"); err == nil {
+				t.Error("exchange of a bad code succeeded")
+			}
+
+			token, err := provider.Exchange(t.Context(), "good-code")
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+
+			profile, err := provider.Profile(t.Context(), token)
+			if err != nil {
+				t.Fatalf("profile: %v", err)
+			}
+
+			if profile.Provider != cfg.Name || profile.Login != test.login {
+				t.Errorf("profile = %s:%s, want %s:%s", profile.Provider, profile.Login, cfg.Name, test.login)
+			}
+			if profile.Email != test.email || profile.Name != test.fullName {
+				t.Errorf("profile identity = %q <%s>, want %q <%s>", profile.Name, profile.Email, test.fullName, test.email)
+			}
+			if !slices.Equal(profile.SSHKeys, test.keys) {
+				t.Errorf("profile keys = %v, want %v", profile.SSHKeys, test.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/service"
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	errUnknownAction = errors.New("unknown workspace action")
+	errNoWorkspace   = errors.New("no such workspace")
+)
+
+// userWorkspace returns the workspace slug if it belongs to user.
+func (s *Server) userWorkspace(user *domain.User, slug string) (*domain.Workspace, error) {
+	ws, err := s.store.GetWorkspace(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if ws == nil || ws.Owner != user.Key() {
+		return nil, errNoWorkspace
+	}
+
+	return ws, nil
+}
+
+// ownsWorkspace also accepts a workspace whose first provisioning job has not
+// allocated it yet.
+func (s *Server) ownsWorkspace(user *domain.User, slug string) bool {
+	if job, ok := s.provisioner.Status(slug); ok && job.Owner == user.Key() {
+		return true
+	}
+
+	_, err := s.userWorkspace(user, slug)
+	return err == nil
+}
+
+// workspaceAction applies a lifecycle action to ws on behalf of user, which may be
+// nil unless needsOwner(action). The start, restart and reclone actions return the
+// provisioning job they launched or joined.
+func (s *Server) workspaceAction(ctx context.Context, user *domain.User, ws *domain.Workspace, action string) (*domain.Job, error) {
+	var err error
+
+	switch action {
+	case "start":
+		job, err := s.provisioner.Start(ctx, user, ws.Name, ws.Template)
+		if err != nil {
+			return nil, err
+		}
+		return &job, nil
+	case "reclone":
+		job, err := s.provisioner.Reclone(ctx, user, ws)
+		if err != nil {
+			return nil, err
+		}
+		return &job, nil
+	case "stop":
+		err = s.provisioner.Stop(ctx, ws)
+	case "hibernate":
+		err = s.provisioner.Hibernate(ctx, ws)
+	case "restart":
+		job, err := s.provisioner.Restart(ctx, user, ws)
+		if err != nil {
+			return nil, err
+		}
+		return &job, nil
+	default:
+		return nil, errUnknownAction
+	}
+
+	return nil, err
+}
+
+// needsOwner reports whether action may provision the workspace, which takes the
+// profile of its owner.
+func needsOwner(action string) bool {
+	switch action {
+	case "start", "restart", "reclone":
+		return true
+	default:
+		return false
+	}
+}
+
+func actionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownAction):
+		return http.StatusBadRequest
+	case errors.Is(err, errNoWorkspace):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrJobInProgress), errors.Is(err, service.ErrWorkspaceUnavailable):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// renderQuotaError shows why a workspace could not be started.
+func (s *Server) renderQuotaError(w http.ResponseWriter, err error) {
+	s.renderError(w, http.StatusForbidden, "Quota exceeded", err.Error()+". Stop one of your running workspaces or ask an administrator to raise the limit.")
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/service"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// defaultEventLimit is how many audit events are listed without a limit parameter.
+const defaultEventLimit = 100
+
+type adminWorkspace struct {
+	Workspace *domain.Workspace `json:"workspace"`
+	Info      *domain.VmInfo    `json:"info"`
+	Readiness *domain.Readiness `json:"readiness,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/users", s.requireAdmin(s.handleAdminUsers))
+	mux.HandleFunc("GET /api/admin/workspaces", s.requireAdmin(s.handleAdminWorkspaces))
+	mux.HandleFunc("POST /api/admin/workspaces/{slug}/migrate", s.requireAdmin(s.handleAdminMigrate))
+	mux.HandleFunc("POST /api/admin/workspaces/{slug}/{action}", s.requireAdmin(s.handleAdminWorkspaceAction))
+	mux.HandleFunc("GET /api/admin/nodes", s.requireAdmin(s.handleAdminNodes))
+	mux.HandleFunc("GET /api/admin/events", s.requireAdmin(s.handleAdminEvents))
+	mux.HandleFunc("DELETE /api/admin/workspaces/{slug}", s.requireAdmin(s.handleAdminDeleteWorkspace))
+	mux.HandleFunc("DELETE /api/admin/routes/{slug}", s.requireAdmin(s.handleAdminDeleteRoute))
+}
+
+func (s *Server) requireAdmin(next userHandler) http.HandlerFunc {
+	return s.requireUser(func(w http.ResponseWriter, r *http.Request, user *domain.User) {
+		if !s.isAdmin(user.Key()) {
+			s.log.Warn("User %s denied access to %s", user.Key(), r.URL.Path)
+			http.Error(w, "Admin role required", http.StatusForbidden)
+			return
+		}
+
+		next(w, r, user)
+	})
+}
+
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	s.mu.RLock()
+	users := make([]*domain.User, 0, len(s.allowedUsers))
+	for _, user := range s.allowedUsers {
+		users = append(users, user)
+	}
+	s.mu.RUnlock()
+
+	s.writeJSON(w, users)
+}
+
+func (s *Server) handleAdminWorkspaces(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	workspaces, err := s.store.ListWorkspaces()
+	if err != nil {
+		http.Error(w, "Failed to list workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	ret := make([]adminWorkspace, 0, len(workspaces))
+	for _, ws := range workspaces {
+		item := adminWorkspace{Workspace: ws}
+
+		item.Info, err = s.backend.Info(r.Context(), ws)
+		if err != nil {
+			item.Error = err.Error()
+		}
+
+		if readiness, ok := s.provisioner.Readiness(ws.Slug); ok {
+			item.Readiness = &readiness
+		}
+
+		ret = append(ret, item)
+	}
+
+	s.writeJSON(w, ret)
+}
+
+func (s *Server) handleAdminWorkspaceAction(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	action := r.PathValue("action")
+
+	ws, ok := s.adminWorkspace(w, r.PathValue("slug"))
+	if !ok {
+		return
+	}
+
+	// Only starting a workspace takes its owner, for the profile; stopping it works
+	// for owners who are no longer allowed too.
+	var user *domain.User
+	if needsOwner(action) {
+		user, ok = s.getUser(ws.Owner)
+		if !ok {
+			http.Error(w, "Unknown user", http.StatusNotFound)
+			return
+		}
+	}
+
+	s.log.Info("Admin %s requested %s on workspace %s", admin.Key(), action, ws.Slug)
+	s.store.AddEvent(domain.NewEvent(domain.EventAdminAction, ws.Owner, fmt.Sprintf("%s of %s by %s", action, ws.Slug, admin.Key())))
+
+	job, err := s.workspaceAction(r.Context(), user, ws, action)
+	if err != nil {
+		http.Error(w, err.Error(), actionErrorStatus(err))
+		return
+	}
+
+	if job != nil {
+		s.writeJSON(w, job)
+		return
+	}
+
+	ws, err = s.store.GetWorkspace(ws.Slug)
+	if err != nil {
+		http.Error(w, "Failed to read workspace", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, ws)
+}
+
+// handleAdminMigrate moves a workspace to the node given in the node query parameter.
+func (s *Server) handleAdminMigrate(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	proxmox, ok := s.backend.(*service.ProxmoxService)
+	if !ok {
+		http.Error(w, "Migration needs the Proxmox backend", http.StatusNotImplemented)
+		return
+	}
+
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		http.Error(w, "Missing target node", http.StatusBadRequest)
+		return
+	}
+
+	ws, ok := s.adminWorkspace(w, r.PathValue("slug"))
+	if !ok {
+		return
+	}
+
+	if job, running := s.provisioner.Status(ws.Slug); running && !job.Done() {
+		http.Error(w, "Workspace is being provisioned", http.StatusConflict)
+		return
+	}
+
+	s.log.Info("Admin %s requested migration of workspace %s to %s", admin.Key(), ws.Slug, node)
+	s.store.AddEvent(domain.NewEvent(domain.EventAdminAction, ws.Owner, fmt.Sprintf("migrate of %s to %s by %s", ws.Slug, node, admin.Key())))
+
+	if err := proxmox.Migrate(r.Context(), ws, node); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	s.writeJSON(w, ws)
+}
+
+func (s *Server) handleAdminNodes(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	proxmox, ok := s.backend.(*service.ProxmoxService)
+	if !ok {
+		http.Error(w, "Nodes need the Proxmox backend", http.StatusNotImplemented)
+		return
+	}
+
+	nodes, err := proxmox.Nodes(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	s.writeJSON(w, nodes)
+}
+
+// handleAdminEvents lists the newest audit events, as many as the limit query
+// parameter asks for.
+func (s *Server) handleAdminEvents(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	limit := defaultEventLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := s.store.ListEvents(limit)
+	if err != nil {
+		http.Error(w, "Failed to list events", http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, events)
+}
+
+func (s *Server) handleAdminDeleteWorkspace(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	ws, ok := s.adminWorkspace(w, r.PathValue("slug"))
+	if !ok {
+		return
+	}
+
+	s.log.Info("Admin %s requested delete of workspace %s", admin.Key(), ws.Slug)
+	s.store.AddEvent(domain.NewEvent(domain.EventAdminAction, ws.Owner, fmt.Sprintf("delete of %s by %s", ws.Slug, admin.Key())))
+
+	if err := s.provisioner.Delete(r.Context(), ws); err != nil {
+		http.Error(w, err.Error(), actionErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminWorkspace resolves a workspace, answering 404 when it is unknown. Its owner
+// may no longer be allowed: administrators still get to clean it up.
+func (s *Server) adminWorkspace(w http.ResponseWriter, slug string) (*domain.Workspace, bool) {
+	ws, err := s.store.GetWorkspace(slug)
+	if err != nil {
+		http.Error(w, "Failed to read workspace", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if ws == nil {
+		http.Error(w, "Unknown workspace", http.StatusNotFound)
+		return nil, false
+	}
+
+	return ws, true
+}
+
+func (s *Server) handleAdminDeleteRoute(w http.ResponseWriter, r *http.Request, admin *domain.User) {
+	slug := r.PathValue("slug")
+
+	routes, err := s.store.ListRoutes()
+	if err != nil {
+		http.Error(w, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	host := slug + "." + s.caddyService.Config().BaseURL
+	for _, route := range routes {
+		if route.Slug == slug {
+			host = route.Host
+		}
+	}
+
+	s.log.Info("Admin %s requested removal of route %s", admin.Key(), host)
+
+	// The route of a workspace stays down; any other route is simply removed.
+	if ws, ok := s.allocator.Get(slug); ok {
+		err = s.provisioner.RemoveRoute(r.Context(), ws)
+	} else {
+		err = s.caddyService.Remove(r.Context(), slug, host)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"net"
+	"net/http"
+	"time"
+)
+
+// handleBootstrap serves the set-up of the workspace container asking for it: SSH
+// keys, code-server authentication and git identity. Containers are told apart by
+// the address the allocator gave them, so they have to reach the launcher directly
+// rather than through a proxy, with the IP filter of the Proxmox firewall keeping
+// them from using another address. Templates that cannot be set up through the
+// backend API fetch it on first start, and only then: once served, the set-up is
+// refused until the workspace is cloned again.
+func (s *Server) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Unknown workspace", http.StatusNotFound)
+		return
+	}
+
+	ws, err := s.workspaceByIP(ip)
+	if err != nil {
+		s.log.Error("Failed to look up workspace of %s: %v", ip, err)
+		http.Error(w, "Failed to read workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	if ws == nil {
+		s.log.Warn("Bootstrap requested from %s, which is no workspace", ip)
+		http.Error(w, "Unknown workspace", http.StatusNotFound)
+		return
+	}
+
+	user, ok := s.getUser(ws.Owner)
+	if !ok || s.isDenied(ws.Owner) {
+		s.log.Warn("Bootstrap of workspace %s refused, owner %s is not allowed", ws.Slug, ws.Owner)
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	first := false
+	err = s.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		if stored.BootstrappedAt.IsZero() {
+			stored.BootstrappedAt = time.Now()
+			first = true
+		}
+	})
+	if err != nil {
+		s.log.Error("Failed to record bootstrap of workspace %s: %v", ws.Slug, err)
+		http.Error(w, "Failed to update workspace", http.StatusInternalServerError)
+		return
+	}
+
+	if !first {
+		s.log.Warn("Bootstrap of workspace %s requested again from %s", ws.Slug, ip)
+		http.Error(w, "Workspace already bootstrapped", http.StatusGone)
+		return
+	}
+
+	s.log.Info("Serving bootstrap of workspace %s to %s", ws.Slug, ip)
+	s.store.AddEvent(domain.NewEvent(domain.EventBootstrap, ws.Owner, ws.Slug))
+	s.writeJSON(w, domain.NewBootstrap(user, ws))
+}
+
+func (s *Server) workspaceByIP(ip string) (*domain.Workspace, error) {
+	workspaces, err := s.store.ListWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ws := range workspaces {
+		if ws.IP == ip {
+			return ws, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/service"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// dashboardActions are the buttons offered for each workspace; reset maps to reclone.
+var dashboardActions = []string{"start", "stop", "hibernate", "restart", "reset", "delete"}
+
+type dashboardWorkspace struct {
+	Workspace *domain.Workspace
+	Info      *domain.VmInfo
+	Readiness *domain.Readiness
+	Status    domain.VmStatus
+	URL       string
+	Job       *domain.Job
+	Error     string
+}
+
+type templateOption struct {
+	Name        string
+	DisplayName string
+}
+
+type dashboardPage struct {
+	User       *domain.User
+	Workspaces []dashboardWorkspace
+	Templates  []templateOption
+	Actions    []string
+	Error      string
+}
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request, user *domain.User) {
+	page := dashboardPage{
+		User:      user,
+		Actions:   dashboardActions,
+		Templates: s.templateOptions(),
+	}
+
+	workspaces, err := s.store.ListWorkspacesOf(user.Key())
+	if err != nil {
+		s.log.Error("Failed to list workspaces of %s: %v", user.Key(), err)
+		page.Error = "Failed to read your workspaces"
+	}
+
+	for _, ws := range workspaces {
+		item := dashboardWorkspace{
+			Workspace: ws,
+			Status:    ws.Status,
+			URL:       "https://" + s.caddyService.Subdomain(ws),
+		}
+
+		item.Info, err = s.backend.Info(r.Context(), ws)
+		if err != nil {
+			s.log.Error("Failed to get info of workspace %s: %v", ws.Slug, err)
+			item.Error = "Failed to query this container"
+		} else if item.Info != nil {
+			item.Status = item.Info.Status
+		} else {
+			item.Status = domain.VmStatusMissing
+		}
+
+		if job, ok := s.provisioner.Status(ws.Slug); ok {
+			item.Job = &job
+		}
+
+		if readiness, ok := s.provisioner.Readiness(ws.Slug); ok {
+			item.Readiness = &readiness
+		}
+
+		page.Workspaces = append(page.Workspaces, item)
+	}
+
+	s.render(w, "dashboard", page)
+}
+
+func (s *Server) templateOptions() []templateOption {
+	cfg := s.provisioner.Config()
+
+	ret := []templateOption{}
+	for _, name := range cfg.TemplateNames() {
+		_, template, _ := cfg.Template(name)
+
+		option := templateOption{Name: name, DisplayName: template.DisplayName}
+		if option.DisplayName == "" {
+			option.DisplayName = name
+		}
+
+		ret = append(ret, option)
+	}
+
+	return ret
+}
+
+// sameOrigin refuses forged form posts. The session cookie is SameSite=Lax, which
+// still lets top-level cross-site navigations through, but browsers tag those.
+func (s *Server) sameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		http.Error(w, "Cross-site request refused", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleCreateWorkspace(w http.ResponseWriter, r *http.Request, user *domain.User) {
+	if !s.sameOrigin(w, r) {
+		return
+	}
+
+	name := r.FormValue("name")
+	template := r.FormValue("template")
+
+	s.log.Info("User %s requested new workspace %s from template %s", user.Key(), name, template)
+
+	job, err := s.provisioner.Start(r.Context(), user, name, template)
+	if err != nil {
+		s.renderWorkspaceError(w, "create", err)
+		return
+	}
+
+	http.Redirect(w, r, "/workspace?slug="+url.QueryEscape(domain.WorkspaceSlug(user, job.Workspace)), http.StatusSeeOther)
+}
+
+func (s *Server) handleDashboardAction(w http.ResponseWriter, r *http.Request, user *domain.User) {
+	if !s.sameOrigin(w, r) {
+		return
+	}
+
+	action := r.PathValue("action")
+
+	ws, err := s.userWorkspace(user, r.PathValue("slug"))
+	if err != nil {
+		s.renderWorkspaceError(w, action, err)
+		return
+	}
+
+	s.log.Info("User %s requested %s on workspace %s", user.Key(), action, ws.Slug)
+	s.reaper.Touch(ws.Slug)
+
+	if action == "delete" {
+		if err := s.provisioner.Delete(r.Context(), ws); err != nil {
+			s.renderWorkspaceError(w, action, err)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if action == "reset" {
+		action = "reclone"
+	}
+
+	job, err := s.workspaceAction(r.Context(), user, ws, action)
+	if err != nil {
+		s.renderWorkspaceError(w, r.PathValue("action"), err)
+		return
+	}
+
+	if job != nil {
+		http.Redirect(w, r, "/workspace?slug="+url.QueryEscape(ws.Slug), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) renderWorkspaceError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, service.ErrQuotaExceeded) {
+		s.renderQuotaError(w, err)
+		return
+	}
+
+	s.log.Warn("Workspace action %s failed: %v", action, err)
+	s.renderError(w, actionErrorStatus(err), "Workspace action failed", fmt.Sprintf("Could not %s the workspace: %v", action, err))
+}
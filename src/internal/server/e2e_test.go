@@ -0,0 +1,336 @@
+package server
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/fake"
+	"code-server-launcher/internal/service"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testTemplateID = 9000
+	testLogin      = "octocat"
+	testPubKey     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE2e2e octocat@example.com"
+)
+
+// oauthStub is the provider and user list server of newOAuthStub.
+type oauthStub struct {
+	*httptest.Server
+	users atomic.Pointer[string]
+}
+
+// SetUsers replaces the user list document served from /users.json.
+func (o *oauthStub) SetUsers(doc string) {
+	o.users.Store(&doc)
+}
+
+// newOAuthStub serves the GitHub Enterprise endpoints used by the github provider:
+// token exchange, user profile and SSH keys, plus the launcher user list, which
+// starts out with testLogin.
+func newOAuthStub(t *testing.T) *oauthStub {
+	ret := &oauthStub{}
+	ret.SetUsers(fmt.Sprintf(`{"users":[{"login":%q,"provider":"github","pubkey":%q}]}`, testLogin, testPubKey))
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"bad_verification_code"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"gho_test","token_type":"bearer","scope":"user:email"}`)
+	})
+
+	mux.HandleFunc("GET /api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gho_test" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"login":%q,"email":"octocat@example.com","name":"The Octocat"}`, testLogin)
+	})
+
+	mux.HandleFunc("GET /api/v3/users/{login}/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]any{{"id": 1, "key": testPubKey}})
+	})
+
+	mux.HandleFunc("GET /users.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, *ret.users.Load())
+	})
+
+	ret.Server = httptest.NewServer(mux)
+	t.Cleanup(ret.Close)
+
+	return ret
+}
+
+// listenUpstream stands in for code-server inside the workspace container: the
+// pool hands out 127.0.0.1 first, so the launcher reaches it on that address.
+func listenUpstream(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "code-server")
+	}))
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func newTestConfig(t *testing.T, oauth *oauthStub, pve *fake.Proxmox, caddy *fake.Caddy, upstreamPort int) *config.AppConfig {
+	caddyHost, caddyPort := caddy.Addr()
+
+	doc := map[string]any{
+		"providers": []map[string]any{{
+			"name":          "github",
+			"type":          "github",
+			"client_id":     "launcher",
+			"client_secret": "launcher-secret",
+			"redirect_url":  "http://launcher.test/callback",
+			"base_url":      oauth.URL,
+		}},
+		"user_list_url": oauth.URL + "/users.json",
+		"state_file":    filepath.Join(t.TempDir(), "state.db"),
+		"session":       map[string]any{"secret": "test-secret", "insecure_cookies": true},
+		"server":        map[string]any{"ready_timeout": 10, "public_url": "https://launcher.test"},
+		"caddy": map[string]any{
+			"host":          caddyHost,
+			"port":          caddyPort,
+			"base_url":      "code.test",
+			"upstream_port": upstreamPort,
+			"auth_upstream": "127.0.0.1:8080",
+		},
+		"workspace": map[string]any{
+			"memory_size":      1024,
+			"cpu_cores":        2,
+			"storage_size":     8,
+			"vmid_range_start": 200,
+			"vmid_range_end":   299,
+			"ip_pool":          "127.0.0.0/24",
+			"gateway":          "127.0.0.254",
+			"code_server_auth": "password",
+		},
+		"proxmox": map[string]any{
+			"host":          pve.Host(),
+			"node":          "pve",
+			"username":      pve.Username,
+			"password":      pve.Password,
+			"fingerprint":   pve.Fingerprint(),
+			"template_id":   testTemplateID,
+			"storage_name":  "local-lvm",
+			"time_to_start": 5,
+		},
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	return cfg
+}
+
+func TestLoginProvisionsWorkspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	oauth := newOAuthStub(t)
+
+	pve := fake.NewProxmox("pve")
+	t.Cleanup(pve.Close)
+	pve.AddTemplate(testTemplateID)
+
+	caddy := fake.NewCaddy()
+	t.Cleanup(caddy.Close)
+
+	upstreamPort := listenUpstream(t)
+
+	srv, err := NewServer(newTestConfig(t, oauth, pve, caddy, upstreamPort))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	launcher := httptest.NewServer(srv.Handler())
+	t.Cleanup(launcher.Close)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(launcher.URL + "/login/github")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	resp.Body.Close()
+
+	authorize, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(authorize.String(), oauth.URL+"/login/oauth/authorize") {
+		t.Fatalf("login redirected to %q, want the provider authorize URL", resp.Header.Get("Location"))
+	}
+
+	callback := launcher.URL + "/callback?" + url.Values{
+		"code":  {"good-code"},
+		"state": {authorize.Query().Get("state")},
+	}.Encode()
+
+	resp, err = client.Get(callback)
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasPrefix(resp.Header.Get("Location"), "/workspace?") {
+		t.Fatalf("callback answered %s to %q, want a redirect to the progress page", resp.Status, resp.Header.Get("Location"))
+	}
+
+	slug := testLogin
+	job := waitForJob(t, srv, slug, 30*time.Second)
+	if job.Phase != domain.JobPhaseReady {
+		t.Fatalf("job ended in phase %s: %s", job.Phase, job.Error)
+	}
+	if want := "https://" + slug + ".code.test"; job.URL != want {
+		t.Errorf("job URL = %q, want %q", job.URL, want)
+	}
+
+	ws, ok := srv.allocator.Get(slug)
+	if !ok {
+		t.Fatalf("no workspace allocated for %s", slug)
+	}
+	if ws.IP != "127.0.0.1" {
+		t.Errorf("workspace IP = %s, want the first pool address", ws.IP)
+	}
+
+	guest, ok := pve.Guest(ws.VMID)
+	if !ok {
+		t.Fatalf("container %d was not cloned, calls: %v", ws.VMID, pve.Calls())
+	}
+	if guest.Status != "running" {
+		t.Errorf("container %d is %s, want running", ws.VMID, guest.Status)
+	}
+	if guest.Name != "codeserver-"+slug {
+		t.Errorf("container hostname = %q, want codeserver-%s", guest.Name, slug)
+	}
+	if memory, _ := guest.Config["memory"].(float64); memory != 1024 {
+		t.Errorf("container memory = %v, want 1024", guest.Config["memory"])
+	}
+	if net0, _ := guest.Config["net0"].(string); !strings.Contains(net0, "ip=127.0.0.1/24") || !strings.Contains(net0, "gw=127.0.0.254") {
+		t.Errorf("container net0 = %q, want the allocated address and gateway", net0)
+	}
+	if guest.Firewall["enable"] != "1" || guest.Firewall["ipfilter"] != "1" {
+		t.Errorf("container firewall = %v, want it enabled with IP filtering", guest.Firewall)
+	}
+	if guest.MaxDisk != 8<<30 {
+		t.Errorf("container disk = %d bytes, want 8G", guest.MaxDisk)
+	}
+
+	var routes []service.Route
+	if err := caddy.Routes("srv0", &routes); err != nil {
+		t.Fatalf("routes: %v", err)
+	}
+
+	upstream := fmt.Sprintf("127.0.0.1:%d", upstreamPort)
+	found := false
+	for _, route := range routes {
+		if len(route.Match) == 0 || len(route.Match[0].Host) == 0 || route.Match[0].Host[0] != slug+".code.test" {
+			continue
+		}
+
+		found = true
+		last := route.Handle[len(route.Handle)-1]
+		if last.Handler != "reverse_proxy" || len(last.Upstreams) != 1 || last.Upstreams[0].Dial != upstream {
+			t.Errorf("route of %s proxies with %+v, want reverse_proxy to %s", slug, last, upstream)
+		}
+	}
+
+	if !found {
+		t.Errorf("no Caddy route for %s.code.test in %+v", slug, routes)
+	}
+
+	// The test client connects from 127.0.0.1, the address of the workspace.
+	resp, err = http.Get(launcher.URL + "/bootstrap")
+	if err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+
+	var boot domain.Bootstrap
+	err = json.NewDecoder(resp.Body).Decode(&boot)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("bootstrap answered %s: %v", resp.Status, err)
+	}
+
+	if boot.Hostname != "codeserver-"+slug || len(boot.SSHKeys) != 1 || boot.SSHKeys[0] != testPubKey {
+		t.Errorf("bootstrap = %+v, want the hostname and key of %s", boot, testLogin)
+	}
+	if boot.GitName != "The Octocat" || boot.GitEmail != "octocat@example.com" {
+		t.Errorf("bootstrap git identity = %q <%s>, want the profile name and email", boot.GitName, boot.GitEmail)
+	}
+	if boot.Auth != "password" || boot.Password == "" || boot.Password != ws.Password {
+		t.Errorf("bootstrap auth = %q with password %q, want the workspace password %q", boot.Auth, boot.Password, ws.Password)
+	}
+
+	resp, err = client.Get(launcher.URL + "/api/workspaces/" + slug + "/status")
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var status domain.Job
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Phase != domain.JobPhaseReady {
+		t.Errorf("status API answered %s with phase %q (%v), want ready through the session cookie", resp.Status, status.Phase, err)
+	}
+}
+
+func waitForJob(t *testing.T, srv *Server, slug string, timeout time.Duration) domain.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		job, ok := srv.provisioner.Status(slug)
+		if ok && (job.Phase == domain.JobPhaseReady || job.Phase == domain.JobPhaseFailed) {
+			return job
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("workspace %s not ready after %s, last job: %+v", slug, timeout, job)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
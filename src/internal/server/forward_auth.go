@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const remoteUserHeader = "X-Remote-User"
+
+// handleVerify answers Caddy forward_auth subrequests for workspace subdomains.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	host := r.Header.Get("X-Forwarded-Host")
+
+	slug, ok := s.caddyService.SlugFromHost(host)
+	if !ok {
+		s.log.Warn("Forward auth for unknown host: %s", host)
+		http.Error(w, "Unknown workspace", http.StatusForbidden)
+		return
+	}
+
+	user, err := s.currentUser(r)
+	if err != nil {
+		s.log.Debug("Forward auth without valid session for %s: %v", host, err)
+		s.redirectToLogin(w, r, host)
+		return
+	}
+
+	if !s.ownsWorkspace(user, slug) {
+		s.log.Warn("User %s tried to access workspace %s", user.Key(), slug)
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	s.reaper.Touch(slug)
+
+	w.Header().Set(remoteUserHeader, user.Login)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) redirectToLogin(w http.ResponseWriter, r *http.Request, host string) {
+	if s.config.PublicURL == "" {
+		s.log.Error("No public_url configured, cannot redirect %s to login", host)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+
+	returnTo := proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+	target := strings.TrimSuffix(s.config.PublicURL, "/") + "/login?return=" + url.QueryEscape(returnTo)
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"},{"login":"hubot"},{"login":"mallory"}],"deny":["mallory"]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	for _, login := range []string{"octocat", "mallory"} {
+		ws := &domain.Workspace{Owner: domain.UserKey("github", login), Name: domain.DefaultWorkspace, Slug: login}
+		if err := srv.store.SaveWorkspace(ws); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		login    string
+		host     string
+		code     int
+		location string
+	}{
+		{name: "owner", login: "octocat", host: "octocat.code.test", code: http.StatusOK},
+		{name: "other user", login: "hubot", host: "octocat.code.test", code: http.StatusForbidden},
+		{
+			name:     "no session",
+			host:     "octocat.code.test",
+			code:     http.StatusFound,
+			location: "https://launcher.test/login?return=https%3A%2F%2Foctocat.code.test%2Fproject%3Ffolder%3D%2Fsrc",
+		},
+		{name: "unknown host", login: "octocat", host: "launcher.test", code: http.StatusForbidden},
+		{name: "foreign host", login: "octocat", host: "octocat.example.com", code: http.StatusForbidden},
+		{name: "nested host", login: "octocat", host: "octocat.evil.code.test", code: http.StatusForbidden},
+		{name: "missing host", login: "octocat", code: http.StatusForbidden},
+		{
+			name:     "denied user",
+			login:    "mallory",
+			host:     "mallory.code.test",
+			code:     http.StatusFound,
+			location: "https://launcher.test/login?return=https%3A%2F%2Fmallory.code.test%2Fproject%3Ffolder%3D%2Fsrc",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := srv.request(t, http.MethodGet, "/auth/verify", test.login)
+			req.Header.Set("X-Forwarded-Host", test.host)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Uri", "/project?folder=/src")
+
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != test.code {
+				t.Fatalf("verify = %d, want %d", rec.Code, test.code)
+			}
+			if location := rec.Header().Get("Location"); location != test.location {
+				t.Errorf("redirect = %q, want %q", location, test.location)
+			}
+
+			user := rec.Header().Get(remoteUserHeader)
+			if test.code == http.StatusOK && user != test.login {
+				t.Errorf("%s = %q, want %q", remoteUserHeader, user, test.login)
+			}
+			if test.code != http.StatusOK && user != "" {
+				t.Errorf("%s = %q on a refused request", remoteUserHeader, user)
+			}
+		})
+	}
+}
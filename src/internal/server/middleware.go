@@ -0,0 +1,48 @@
+package server
+
+import (
+	"code-server-launcher/internal/domain"
+	"net/http"
+	"strings"
+)
+
+type userHandler func(w http.ResponseWriter, r *http.Request, user *domain.User)
+
+// requireUser resolves the session user for protected handlers, sending anonymous
+// browsers to the login page and anonymous API clients a 401.
+func (s *Server) requireUser(next userHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.currentUser(r)
+		if err != nil {
+			s.log.Debug("Unauthenticated request to %s: %v", r.URL.Path, err)
+
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		next(w, r, user)
+	}
+}
+
+func (s *Server) currentUser(r *http.Request) (*domain.User, error) {
+	sess, err := s.sessions.Get(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.authUser(r.Context(), sess.UserKey()) {
+		return nil, errUserNotAllowed
+	}
+
+	user, ok := s.getUser(sess.UserKey())
+	if !ok {
+		return nil, errUserNotAllowed
+	}
+
+	return user, nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed web/templates/*.html
+var templateFS embed.FS
+
+//go:embed web/static
+var staticFS embed.FS
+
+var pages = template.Must(template.New("pages").Funcs(template.FuncMap{
+	"bytes":    formatBytes,
+	"duration": formatUptime,
+}).ParseFS(templateFS, "web/templates/*.html"))
+
+type errorPage struct {
+	Title   string
+	Message string
+}
+
+func staticHandler() http.Handler {
+	static, err := fs.Sub(staticFS, "web/static")
+	if err != nil {
+		panic(fmt.Sprintf("failed to open embedded static assets: %v", err))
+	}
+
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
+
+func (s *Server) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := pages.ExecuteTemplate(w, name, data)
+	if err != nil {
+		s.log.Error("Failed to render %s page: %v", name, err)
+	}
+}
+
+func (s *Server) renderError(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	s.render(w, "error", errorPage{Title: title, Message: message})
+}
+
+func formatBytes(value uint64) string {
+	const unit = 1024
+	if value < unit {
+		return fmt.Sprintf("%d B", value)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := value / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(value)/float64(div), "KMGTPE"[exp])
+}
+
+func formatUptime(seconds int64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
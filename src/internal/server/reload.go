@@ -0,0 +1,110 @@
+package server
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/service"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const configPollInterval = 5 * time.Second
+
+// WatchConfig reloads the configuration on SIGHUP and whenever the modification
+// time of the file at path changes, until ctx is done.
+func (s *Server) WatchConfig(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.log.Info("SIGHUP received, reloading %s", path)
+		case <-ticker.C:
+			current := fileModTime(path)
+			if current.Equal(modTime) {
+				continue
+			}
+
+			modTime = current
+			s.log.Info("Config file %s changed, reloading", path)
+		}
+
+		s.reloadFrom(ctx, path)
+	}
+}
+
+func (s *Server) reloadFrom(ctx context.Context, path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		s.log.Error("Rejected config reload, keeping the running config: %v", err)
+		return
+	}
+
+	if err := s.Reload(ctx, cfg); err != nil {
+		s.log.Error("Rejected config reload, keeping the running config: %v", err)
+		return
+	}
+
+	s.log.Info("Config reloaded from %s", path)
+}
+
+// Reload applies cfg to the running services and refreshes the user list. The
+// listen address, sessions, identity providers, backend and state file are only
+// read at startup and need a restart to change. Everything that can fail is done
+// before any service is switched, so a rejected config leaves the running one whole.
+func (s *Server) Reload(ctx context.Context, cfg *config.AppConfig) error {
+	applyAllocator, err := s.allocator.PrepareReload(cfg.Workspace)
+	if err != nil {
+		return err
+	}
+
+	applyBackend := func() {}
+	switch backend := s.backend.(type) {
+	case *service.ProxmoxService:
+		applyBackend, err = backend.PrepareReload(cfg.Proxmox, cfg.Workspace)
+		if err != nil {
+			return err
+		}
+	case *service.DockerService:
+		applyBackend = func() { backend.Reload(cfg.Workspace) }
+	}
+
+	applyBackend()
+	applyAllocator()
+	s.provisioner.Reload(cfg.Workspace)
+
+	s.caddyService.Reload(cfg.Caddy)
+	s.userService.Reload(cfg)
+	s.reaper.Reload(cfg.Idle)
+
+	s.mu.Lock()
+	s.admins = domain.UserKeySet(cfg.Admins)
+	s.mu.Unlock()
+
+	if err := s.refreshUsers(ctx); err != nil {
+		s.log.Warn("Config reloaded but the user list could not be refreshed: %v", err)
+	}
+
+	return nil
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
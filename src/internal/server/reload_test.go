@@ -0,0 +1,67 @@
+package server
+
+import (
+	"code-server-launcher/internal/service"
+	"testing"
+)
+
+func TestReloadDropsRemovedUsers(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"},{"login":"hubot"}]}`)
+
+	cfg := newTestConfig(t, srv.oauth, srv.pve, srv.caddy, srv.caddyService.Config().UpstreamPort)
+	if err := srv.Reload(t.Context(), cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, ok := srv.allowedUser("github:octocat"); !ok {
+		t.Fatal("listed user not allowed after reload")
+	}
+
+	srv.oauth.SetUsers(`{"users":[{"login":"hubot"}],"deny":["mallory"]}`)
+	if err := srv.Reload(t.Context(), cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if _, ok := srv.allowedUser("github:octocat"); ok {
+		t.Error("user removed from the list still allowed after reload")
+	}
+	if _, ok := srv.allowedUser("github:hubot"); !ok {
+		t.Error("user still on the list lost access on reload")
+	}
+	if !srv.isDenied("github:mallory") {
+		t.Error("deny list not replaced on reload")
+	}
+}
+
+func TestRejectedReloadKeepsConfig(t *testing.T) {
+	srv := newTestServer(t)
+	proxmox := srv.backend.(*service.ProxmoxService)
+
+	cfg := newTestConfig(t, srv.oauth, srv.pve, srv.caddy, srv.caddyService.Config().UpstreamPort)
+	cfg.Workspace.MemSize = 4096
+	cfg.Proxmox.Password = "changed"
+	cfg.Caddy.BaseURL = "other.test"
+	cfg.Admins = []string{"octocat"}
+
+	// The new password is refused by Proxmox.
+	if err := srv.Reload(t.Context(), cfg); err == nil {
+		t.Fatal("reload with a refused password succeeded")
+	}
+
+	cfg.Proxmox.Password = srv.pve.Password
+	cfg.Workspace.IPPool = "10.0.0.0"
+
+	if err := srv.Reload(t.Context(), cfg); err == nil {
+		t.Fatal("reload with a malformed pool succeeded")
+	}
+
+	if proxmox.Config().Password != srv.pve.Password || srv.provisioner.Config().MemSize != 1024 {
+		t.Error("rejected reload switched the Proxmox or workspace settings")
+	}
+	if srv.caddyService.Config().BaseURL != "code.test" {
+		t.Error("rejected reload switched the Caddy settings")
+	}
+	if srv.isAdmin("github:octocat") {
+		t.Error("rejected reload switched the admins")
+	}
+}
@@ -3,149 +3,622 @@ package server
 import (
 	"code-server-launcher/internal/config"
 	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/identity"
 	"code-server-launcher/internal/logger"
 	"code-server-launcher/internal/service"
+	"code-server-launcher/internal/session"
+	"code-server-launcher/internal/store"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"strings"
-
-	"golang.org/x/oauth2"
+	"sync"
+	"time"
 )
 
+var errUserNotAllowed = errors.New("user is not allowed")
+
+// httpShutdownTimeout bounds how long open requests get to finish once the
+// provisioning jobs are drained.
+const httpShutdownTimeout = 10 * time.Second
+
+// userRefreshInterval spaces out the user list refreshes triggered by sessions of
+// users missing from it, so a stale browser tab cannot flood the list source.
+const userRefreshInterval = 30 * time.Second
+
 type Server struct {
-	log            *logger.Logger
-	config         *config.ServerConfig
-	userService    *service.UserService
-	proxmoxService *service.ProxmoxService
-	githubConfig   *config.GithubConfig
-	oauth2         *oauth2.Config
-	allowedUsers   map[string]*domain.User
+	log          *logger.Logger
+	config       *config.ServerConfig
+	userService  *service.UserService
+	backend      service.WorkspaceBackend
+	caddyService *service.Caddy
+	allocator    *service.Allocator
+	provisioner  *service.Provisioner
+	reaper       *service.Reaper
+	sessions     *session.Manager
+	providers    *identity.Registry
+	store        *store.Store
+	allowedUsers map[string]*domain.User
+	deniedUsers  map[string]bool
+	// listed holds the users of the last user list, enrolled those let in by
+	// provider membership; allowedUsers has both.
+	listed      map[string]bool
+	enrolled    map[string]bool
+	admins      map[string]bool
+	mu          sync.RWMutex
+	lastRefresh time.Time
+	refreshMu   sync.Mutex
 }
 
-func NewServer(cfg *config.AppConfig) *Server {
-	return &Server{
-		log:            logger.NewLogger("Http-Server"),
-		config:         cfg.Server,
-		userService:    service.NewUserService(cfg),
-		proxmoxService: service.NewProxmoxService(cfg.Proxmox),
-		githubConfig:   cfg.Github,
-		oauth2:         cfg.Github.GetOAuth(),
-		allowedUsers:   map[string]*domain.User{},
+func NewServer(cfg *config.AppConfig) (*Server, error) {
+	providers, err := identity.NewRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "code-server-launcher.db"
 	}
 
+	st, err := store.NewStore(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Server{
+		log:          logger.NewLogger("Http-Server"),
+		config:       cfg.Server,
+		userService:  service.NewUserService(cfg),
+		allowedUsers: map[string]*domain.User{},
+		deniedUsers:  map[string]bool{},
+		listed:       map[string]bool{},
+		enrolled:     map[string]bool{},
+		admins:       domain.UserKeySet(cfg.Admins),
+		sessions:     session.NewManager(cfg.Session),
+		providers:    providers,
+		store:        st,
+	}
+
+	var placer *service.Placer
+
+	switch cfg.Backend {
+	case config.BackendDocker:
+		ret.backend = service.NewDockerService(cfg.Docker, cfg.Workspace, st)
+	default:
+		proxmox := service.NewProxmoxService(cfg.Proxmox, cfg.Workspace, st)
+		if proxmox == nil {
+			return nil, fmt.Errorf("failed to set up Proxmox client for %s", cfg.Proxmox.Host)
+		}
+		ret.backend = proxmox
+		placer = service.NewPlacer(proxmox)
+	}
+
+	ret.log.Info("Running workspaces on %s", cfg.Backend)
+	ret.caddyService = service.NewCaddyService(cfg.Caddy, ret.backend, st)
+
+	ret.allocator, err = service.NewAllocator(cfg.Workspace, ret.backend, st)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.provisioner = service.NewProvisioner(cfg.Workspace, ret.backend, ret.caddyService, ret.allocator, placer, st, ret.allowedUser, cfg.Server.ReadyTimeout)
+	ret.reaper = service.NewReaper(cfg.Idle, ret.provisioner, st, ret.getUser)
+
+	users, err := st.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	// Listed users are stored for their profile only; the user list decides on them.
+	for _, user := range users {
+		if user.Enrolled {
+			ret.allowedUsers[user.Key()] = user
+			ret.enrolled[user.Key()] = true
+		}
+	}
+
+	return ret, nil
+}
+
+// Handler returns the launcher HTTP routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHome)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/login/{provider}", s.handleProviderLogin)
+	mux.HandleFunc("/callback", s.handleCallback)
+	mux.HandleFunc("/logout", s.handleLogout)
+	mux.HandleFunc("/auth/verify", s.handleVerify)
+	mux.HandleFunc("GET /bootstrap", s.handleBootstrap)
+	mux.HandleFunc("/workspace", s.requireUser(s.handleWorkspace))
+	mux.HandleFunc("POST /workspaces", s.requireUser(s.handleCreateWorkspace))
+	mux.HandleFunc("POST /workspaces/{slug}/{action}", s.requireUser(s.handleDashboardAction))
+	mux.Handle("GET /static/", staticHandler())
+	mux.HandleFunc("GET /api/workspaces/{slug}/status", s.requireUser(s.handleWorkspaceStatus))
+	s.registerAdminRoutes(mux)
+
+	return mux
 }
 
-func (s *Server) Start() error {
-	http.HandleFunc("/", s.handleHome)
-	http.HandleFunc("/login", s.handleLogin)
-	http.HandleFunc("/callback", s.handleCallback)
+// Start serves HTTP until ctx is done. It then waits up to shutdown_timeout for
+// the provisioning jobs in flight, still answering the progress pages meanwhile,
+// before closing the listener. It returns nil after such a graceful stop.
+func (s *Server) Start(ctx context.Context) error {
+	go s.provisioner.RunReconciler(ctx, time.Duration(s.config.ReconcileInterval)*time.Second)
+	go s.reaper.Run(ctx)
+
+	addr := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
 
-	addr := s.config.Host + ":" + string(s.config.Port)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
 
 	s.log.Info("Server started at %s", addr)
-	err := http.ListenAndServe(addr, nil)
 
-	if err != nil {
+	select {
+	case err := <-errs:
 		s.log.Error("HTTP Server Return: %v", err)
+		return err
+	case <-ctx.Done():
+	}
+
+	s.log.Info("Shutting down, waiting for provisioning jobs")
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if err := s.provisioner.Shutdown(drainCtx); err != nil {
+		s.log.Warn("Provisioning jobs did not finish in time, cancelled them: %v", err)
+	}
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancelClose()
+
+	if err := srv.Shutdown(closeCtx); err != nil {
+		s.log.Warn("HTTP server did not close cleanly: %v", err)
 	}
 
 	return nil
 }
 
-func (s *Server) refreshUsers() error {
-	users, err := s.userService.LoadUsers()
+// refreshUsers loads the user list. When it cannot be loaded the allowed and denied
+// users stay as they are.
+func (s *Server) refreshUsers(ctx context.Context) error {
+	users, err := s.userService.LoadUsers(ctx)
 
 	if err != nil {
 		s.log.Error("Failed to load users: %v", err)
 		return err
 	}
 
+	stored, err := s.store.ListUsers()
+	if err != nil {
+		s.log.Warn("Failed to read stored users, their profiles are not kept: %v", err)
+	}
+
+	profiles := make(map[string]*domain.User, len(stored))
+	for _, user := range stored {
+		profiles[user.Key()] = user
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Rebuilt from scratch so users dropped from the list lose access; users enrolled
+	// by membership are not on the list and are carried over.
+	allowed := make(map[string]*domain.User, len(users.Users)+len(s.enrolled))
+	for key := range s.enrolled {
+		if user, ok := s.allowedUsers[key]; ok {
+			allowed[key] = user
+		}
+	}
+
+	listed := make(map[string]bool, len(users.Users))
 	for _, user := range users.Users {
-		s.allowedUsers[user.Login] = user
+		listed[user.Key()] = true
+
+		// The list carries no profile, keep what the last login brought.
+		known, ok := s.allowedUsers[user.Key()]
+		if !ok {
+			known, ok = profiles[user.Key()]
+		}
+		if ok {
+			user.SetIdentity(known.Name, known.Email)
+			if user.PubKey == "" {
+				user.SetPubKey(known.PubKey)
+			}
+		}
+		user.Enrolled = s.enrolled[user.Key()]
+		allowed[user.Key()] = user
 	}
 
+	s.allowedUsers = allowed
+	s.listed = listed
+	s.deniedUsers = users.DeniedKeys()
+
 	return nil
 }
 
+// refreshUsersThrottled refreshes the user list unless a refresh was tried less
+// than userRefreshInterval ago.
+func (s *Server) refreshUsersThrottled(ctx context.Context) {
+	s.refreshMu.Lock()
+	if time.Since(s.lastRefresh) < userRefreshInterval {
+		s.refreshMu.Unlock()
+		s.log.Debug("User list refreshed less than %s ago, not refreshing", userRefreshInterval)
+		return
+	}
+	s.lastRefresh = time.Now()
+	s.refreshMu.Unlock()
+
+	if err := s.refreshUsers(ctx); err != nil {
+		s.log.Error("Failed to refresh user list: %v", err)
+	}
+}
+
+func (s *Server) isDenied(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.deniedUsers[key]
+}
+
+func (s *Server) isListed(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listed[key]
+}
+
+// authorizeLogin decides whether profile may log in through provider. Users on the
+// list get in; the others need the provider to grant access, such as through
+// organization membership. That is checked on every login, so users enrolled that
+// way lose access once they leave. Logins are bounded by the provider, so they
+// always refresh the list for users missing from it.
+func (s *Server) authorizeLogin(ctx context.Context, provider identity.Provider, profile *domain.Profile) bool {
+	key := domain.UserKey(profile.Provider, profile.Login)
+
+	if !s.isListed(key) {
+		if err := s.refreshUsers(ctx); err != nil {
+			s.log.Error("Failed to refresh user list: %v", err)
+		}
+	}
+
+	if s.isDenied(key) {
+		return false
+	}
+
+	if s.isListed(key) {
+		return true
+	}
+
+	if !provider.Authorize(profile) {
+		s.unenroll(key)
+		return false
+	}
+
+	s.enroll(profile)
+
+	return true
+}
+
+// enroll adds a user granted by provider membership; the workspace VMID and IP
+// are assigned later by the allocator.
+func (s *Server) enroll(profile *domain.Profile) *domain.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := domain.UserKey(profile.Provider, profile.Login)
+	if user, ok := s.allowedUsers[key]; ok && s.enrolled[key] {
+		return user
+	}
+
+	user := domain.NewUserFromProfile(profile)
+	user.Enrolled = true
+	s.allowedUsers[key] = user
+	s.enrolled[key] = true
+
+	if err := s.store.SaveUser(user); err != nil {
+		s.log.Error("Failed to persist enrolled user %s: %v", key, err)
+	}
+
+	s.log.Info("User %s enrolled by %s membership", key, profile.Provider)
+	s.store.AddEvent(domain.NewEvent(domain.EventEnroll, key, "enrolled by "+profile.Provider+" membership"))
+
+	return user
+}
+
+// unenroll drops a user enrolled by provider membership, which the provider no
+// longer grants. Users also on the list keep their access.
+func (s *Server) unenroll(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.enrolled[key] {
+		return
+	}
+
+	delete(s.enrolled, key)
+
+	var err error
+	if user, ok := s.allowedUsers[key]; ok && s.listed[key] {
+		listed := *user
+		listed.Enrolled = false
+		s.allowedUsers[key] = &listed
+		err = s.store.SaveUser(&listed)
+	} else {
+		delete(s.allowedUsers, key)
+		err = s.store.DeleteUser(key)
+	}
+	if err != nil {
+		s.log.Error("Failed to remove enrolled user %s: %v", key, err)
+	}
+
+	s.log.Info("User %s dropped, membership no longer grants access", key)
+	s.store.AddEvent(domain.NewEvent(domain.EventUnenroll, key, "membership no longer grants access"))
+}
+
+func (s *Server) isAdmin(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.admins[key]
+}
+
+func (s *Server) getUser(key string) (*domain.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.allowedUsers[key]
+	return user, ok
+}
+
+// updateUser replaces the allowed user key with a copy changed by apply, so the
+// users already handed out are never modified, stores it and returns the copy.
+func (s *Server) updateUser(key string, apply func(user *domain.User)) (*domain.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.allowedUsers[key]
+	if !ok {
+		return nil, false
+	}
+
+	updated := *current
+	apply(&updated)
+	s.allowedUsers[key] = &updated
+
+	if err := s.store.SaveUser(&updated); err != nil {
+		s.log.Error("Failed to persist user %s: %v", key, err)
+	}
+
+	return &updated, true
+}
+
+// allowedUser is getUser for a user who is also not in the deny list.
+func (s *Server) allowedUser(key string) (*domain.User, bool) {
+	if s.isDenied(key) {
+		return nil, false
+	}
+
+	return s.getUser(key)
+}
+
 func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, `<a href="/login">Login with GitHub</a>`)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
 	s.log.Debug("Home page accessed")
+
+	if user, err := s.currentUser(r); err == nil {
+		s.handleDashboard(w, r, user)
+		return
+	}
+
+	s.render(w, "home", nil)
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("Login page accessed")
 
-	url := s.oauth2.AuthCodeURL("state-token", oauth2.AccessTypeOnline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	if target := r.URL.Query().Get("return"); target != "" && s.caddyService.IsWorkspaceURL(target) {
+		s.sessions.SetReturnTo(w, target)
+	}
+
+	providers := s.providers.List()
+	if len(providers) == 1 {
+		http.Redirect(w, r, "/login/"+url.PathEscape(providers[0].Name()), http.StatusTemporaryRedirect)
+		return
+	}
+
+	s.render(w, "login", providers)
+}
+
+func (s *Server) handleProviderLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.providers.Get(r.PathValue("provider"))
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	state := s.sessions.NewState(w, provider.Name())
+	http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusTemporaryRedirect)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.sessions.Destroy(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug("Callback page accessed")
+
+	providerName, err := s.sessions.VerifyState(w, r)
+	if err != nil {
+		s.log.Warn("Rejected OAuth callback: %v", err)
+		http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+		return
+	}
+
+	provider, ok := s.providers.Get(providerName)
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusBadRequest)
+		return
+	}
+
 	code := r.URL.Query().Get("code")
-	token, err := s.oauth2.Exchange(context.Background(), code)
+	token, err := provider.Exchange(r.Context(), code)
 	if err != nil {
+		s.log.Error("Failed to exchange token with %s: %v", provider.Name(), err)
 		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
 		return
 	}
 
-	client := s.oauth2.Client(context.Background(), token)
-	resp, err := client.Get("https://api.github.com/user")
+	profile, err := provider.Profile(r.Context(), token)
 	if err != nil {
+		s.log.Error("Failed to get user info from %s: %v", provider.Name(), err)
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	var user struct {
-		Login string `json:"login"`
+	s.log.Debug("User info: %+v", profile)
+
+	key := domain.UserKey(profile.Provider, profile.Login)
+	if !s.authorizeLogin(r.Context(), provider, profile) {
+		s.log.Warn("Access denied for user: %s", key)
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	allowed, ok := s.updateUser(key, func(user *domain.User) {
+		if user.PubKey == "" && len(profile.SSHKeys) > 0 {
+			user.SetPubKey(strings.Join(profile.SSHKeys, "\n"))
+		}
+		user.SetIdentity(profile.Name, profile.Email)
+	})
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
+
+	if err := s.sessions.Create(w, profile.Provider, profile.Login); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	user.Login = strings.ToLower(user.Login)
+	s.store.AddEvent(domain.NewEvent(domain.EventLogin, key, "login with "+provider.Name()))
+
+	// Start the workspace the browser was headed to, or the default one.
+	ws := &domain.Workspace{Name: domain.DefaultWorkspace, Slug: allowed.Slug()}
+	returnTo := s.sessions.PopReturnTo(w, r)
+	if target, err := url.Parse(returnTo); returnTo != "" && err == nil {
+		if slug, ok := s.caddyService.SlugFromHost(target.Host); ok {
+			if owned, err := s.userWorkspace(allowed, slug); err == nil {
+				ws = owned
+			}
+		}
+	}
 
-	s.log.Debug("User info: %+v\n", user)
+	s.reaper.Touch(ws.Slug)
 
-	if !s.authUser(user.Login) {
-		log.Printf("Access denied for user: %s", user.Login)
-		http.Error(w, "Access denied", http.StatusForbidden)
+	if _, err := s.provisioner.Start(r.Context(), allowed, ws.Name, ws.Template); err != nil {
+		if errors.Is(err, service.ErrQuotaExceeded) {
+			s.renderQuotaError(w, err)
+			return
+		}
+		if errors.Is(err, service.ErrShuttingDown) {
+			http.Error(w, "Server is shutting down, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		http.Error(w, "Failed to start workspace", http.StatusInternalServerError)
+		return
+	}
+
+	query := url.Values{"slug": {ws.Slug}}
+	if returnTo != "" {
+		query.Set("return", returnTo)
+	}
+
+	http.Redirect(w, r, "/workspace?"+query.Encode(), http.StatusSeeOther)
+}
+
+func (s *Server) handleWorkspace(w http.ResponseWriter, r *http.Request, user *domain.User) {
+	slug := r.URL.Query().Get("slug")
+	if slug == "" {
+		slug = user.Slug()
+	}
+
+	if !s.ownsWorkspace(user, slug) {
+		s.renderError(w, http.StatusNotFound, "Unknown workspace", "You have no workspace called "+slug+".")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{Name: "user", Value: user.Login})
+	returnTo := r.URL.Query().Get("return")
+	if !s.caddyService.IsWorkspaceURL(returnTo) {
+		returnTo = ""
+	}
+
+	s.render(w, "progress", map[string]string{"Slug": slug, "Return": returnTo})
+}
+
+func (s *Server) handleWorkspaceStatus(w http.ResponseWriter, r *http.Request, user *domain.User) {
+	slug := r.PathValue("slug")
+
+	if !s.ownsWorkspace(user, slug) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
 
-	//Create a new VM for the user
+	job, ok := s.provisioner.Status(slug)
+	if !ok {
+		http.Error(w, "No workspace job found", http.StatusNotFound)
+		return
+	}
 
-	//create Caddy new Entry for the user
+	s.writeJSON(w, job)
+}
 
-	//redirect to the VM page
+func (s *Server) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		s.log.Error("Failed to encode JSON response: %v", err)
+	}
 }
 
-func (s *Server) authUser(user string) bool {
+// authUser reports whether user may use the launcher. Unknown users trigger a
+// refresh of the user list, at most once every userRefreshInterval.
+func (s *Server) authUser(ctx context.Context, user string) bool {
 	s.log.Debug("Auth user: %s", user)
 
-	if _, ok := s.allowedUsers[user]; ok {
+	if s.isDenied(user) {
+		s.log.Debug("User %s is in the deny list", user)
+		return false
+	}
+
+	if _, ok := s.getUser(user); ok {
 		s.log.Debug("User %s found in allowed users", user)
 		return true
-	} else {
-		s.log.Debug("User %s not found! Trying to refresh user list", user)
-		err := s.refreshUsers()
-		if err != nil {
-			s.log.Error("Failed to refresh user list: %v", err)
-		}
+	}
 
-		if _, ok := s.allowedUsers[user]; ok {
-			s.log.Debug("User %s found in allowed users", user)
-			return true
-		} else {
-			s.log.Debug("User %s not found in allowed users", user)
-		}
+	s.log.Debug("User %s not found! Trying to refresh user list", user)
+	s.refreshUsersThrottled(ctx)
+
+	if _, ok := s.getUser(user); ok && !s.isDenied(user) {
+		s.log.Debug("User %s found in allowed users", user)
+		return true
 	}
 
+	s.log.Debug("User %s not found in allowed users", user)
+
 	return false
 }
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/fake"
+	"code-server-launcher/internal/identity"
+	"code-server-launcher/internal/service"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+type testServer struct {
+	*Server
+	cfg   *config.AppConfig
+	oauth *oauthStub
+	pve   *fake.Proxmox
+	caddy *fake.Caddy
+}
+
+// newTestServer builds a launcher on top of the provider stub and the fake Proxmox
+// and Caddy, without serving it.
+func newTestServer(t *testing.T) *testServer {
+	oauth := newOAuthStub(t)
+
+	pve := fake.NewProxmox("pve")
+	t.Cleanup(pve.Close)
+	pve.AddTemplate(testTemplateID)
+
+	caddy := fake.NewCaddy()
+	t.Cleanup(caddy.Close)
+
+	cfg := newTestConfig(t, oauth, pve, caddy, listenUpstream(t))
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { srv.store.Close() })
+
+	return &testServer{Server: srv, cfg: cfg, oauth: oauth, pve: pve, caddy: caddy}
+}
+
+// restart closes the store and builds the launcher anew on the same config.
+func (srv *testServer) restart(t *testing.T) *testServer {
+	srv.store.Close()
+
+	next, err := NewServer(srv.cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { next.store.Close() })
+
+	return &testServer{Server: next, cfg: srv.cfg, oauth: srv.oauth, pve: srv.pve, caddy: srv.caddy}
+}
+
+// request builds a request carrying a session of the GitHub user login, or none
+// when login is empty.
+func (srv *testServer) request(t *testing.T, method, target, login string) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, nil)
+	if login == "" {
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	if err := srv.sessions.Create(rec, "github", login); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	return req
+}
+
+// memberProvider grants access by membership when member is set.
+type memberProvider struct {
+	identity.Provider
+	member bool
+}
+
+func (p *memberProvider) Authorize(*domain.Profile) bool {
+	return p.member
+}
+
+func TestMembershipCheckedOnEveryLogin(t *testing.T) {
+	srv := newTestServer(t)
+	provider := &memberProvider{member: true}
+	hubot := &domain.Profile{Provider: "github", Login: "hubot"}
+	key := domain.UserKey(hubot.Provider, hubot.Login)
+
+	if !srv.authorizeLogin(t.Context(), provider, hubot) {
+		t.Fatal("member was refused")
+	}
+	if users, _ := srv.store.ListUsers(); len(users) != 1 || users[0].Key() != key {
+		t.Fatalf("stored users = %v, want the enrolled member", users)
+	}
+
+	// Once out of the organization, the enrolled user is dropped on the next login.
+	provider.member = false
+	if srv.authorizeLogin(t.Context(), provider, hubot) {
+		t.Fatal("former member was let in")
+	}
+	if _, ok := srv.getUser(key); ok {
+		t.Error("former member is still allowed")
+	}
+	if users, _ := srv.store.ListUsers(); len(users) != 0 {
+		t.Errorf("stored users = %v, want the former member removed", users)
+	}
+
+	// Users on the list do not depend on membership.
+	if !srv.authorizeLogin(t.Context(), provider, &domain.Profile{Provider: "github", Login: testLogin}) {
+		t.Error("listed user was refused")
+	}
+}
+
+func TestMalformedUserListKeepsUsers(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"}],"deny":["mallory"]}`)
+
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	srv.oauth.SetUsers(`{"users":[{"login":"octo`)
+	if err := srv.refreshUsers(t.Context()); err == nil {
+		t.Fatal("truncated user list was accepted")
+	}
+
+	if !srv.isDenied("github:mallory") {
+		t.Error("deny list cleared by a truncated user list")
+	}
+	if _, ok := srv.getUser("github:octocat"); !ok {
+		t.Error("allowed users cleared by a truncated user list")
+	}
+}
+
+func TestBootstrapServedOnce(t *testing.T) {
+	srv := newTestServer(t)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	// httptest requests come from 192.0.2.1.
+	ws := &domain.Workspace{Owner: domain.UserKey("github", testLogin), Name: domain.DefaultWorkspace, Slug: testLogin, VMID: 200, IP: "192.0.2.1"}
+	if err := srv.store.SaveWorkspace(ws); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	bootstrap := func() int {
+		rec := httptest.NewRecorder()
+		srv.handleBootstrap(rec, httptest.NewRequest(http.MethodGet, "/bootstrap", nil))
+		return rec.Code
+	}
+
+	if code := bootstrap(); code != http.StatusOK {
+		t.Fatalf("first bootstrap = %d, want 200", code)
+	}
+	if code := bootstrap(); code != http.StatusGone {
+		t.Errorf("second bootstrap = %d, want 410", code)
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "/bootstrap", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	rec := httptest.NewRecorder()
+	srv.handleBootstrap(rec, other)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("bootstrap from another address = %d, want 404", rec.Code)
+	}
+}
+
+func TestReconcileRevokesRemovedUser(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"},{"login":"hubot"}]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	host := "octocat.code.test"
+	ws := &domain.Workspace{Owner: "github:octocat", Name: domain.DefaultWorkspace, Slug: "octocat", VMID: 250, IP: "127.0.0.50"}
+	if err := srv.store.SaveWorkspace(ws); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := srv.caddyService.Insert(t.Context(), ws); err != nil {
+		t.Fatalf("insert route: %v", err)
+	}
+
+	// octocat is dropped from the list.
+	srv.oauth.SetUsers(`{"users":[{"login":"hubot"}]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	if _, ok := srv.getUser("github:octocat"); ok {
+		t.Fatal("user dropped from the list is still allowed")
+	}
+	if _, ok := srv.getUser("github:hubot"); !ok {
+		t.Fatal("user still on the list lost access")
+	}
+
+	srv.provisioner.Reconcile(t.Context())
+
+	var routes []service.Route
+	if err := srv.caddy.Routes("srv0", &routes); err != nil {
+		t.Fatalf("routes: %v", err)
+	}
+	for _, route := range routes {
+		for _, match := range route.Match {
+			if slices.Contains(match.Host, host) {
+				t.Errorf("route %s of the dropped user survived the reconcile", host)
+			}
+		}
+	}
+}
+
+func TestAdminDeletesWorkspaceOfRevokedUser(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"},{"login":"hubot"}]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	srv.admins = map[string]bool{"github:octocat": true}
+
+	ws := &domain.Workspace{Owner: "github:hubot", Name: domain.DefaultWorkspace, Slug: "hubot", VMID: 250, IP: "127.0.0.50"}
+	if err := srv.store.SaveWorkspace(ws); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// hubot is dropped from the list, the workspace stays behind.
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"}]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, srv.request(t, http.MethodPost, "/api/admin/workspaces/hubot/start", "octocat"))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("start for a revoked owner = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, srv.request(t, http.MethodDelete, "/api/admin/workspaces/hubot", "octocat"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d %s, want 204", rec.Code, rec.Body)
+	}
+
+	if stored, err := srv.store.GetWorkspace("hubot"); err != nil || stored != nil {
+		t.Errorf("workspace after delete = %+v (%v), want it released", stored, err)
+	}
+}
+
+func TestListedUserProfileSurvivesRestart(t *testing.T) {
+	srv := newTestServer(t)
+	srv.oauth.SetUsers(`{"users":[{"login":"octocat"}]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	_, ok := srv.updateUser("github:octocat", func(user *domain.User) {
+		user.SetPubKey(testPubKey)
+		user.SetIdentity("The Octocat", "octocat@example.com")
+	})
+	if !ok {
+		t.Fatal("listed user not found")
+	}
+
+	srv = srv.restart(t)
+
+	// The stored profile grants nothing, the user list does.
+	if _, ok := srv.getUser("github:octocat"); ok {
+		t.Fatal("listed user allowed before the user list was read")
+	}
+
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	user, ok := srv.getUser("github:octocat")
+	if !ok {
+		t.Fatal("listed user not allowed after restart")
+	}
+	if user.Name != "The Octocat" || user.Email != "octocat@example.com" || user.PubKey != testPubKey {
+		t.Errorf("user after restart = %+v, want the profile of the last login", user)
+	}
+
+	srv.oauth.SetUsers(`{"users":[]}`)
+	if err := srv.refreshUsers(t.Context()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, ok := srv.getUser("github:octocat"); ok {
+		t.Error("stored profile kept a user dropped from the list")
+	}
+}
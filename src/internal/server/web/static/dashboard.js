@@ -0,0 +1,7 @@
+document.querySelectorAll("button[data-confirm]").forEach(function (button) {
+	button.addEventListener("click", function (event) {
+		if (!window.confirm(button.dataset.confirm)) {
+			event.preventDefault();
+		}
+	});
+});
@@ -0,0 +1,43 @@
+(function () {
+	const script = document.getElementById("progress");
+	const statusUrl = script.dataset.statusUrl;
+	const returnTo = script.dataset.return;
+
+	async function poll() {
+		try {
+			const resp = await fetch(statusUrl, {credentials: "same-origin"});
+
+			// Client errors (signed out, workspace gone) will not clear up by polling again.
+			if (resp.status >= 400 && resp.status < 500) {
+				const message = (await resp.text()).trim();
+				document.getElementById("error").textContent = message || "Workspace status unavailable (" + resp.status + ")";
+				return;
+			}
+
+			if (resp.ok) {
+				const job = await resp.json();
+				document.getElementById("phase").textContent = job.phase;
+				document.getElementById("task").textContent = job.task ? job.task.type + ": " + job.task.status : "";
+
+				if (job.phase === "ready") {
+					window.location = returnTo || job.url;
+					return;
+				}
+
+				if (job.phase === "failed") {
+					document.getElementById("error").textContent = job.error;
+					if (job.task && job.task.log) {
+						document.getElementById("task-log").textContent = job.task.log.join("\n");
+					}
+					return;
+				}
+			}
+		} catch (e) {
+			// Network errors are transient, keep polling.
+		}
+
+		setTimeout(poll, 2000);
+	}
+
+	poll();
+})();
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// vmidLister is implemented by backends whose VMIDs are shared with guests the
+// launcher does not manage.
+type vmidLister interface {
+	UsedVMIDs(ctx context.Context) (map[int]bool, error)
+}
+
+type Allocator struct {
+	log       *logger.Logger
+	backend   WorkspaceBackend
+	store     *store.Store
+	cfg       *config.WorkspaceConfig
+	vmidStart int
+	vmidEnd   int
+	pool      *net.IPNet
+	gateway   net.IP
+	mu        sync.Mutex
+}
+
+func NewAllocator(cfg *config.WorkspaceConfig, backend WorkspaceBackend, st *store.Store) (*Allocator, error) {
+	ret := &Allocator{
+		log:     logger.NewLogger("Allocator"),
+		backend: backend,
+		store:   st,
+	}
+
+	if err := ret.Reload(cfg); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Reload switches the VMID range and IP pool used for new allocations. Workspaces
+// already allocated keep their VMID and IP.
+func (a *Allocator) Reload(cfg *config.WorkspaceConfig) error {
+	apply, err := a.PrepareReload(cfg)
+	if err != nil {
+		return err
+	}
+
+	apply()
+
+	return nil
+}
+
+// PrepareReload checks cfg and returns the switch to it, which cannot fail.
+func (a *Allocator) PrepareReload(cfg *config.WorkspaceConfig) (func(), error) {
+	_, pool, err := net.ParseCIDR(cfg.IPPool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip_pool %q: %v", cfg.IPPool, err)
+	}
+
+	if pool.IP.To4() == nil {
+		return nil, fmt.Errorf("ip_pool %q is not an IPv4 network", cfg.IPPool)
+	}
+
+	if cfg.VMIDRangeStart <= 0 || cfg.VMIDRangeEnd < cfg.VMIDRangeStart {
+		return nil, fmt.Errorf("invalid VMID range %d-%d", cfg.VMIDRangeStart, cfg.VMIDRangeEnd)
+	}
+
+	apply := func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		a.cfg = cfg
+		a.vmidStart = cfg.VMIDRangeStart
+		a.vmidEnd = cfg.VMIDRangeEnd
+		a.pool = pool
+		a.gateway = net.ParseIP(cfg.Gateway)
+	}
+
+	return apply, nil
+}
+
+func (a *Allocator) Get(slug string) (*domain.Workspace, bool) {
+	ws, err := a.store.GetWorkspace(slug)
+	if err != nil {
+		a.log.Error("Failed to read workspace %s: %v", slug, err)
+		return nil, false
+	}
+
+	return ws, ws != nil
+}
+
+// Allocate returns the user's workspace called name, assigning a free VMID and IP
+// the first time it is used. template picks the catalog entry it is cloned from.
+func (a *Allocator) Allocate(ctx context.Context, user *domain.User, name, template string) (*domain.Workspace, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	slug := domain.WorkspaceSlug(user, name)
+	if ws, ok := a.Get(slug); ok {
+		if ws.Owner != user.Key() {
+			return nil, fmt.Errorf("%w: %s is taken", ErrWorkspaceUnavailable, slug)
+		}
+		return ws, nil
+	}
+
+	template, _, ok := a.cfg.Template(template)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown template %q", ErrWorkspaceUnavailable, template)
+	}
+
+	usedVMIDs := map[int]bool{}
+	if lister, ok := a.backend.(vmidLister); ok {
+		used, err := lister.UsedVMIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		usedVMIDs = used
+	}
+
+	workspaces, err := a.store.ListWorkspaces()
+	if err != nil {
+		a.log.Error("Failed to list workspaces: %v", err)
+		return nil, err
+	}
+
+	usedIPs := map[string]bool{}
+	for _, ws := range workspaces {
+		usedVMIDs[ws.VMID] = true
+		usedIPs[ws.IP] = true
+	}
+
+	vmid, err := a.nextVMID(usedVMIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := a.nextIP(usedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := domain.NewWorkspace(user, name, template, vmid, ip)
+	if err := a.store.SaveWorkspace(ws); err != nil {
+		return nil, err
+	}
+
+	a.log.Info("Allocated VMID %d and IP %s to workspace %s of user %s", ws.VMID, ws.IP, ws.Slug, user.Key())
+	a.store.AddEvent(domain.NewEvent(domain.EventAllocate, ws.Owner, fmt.Sprintf("%s: vmid %d, ip %s", ws.Slug, ws.VMID, ws.IP)))
+
+	return ws, nil
+}
+
+func (a *Allocator) Release(slug string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ws, err := a.store.GetWorkspace(slug)
+	if err != nil || ws == nil {
+		return err
+	}
+
+	if err := a.store.DeleteWorkspace(slug); err != nil {
+		return err
+	}
+
+	a.log.Info("Released VMID %d and IP %s of workspace %s", ws.VMID, ws.IP, slug)
+	a.store.AddEvent(domain.NewEvent(domain.EventRelease, ws.Owner, fmt.Sprintf("%s: vmid %d, ip %s", slug, ws.VMID, ws.IP)))
+
+	return nil
+}
+
+func (a *Allocator) nextVMID(used map[int]bool) (int, error) {
+	for vmid := a.vmidStart; vmid <= a.vmidEnd; vmid++ {
+		if !used[vmid] {
+			return vmid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free VMID left in range %d-%d", a.vmidStart, a.vmidEnd)
+}
+
+// nextIP walks the pool skipping the network, broadcast and gateway addresses.
+func (a *Allocator) nextIP(used map[string]bool) (net.IP, error) {
+	network := binary.BigEndian.Uint32(a.pool.IP.To4())
+	ones, bits := a.pool.Mask.Size()
+	size := uint32(1) << uint32(bits-ones)
+
+	for offset := uint32(1); offset+1 < size; offset++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, network+offset)
+
+		if ip.Equal(a.gateway) || used[ip.String()] {
+			continue
+		}
+
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("no free IP left in pool %s", a.pool)
+}
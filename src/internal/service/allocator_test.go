@@ -0,0 +1,140 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTestAllocator returns the allocator of a test environment switched to the
+// VMID range start-end and the IP pool.
+func newTestAllocator(t *testing.T, env *testEnv, start, end int, pool, gateway string) *Allocator {
+	t.Helper()
+
+	cfg := *env.provisioner.Config()
+	cfg.VMIDRangeStart = start
+	cfg.VMIDRangeEnd = end
+	cfg.IPPool = pool
+	cfg.Gateway = gateway
+
+	allocator := env.provisioner.allocator
+	if err := allocator.Reload(&cfg); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	return allocator
+}
+
+func TestAllocatorSkipsExistingGuests(t *testing.T) {
+	env := newTestEnv(t)
+	allocator := newTestAllocator(t, env, 200, 209, "10.0.0.0/24", "10.0.0.1")
+
+	// A guest the launcher does not manage holds the first VMID of the range.
+	env.pve.AddTemplate(200)
+
+	ws, err := allocator.Allocate(t.Context(), domain.NewUser("alice"), domain.DefaultWorkspace, "")
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	if ws.VMID != 201 || ws.IP != "10.0.0.2" {
+		t.Errorf("allocated VMID %d and IP %s, want 201 and 10.0.0.2 past the guest and gateway", ws.VMID, ws.IP)
+	}
+
+	again, err := allocator.Allocate(t.Context(), domain.NewUser("alice"), domain.DefaultWorkspace, "")
+	if err != nil || again.VMID != ws.VMID || again.IP != ws.IP {
+		t.Errorf("second allocation = %+v, %v, want the same workspace", again, err)
+	}
+}
+
+func TestAllocatorRefusesTakenSlug(t *testing.T) {
+	env := newTestEnv(t)
+	allocator := newTestAllocator(t, env, 200, 209, "10.0.0.0/24", "10.0.0.1")
+
+	// A record left by another owner holds the slug.
+	taken := &domain.Workspace{Owner: "gitlab:alice", Slug: "alice", VMID: 209, IP: "10.0.0.9"}
+	if err := env.provisioner.store.SaveWorkspace(taken); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	if _, err := allocator.Allocate(t.Context(), domain.NewUser("alice"), domain.DefaultWorkspace, ""); !errors.Is(err, ErrWorkspaceUnavailable) {
+		t.Errorf("allocate of a taken slug = %v, want ErrWorkspaceUnavailable", err)
+	}
+}
+
+func TestAllocatorNamedWorkspaceSlugs(t *testing.T) {
+	env := newTestEnv(t)
+	allocator := newTestAllocator(t, env, 200, 209, "10.0.0.0/24", "10.0.0.1")
+
+	// Workspace "dev" of user "a" must not take the default workspace of user "dev-a".
+	dev, err := allocator.Allocate(t.Context(), domain.NewUser("a"), "dev", "")
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	other, err := allocator.Allocate(t.Context(), domain.NewUser("dev-a"), domain.DefaultWorkspace, "")
+	if err != nil {
+		t.Fatalf("allocate of the default workspace of dev-a: %v", err)
+	}
+
+	if dev.Slug == other.Slug {
+		t.Errorf("both workspaces got the slug %q", dev.Slug)
+	}
+}
+
+func TestAllocatorExhaustion(t *testing.T) {
+	env := newTestEnv(t)
+
+	allocator := newTestAllocator(t, env, 200, 201, "10.0.0.0/24", "10.0.0.1")
+	for _, login := range []string{"alice", "bob"} {
+		if _, err := allocator.Allocate(t.Context(), domain.NewUser(login), domain.DefaultWorkspace, ""); err != nil {
+			t.Fatalf("allocate for %s: %v", login, err)
+		}
+	}
+
+	_, err := allocator.Allocate(t.Context(), domain.NewUser("carol"), domain.DefaultWorkspace, "")
+	if err == nil || !strings.Contains(err.Error(), "no free VMID") {
+		t.Errorf("allocate past the VMID range = %v, want no free VMID", err)
+	}
+	if _, ok := allocator.Get("carol"); ok {
+		t.Error("failed allocation was stored")
+	}
+
+	// Only 10.0.0.2 is left in a /30 once network, broadcast and gateway are skipped.
+	allocator = newTestAllocator(t, env, 200, 299, "10.0.0.0/30", "10.0.0.1")
+
+	_, err = allocator.Allocate(t.Context(), domain.NewUser("carol"), domain.DefaultWorkspace, "")
+	if err == nil || !strings.Contains(err.Error(), "no free IP") {
+		t.Errorf("allocate past the IP pool = %v, want no free IP", err)
+	}
+}
+
+func TestAllocatorReusesReleased(t *testing.T) {
+	env := newTestEnv(t)
+	allocator := newTestAllocator(t, env, 200, 209, "10.0.0.0/24", "10.0.0.1")
+
+	alice, err := allocator.Allocate(t.Context(), domain.NewUser("alice"), domain.DefaultWorkspace, "")
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := allocator.Allocate(t.Context(), domain.NewUser("bob"), domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	if err := allocator.Release(alice.Slug); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, ok := allocator.Get(alice.Slug); ok {
+		t.Fatal("released workspace is still stored")
+	}
+
+	carol, err := allocator.Allocate(t.Context(), domain.NewUser("carol"), domain.DefaultWorkspace, "")
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	if carol.VMID != alice.VMID || carol.IP != alice.IP {
+		t.Errorf("allocated VMID %d and IP %s, want the released %d and %s", carol.VMID, carol.IP, alice.VMID, alice.IP)
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnexpectedState is returned for a container the launcher cannot bring up,
+// such as a template occupying the workspace VMID.
+var ErrUnexpectedState = errors.New("workspace container in unexpected state")
+
+const (
+	settleTimeout  = 2 * time.Minute
+	settleInterval = 2 * time.Second
+)
+
+// Reporter follows a workspace while a backend brings it up.
+type Reporter interface {
+	// Phase is called when the backend enters a provisioning phase.
+	Phase(phase domain.JobPhase)
+	// Task is called as a Proxmox task the backend waits on progresses.
+	Task(task domain.Task)
+}
+
+// WorkspaceBackend runs the containers behind workspaces. Info returns nil without
+// an error when the container does not exist. Calls give up when ctx is done.
+type WorkspaceBackend interface {
+	// Ensure creates the container if needed, set up for its owner with boot, and
+	// brings it up, reporting the phases and tasks it goes through.
+	Ensure(ctx context.Context, ws *domain.Workspace, boot *domain.Bootstrap, report Reporter) error
+	Start(ctx context.Context, ws *domain.Workspace) error
+	Stop(ctx context.Context, ws *domain.Workspace) error
+	// Restart reboots a running container.
+	Restart(ctx context.Context, ws *domain.Workspace) error
+	Hibernate(ctx context.Context, ws *domain.Workspace) error
+	Delete(ctx context.Context, ws *domain.Workspace) error
+	Info(ctx context.Context, ws *domain.Workspace) (*domain.VmInfo, error)
+	// Endpoint is the address the workspace serves code-server on port at.
+	Endpoint(ws *domain.Workspace, port int) string
+}
+
+// recordStatus keeps the stored workspace status in sync and audits the change.
+func recordStatus(log *logger.Logger, st *store.Store, ws *domain.Workspace, status domain.VmStatus) {
+	ws.Status = status
+
+	err := st.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		stored.Status = status
+	})
+	if err != nil {
+		log.Warn("Failed to record status of workspace %d: %v", ws.VMID, err)
+	}
+
+	st.AddEvent(domain.NewEvent(domain.EventContainerStatus, ws.Owner, fmt.Sprintf("container %d is %s", ws.VMID, status)))
+}
+
+// recordDesired keeps what the owner asked of the workspace, for the reconciler.
+func recordDesired(log *logger.Logger, st *store.Store, ws *domain.Workspace, desired domain.DesiredState) {
+	ws.Desired = desired
+
+	err := st.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		stored.Desired = desired
+	})
+	if err != nil {
+		log.Warn("Failed to record desired state of workspace %s: %v", ws.Slug, err)
+	}
+}
+
+// settledStatus returns the container status once it is out of transient states
+// such as a lock or a migration, which are waited out rather than acted upon.
+func settledStatus(ctx context.Context, log *logger.Logger, backend WorkspaceBackend, ws *domain.Workspace) (domain.VmStatus, error) {
+	deadline := time.Now().Add(settleTimeout)
+
+	for {
+		status := domain.VmStatusMissing
+
+		info, err := backend.Info(ctx, ws)
+		if err != nil {
+			return domain.VmStatusUnknown, err
+		}
+		if info != nil {
+			status = info.Status
+		}
+
+		if !status.Transient() {
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			return status, fmt.Errorf("container %d still %s after %s", ws.VMID, status, settleTimeout)
+		}
+
+		log.Info("Container %d of workspace %s is %s, waiting for it to settle", ws.VMID, ws.Slug, status)
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(settleInterval):
+		}
+	}
+}
+
+var (
+	_ WorkspaceBackend = (*ProxmoxService)(nil)
+	_ WorkspaceBackend = (*DockerService)(nil)
+)
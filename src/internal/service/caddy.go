@@ -5,47 +5,267 @@ import (
 	"code-server-launcher/internal/config"
 	"code-server-launcher/internal/domain"
 	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Caddy struct {
-	config.CaddyConfig
-	log *logger.Logger
+	log     *logger.Logger
+	cfg     atomic.Pointer[config.CaddyConfig]
+	backend WorkspaceBackend
+	store   *store.Store
 }
 
-type ReverseProxyHandler struct {
-	Handler   string `json:"handler"`
-	Upstreams []struct {
-		Dial string `json:"dial"`
-	} `json:"upstreams"`
+const authRemoteUserHeader = "X-Remote-User"
+
+// routeIDPrefix marks the routes the launcher manages: their @id is the prefix
+// followed by the workspace slug.
+const routeIDPrefix = "csl-"
+
+var ErrRouteNotFound = errors.New("route not found")
+
+type Upstream struct {
+	Dial string `json:"dial"`
+}
+
+type HeaderOps struct {
+	Set map[string][]string `json:"set,omitempty"`
+}
+
+type Headers struct {
+	Request *HeaderOps `json:"request,omitempty"`
+}
+
+type Rewrite struct {
+	Method string `json:"method,omitempty"`
+	URI    string `json:"uri,omitempty"`
+}
+
+type ResponseMatch struct {
+	StatusCode []int `json:"status_code,omitempty"`
+}
+
+type ResponseHandler struct {
+	Match  *ResponseMatch `json:"match,omitempty"`
+	Routes []Route        `json:"routes"`
+}
+
+type RouteHandler struct {
+	Handler        string            `json:"handler"`
+	Upstreams      []Upstream        `json:"upstreams,omitempty"`
+	Rewrite        *Rewrite          `json:"rewrite,omitempty"`
+	Headers        *Headers          `json:"headers,omitempty"`
+	Request        *HeaderOps        `json:"request,omitempty"`
+	HandleResponse []ResponseHandler `json:"handle_response,omitempty"`
+}
+
+type RouteMatch struct {
+	Host []string `json:"host"`
 }
 
 // Estrutura de rota HTTP
 type Route struct {
-	Match []struct {
-		Host []string `json:"host"`
-	} `json:"match"`
-	Handle   []ReverseProxyHandler `json:"handle"`
-	Terminal bool                  `json:"terminal"`
+	ID       string         `json:"@id,omitempty"`
+	Match    []RouteMatch   `json:"match,omitempty"`
+	Handle   []RouteHandler `json:"handle"`
+	Terminal bool           `json:"terminal,omitempty"`
+}
+
+// HasHost reports whether any matcher of the route matches host.
+func (r *Route) HasHost(host string) bool {
+	for _, match := range r.Match {
+		if slices.Contains(match.Host, host) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func NewCaddyService(cfg *config.CaddyConfig) *Caddy {
-	return &Caddy{
-		log:         logger.NewLogger("CaddyService"),
-		CaddyConfig: *cfg,
+// RouteID is the @id of the route of workspace slug.
+func RouteID(slug string) string {
+	return routeIDPrefix + slug
+}
+
+// SlugFromRouteID returns the workspace slug of a route the launcher manages.
+func SlugFromRouteID(id string) (string, bool) {
+	slug, ok := strings.CutPrefix(id, routeIDPrefix)
+	return slug, ok && slug != ""
+}
+
+func NewCaddyService(cfg *config.CaddyConfig, backend WorkspaceBackend, st *store.Store) *Caddy {
+	ret := &Caddy{
+		log:     logger.NewLogger("CaddyService"),
+		backend: backend,
+		store:   st,
 	}
+
+	ret.cfg.Store(cfg)
+
+	return ret
+}
+
+func (c *Caddy) Config() *config.CaddyConfig {
+	return c.cfg.Load()
+}
+
+// Reload swaps in new settings. Routes already published keep their upstream until
+// they are inserted again.
+func (c *Caddy) Reload(cfg *config.CaddyConfig) {
+	c.cfg.Store(cfg)
+	c.log.Info("Caddy configuration reloaded")
 }
 
 func isValidIP(ip string) bool {
 	return net.ParseIP(ip) != nil
 }
 
-func (c *Caddy) GetRoutes() ([]Route, error) {
-	caddyUrl := fmt.Sprintf("http://%s:%d/config/apps/http/servers/srv0/routes", c.Host, c.Port)
-	resp, err := http.Get(caddyUrl)
+func (c *Caddy) Subdomain(ws *domain.Workspace) string {
+	return fmt.Sprintf("%s.%s", ws.Slug, c.Config().BaseURL)
+}
+
+func (c *Caddy) Upstream(ws *domain.Workspace) string {
+	return c.backend.Endpoint(ws, c.Config().UpstreamPort)
+}
+
+// SlugFromHost returns the owner slug of a workspace hostname such as <slug>.<BaseURL>.
+func (c *Caddy) SlugFromHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	slug, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(c.Config().BaseURL))
+	if !ok || slug == "" || strings.Contains(slug, ".") {
+		return "", false
+	}
+
+	return slug, true
+}
+
+func (c *Caddy) IsWorkspaceURL(raw string) bool {
+	target, err := url.Parse(raw)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") {
+		return false
+	}
+
+	_, ok := c.SlugFromHost(target.Host)
+	return ok
+}
+
+// forwardAuthHandler mirrors Caddy's forward_auth directive: every request is first
+// sent to the launcher /auth/verify endpoint and only proxied on a 2xx answer.
+func (c *Caddy) forwardAuthHandler() RouteHandler {
+	return RouteHandler{
+		Handler:   "reverse_proxy",
+		Upstreams: []Upstream{{Dial: c.Config().AuthUpstream}},
+		Rewrite: &Rewrite{
+			Method: "GET",
+			URI:    "/auth/verify",
+		},
+		Headers: &Headers{
+			Request: &HeaderOps{
+				Set: map[string][]string{
+					"X-Forwarded-Method": {"{http.request.method}"},
+					"X-Forwarded-Uri":    {"{http.request.uri}"},
+				},
+			},
+		},
+		HandleResponse: []ResponseHandler{
+			{
+				Match: &ResponseMatch{StatusCode: []int{2}},
+				Routes: []Route{
+					{
+						Handle: []RouteHandler{
+							{
+								Handler: "headers",
+								Request: &HeaderOps{
+									Set: map[string][]string{
+										authRemoteUserHeader: {"{http.reverse_proxy.header." + authRemoteUserHeader + "}"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (c *Caddy) adminURL(path string) string {
+	cfg := c.Config()
+	return fmt.Sprintf("http://%s:%d%s", cfg.Host, cfg.Port, path)
+}
+
+func (c *Caddy) routesURL() string {
+	return c.adminURL("/config/apps/http/servers/" + url.PathEscape(c.Config().ServerName) + "/routes")
+}
+
+// idURL addresses the object tagged @id wherever it sits in the Caddy config.
+func (c *Caddy) idURL(id string) string {
+	return c.adminURL("/id/" + url.PathEscape(id))
+}
+
+// withTimeout bounds one operation on the admin API by caddy.request_timeout.
+func (c *Caddy) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(c.Config().RequestTimeout)*time.Second)
+}
+
+// send makes one call to the admin API, with body as JSON when not nil, and
+// returns the status code of the answer.
+func (c *Caddy) send(ctx context.Context, method, target string, body any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.log.Error("Failed to marshal JSON: %v", err)
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		c.log.Error("Failed to create request: %v", err)
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.log.Error("Failed to send request to Caddy: %v", err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+func (c *Caddy) GetRoutes(ctx context.Context) ([]Route, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.routesURL(), nil)
+	if err != nil {
+		c.log.Error("Failed to create request: %v", err)
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		c.log.Error("Failed to send request to Caddy: %v", err)
 		return nil, err
@@ -66,94 +286,183 @@ func (c *Caddy) GetRoutes() ([]Route, error) {
 	return routes, nil
 }
 
-func (c *Caddy) ExistsRoute(user *domain.User) (bool, error) {
-	routes, err := c.GetRoutes()
+// DeleteRoute deletes the route tagged id from Caddy, and fails with
+// ErrRouteNotFound when there is none.
+func (c *Caddy) DeleteRoute(ctx context.Context, id string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	status, err := c.send(ctx, http.MethodDelete, c.idURL(id), nil)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusOK:
+		c.log.Info("Route %s removed from Caddy", id)
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("route %s: %w", id, ErrRouteNotFound)
+	default:
+		c.log.Error("Failed to remove route %s from Caddy: %d", id, status)
+		return fmt.Errorf("failed to remove route %s from Caddy: %s", id, http.StatusText(status))
+	}
+}
+
+// Remove deletes the route of workspace slug from Caddy and from the store. A
+// route published before routes carried an @id is found by its host instead.
+func (c *Caddy) Remove(ctx context.Context, slug, host string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err := c.DeleteRoute(ctx, RouteID(slug))
+	if errors.Is(err, ErrRouteNotFound) {
+		err = c.removeUntagged(ctx, host)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.store.DeleteRoute(slug); err != nil {
+		c.log.Warn("Failed to delete route record %s: %v", slug, err)
+	}
+	c.store.AddEvent(domain.NewEvent(domain.EventRouteRemove, slug, host))
+
+	return nil
+}
+
+func (c *Caddy) removeUntagged(ctx context.Context, host string) error {
+	idx, err := c.untaggedIndex(ctx, host)
+	if err != nil || idx < 0 {
+		return err
+	}
+
+	status, err := c.send(ctx, http.MethodDelete, fmt.Sprintf("%s/%d", c.routesURL(), idx), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		c.log.Error("Failed to remove route %s from Caddy: %d", host, status)
+		return fmt.Errorf("failed to remove route %s from Caddy: %s", host, http.StatusText(status))
+	}
+
+	c.log.Info("Route %s removed from Caddy", host)
+	return nil
+}
+
+// ExistsRoute reports whether the route of ws, tagged with its @id, is in Caddy.
+func (c *Caddy) ExistsRoute(ctx context.Context, ws *domain.Workspace) (bool, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	status, err := c.send(ctx, http.MethodGet, c.idURL(RouteID(ws.Slug)), nil)
 	if err != nil {
 		return false, err
 	}
 
-	subdomain := fmt.Sprintf("%s.%s", user.Login, c.BaseURL)
-	for _, route := range routes {
-		if len(route.Match) > 0 && len(route.Match[0].Host) > 0 && route.Match[0].Host[0] == subdomain {
-			c.log.Debug("Route already exists for user %s", user.Login)
-			return true, nil
+	switch status {
+	case http.StatusOK:
+		c.log.Debug("Route already exists for workspace %s", ws.Slug)
+		return true, nil
+	case http.StatusNotFound:
+		c.log.Debug("Route does not exist for workspace %s", ws.Slug)
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to look up route of workspace %s in Caddy: %s", ws.Slug, http.StatusText(status))
+	}
+}
+
+// untaggedIndex returns the position of a route without @id matching host, as
+// published by earlier versions, or -1.
+func (c *Caddy) untaggedIndex(ctx context.Context, host string) (int, error) {
+	routes, err := c.GetRoutes(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	for idx, route := range routes {
+		if route.ID == "" && route.HasHost(host) {
+			return idx, nil
 		}
 	}
 
-	c.log.Debug("Route does not exist for user %s", user.Login)
-	return false, nil
+	return -1, nil
 }
 
-func (c *Caddy) Insert(user *domain.User, internalIp string, internalPort int) error {
-	subdomain := fmt.Sprintf("%s.%s", user.Login, c.BaseURL)
-	internalIP := fmt.Sprintf("%s.%d", c.BaseInternalIP, user.ID)
+// Insert publishes the route of ws, replacing the one it already has. An untagged
+// route for the same host is replaced in place, which gives it its @id.
+func (c *Caddy) Insert(ctx context.Context, ws *domain.Workspace) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	subdomain := c.Subdomain(ws)
+	upstream := c.Upstream(ws)
+
+	internalIP, _, err := net.SplitHostPort(upstream)
+	if err != nil || !isValidIP(internalIP) {
+		c.log.Error("Invalid internal upstream: %s", upstream)
+		return fmt.Errorf("invalid internal upstream: %s", upstream)
+	}
 
-	if !isValidIP(internalIP) {
-		c.log.Error("Invalid internal IP: %s", internalIP)
-		return fmt.Errorf("invalid internal IP: %s", internalIP)
+	if c.Config().AuthUpstream == "" {
+		c.log.Error("No auth upstream configured, refusing to publish an unprotected route for workspace %s", ws.Slug)
+		return fmt.Errorf("caddy auth_upstream is not configured")
 	}
 
 	route := Route{
-		Match: []struct {
-			Host []string `json:"host"`
-		}{
+		ID: RouteID(ws.Slug),
+		Match: []RouteMatch{
 			{Host: []string{subdomain}},
 		},
-		Handle: []ReverseProxyHandler{
+		Handle: []RouteHandler{
+			c.forwardAuthHandler(),
 			{
-				Handler: "reverse_proxy",
-				Upstreams: []struct {
-					Dial string `json:"dial"`
-				}{
-					{Dial: fmt.Sprintf("%s:%d", internalIP, internalPort)},
-				},
+				Handler:   "reverse_proxy",
+				Upstreams: []Upstream{{Dial: upstream}},
 			},
 		},
 		Terminal: true,
 	}
 
-	jsonData, err := json.Marshal(route)
-	if err != nil {
-		c.log.Error("Failed to marshal JSON: %v", err)
-		return err
-	}
-
-	caddyUrl := fmt.Sprintf("http://%s:%d/config/apps/http/servers/srv0/routes", c.Host, c.Port)
-
-	var routeExists bool
-	routeExists, err = c.ExistsRoute(user)
+	exists, err := c.ExistsRoute(ctx, ws)
 	if err != nil {
 		c.log.Error("Failed to check if route exists: %v", err)
 		return err
 	}
 
-	var resp *http.Response
-	method := "POST"
+	// POST appends to the routes array, PATCH replaces the object it addresses.
+	method, target := http.MethodPost, c.routesURL()
 
-	if routeExists {
-		method = "PUT"
-	}
+	if exists {
+		method, target = http.MethodPatch, c.idURL(route.ID)
+	} else {
+		idx, err := c.untaggedIndex(ctx, subdomain)
+		if err != nil {
+			c.log.Error("Failed to check if route exists: %v", err)
+			return err
+		}
 
-	req, err := http.NewRequest(method, caddyUrl, bytes.NewBuffer(jsonData))
+		if idx >= 0 {
+			method, target = http.MethodPatch, fmt.Sprintf("%s/%d", c.routesURL(), idx)
+		}
+	}
 
+	status, err := c.send(ctx, method, target, route)
 	if err != nil {
-		c.log.Error("Failed to create request: %v", err)
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err = http.DefaultClient.Do(req)
 
-	if err != nil {
-		c.log.Error("Failed to send request to Caddy: %v", err)
-		return err
+	if status != http.StatusOK {
+		c.log.Error("Failed to add route to Caddy: %d", status)
+		return fmt.Errorf("failed to add route to Caddy: %s", http.StatusText(status))
 	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		c.log.Error("Failed to add route to Caddy: %s", resp.Status)
-		return fmt.Errorf("failed to add route to Caddy: %s", resp.Status)
+	c.log.Debug("Route %s published with %s", route.ID, method)
+
+	if err := c.store.SaveRoute(domain.NewRouteRecord(ws.Slug, subdomain, upstream)); err != nil {
+		c.log.Warn("Failed to record route of workspace %s: %v", ws.Slug, err)
 	}
+	c.store.AddEvent(domain.NewEvent(domain.EventRouteInsert, ws.Owner, subdomain+" -> "+upstream))
 
-	c.log.Debug("Caddy response status: %s", resp.Status)
 	return nil
 }
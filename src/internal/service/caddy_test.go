@@ -0,0 +1,46 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"errors"
+	"testing"
+)
+
+func TestInsertReplacesRouteByID(t *testing.T) {
+	env := newTestEnv(t)
+	caddy := env.provisioner.caddy
+	ws := &domain.Workspace{Owner: env.user.Key(), Slug: env.user.Slug(), VMID: 200, IP: "127.0.0.1"}
+	host := caddy.Subdomain(ws)
+
+	// A route published before routes carried an @id, in front of a foreign one.
+	env.caddy.AddRoute("srv0", Route{Match: []RouteMatch{{Host: []string{host}}}, Handle: []RouteHandler{{Handler: "reverse_proxy"}}})
+	env.caddy.AddRoute("srv0", Route{Match: []RouteMatch{{Host: []string{"wiki.example.com"}}}, Handle: []RouteHandler{{Handler: "reverse_proxy"}}})
+
+	for range 2 {
+		if err := caddy.Insert(t.Context(), ws); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	var routes []Route
+	if err := env.caddy.Routes("srv0", &routes); err != nil {
+		t.Fatalf("routes: %v", err)
+	}
+	if len(routes) != 2 || routes[0].ID != RouteID(ws.Slug) || !routes[0].HasHost(host) || !routes[1].HasHost("wiki.example.com") {
+		t.Fatalf("routes = %+v, want the workspace route tagged in place and the foreign one kept", routes)
+	}
+
+	if exists, err := caddy.ExistsRoute(t.Context(), ws); err != nil || !exists {
+		t.Fatalf("exists = %v, %v, want true", exists, err)
+	}
+
+	if err := caddy.DeleteRoute(t.Context(), RouteID(ws.Slug)); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := caddy.DeleteRoute(t.Context(), RouteID(ws.Slug)); !errors.Is(err, ErrRouteNotFound) {
+		t.Errorf("second delete = %v, want ErrRouteNotFound", err)
+	}
+	if exists, _ := caddy.ExistsRoute(t.Context(), ws); exists {
+		t.Error("route still exists after delete")
+	}
+}
@@ -0,0 +1,522 @@
+package service
+
+import (
+	"bytes"
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Oldest Engine API version providing everything used here (Docker 20.10).
+const dockerAPIVersion = "v1.41"
+
+// DockerService runs workspaces as containers of the local Docker Engine, using
+// its HTTP API on the unix socket.
+type DockerService struct {
+	log          *logger.Logger
+	cfg          *config.DockerConfig
+	workspace    atomic.Pointer[config.WorkspaceConfig]
+	client       *http.Client
+	store        *store.Store
+	networkReady bool
+	mu           sync.Mutex
+}
+
+type dockerError struct {
+	Message string `json:"message"`
+}
+
+// dockerStream consumes a response streamed as a sequence of JSON messages.
+type dockerStream interface {
+	consume(r io.Reader) error
+}
+
+// dockerProgress is a message of the progress streamed by an image pull. A pull
+// failing midway has already answered 200 and reports the error in the stream.
+type dockerProgress struct {
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+type pullStream struct{}
+
+// consume reads the pull progress to the end, which the pull needs to finish, and
+// returns the first error reported in it.
+func (pullStream) consume(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg dockerProgress
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+type dockerContainer struct {
+	Name  string `json:"Name"`
+	State struct {
+		Status    string    `json:"Status"`
+		StartedAt time.Time `json:"StartedAt"`
+	} `json:"State"`
+	HostConfig struct {
+		Memory   int64 `json:"Memory"`
+		NanoCpus int64 `json:"NanoCpus"`
+	} `json:"HostConfig"`
+}
+
+type dockerStats struct {
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+	} `json:"memory_stats"`
+}
+
+func NewDockerService(cfg *config.DockerConfig, workspace *config.WorkspaceConfig, st *store.Store) *DockerService {
+	socket := cfg.Socket
+
+	ret := &DockerService{
+		log:   logger.NewLogger("DockerService"),
+		cfg:   cfg,
+		store: st,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+
+	ret.workspace.Store(workspace)
+
+	return ret
+}
+
+// Reload only updates the catalog used to pick images; socket and network changes
+// need a restart.
+func (d *DockerService) Reload(workspace *config.WorkspaceConfig) {
+	d.workspace.Store(workspace)
+}
+
+// Ensure pulls the image and creates the container when it is missing and starts
+// or unpauses it otherwise. boot is passed to new containers in their environment.
+func (d *DockerService) Ensure(ctx context.Context, ws *domain.Workspace, boot *domain.Bootstrap, report Reporter) error {
+	status, err := settledStatus(ctx, d.log, d, ws)
+	if err != nil {
+		return err
+	}
+
+	switch domain.UpAction(status) {
+	case domain.LifecycleNone:
+		if ws.Status != domain.VmStatusRunning {
+			recordStatus(d.log, d.store, ws, domain.VmStatusRunning)
+		}
+		return nil
+	case domain.LifecycleResume:
+		report.Phase(domain.JobPhaseStarting)
+		return d.unpause(ctx, ws)
+	case domain.LifecycleStart:
+		report.Phase(domain.JobPhaseStarting)
+		return d.Start(ctx, ws)
+	case domain.LifecycleCreate:
+	default:
+		return fmt.Errorf("%w: container %s is %s", ErrUnexpectedState, containerName(ws), status)
+	}
+
+	image, err := d.image(ws)
+	if err != nil {
+		return err
+	}
+
+	report.Phase(domain.JobPhaseCloning)
+	if err := d.ensureNetwork(ctx); err != nil {
+		return err
+	}
+
+	if err := d.pull(ctx, image); err != nil {
+		return err
+	}
+
+	report.Phase(domain.JobPhaseConfiguring)
+	if err := d.create(ctx, ws, boot, image); err != nil {
+		return err
+	}
+
+	report.Phase(domain.JobPhaseStarting)
+	return d.Start(ctx, ws)
+}
+
+func (d *DockerService) Start(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Starting container for workspace: %s", ws.Slug)
+
+	// 304 means it was already running.
+	_, err := d.do(ctx, http.MethodPost, "/containers/"+containerName(ws)+"/start", nil, nil, nil)
+	if err != nil {
+		d.log.Error("Failed to start container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	recordStatus(d.log, d.store, ws, domain.VmStatusRunning)
+
+	return nil
+}
+
+func (d *DockerService) Stop(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Stopping container for workspace: %s", ws.Slug)
+
+	query := url.Values{"t": {"30"}}
+	_, err := d.do(ctx, http.MethodPost, "/containers/"+containerName(ws)+"/stop", query, nil, nil)
+	if err != nil {
+		d.log.Error("Failed to stop container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	recordStatus(d.log, d.store, ws, domain.VmStatusStopped)
+
+	return nil
+}
+
+func (d *DockerService) Restart(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Restarting container for workspace: %s", ws.Slug)
+
+	query := url.Values{"t": {"30"}}
+	_, err := d.do(ctx, http.MethodPost, "/containers/"+containerName(ws)+"/restart", query, nil, nil)
+	if err != nil {
+		d.log.Error("Failed to restart container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	recordStatus(d.log, d.store, ws, domain.VmStatusRunning)
+
+	return nil
+}
+
+// Hibernate freezes the container processes; memory stays allocated, unlike the
+// Proxmox suspend to disk.
+func (d *DockerService) Hibernate(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Pausing container for workspace: %s", ws.Slug)
+
+	_, err := d.do(ctx, http.MethodPost, "/containers/"+containerName(ws)+"/pause", nil, nil, nil)
+	if err != nil {
+		d.log.Error("Failed to pause container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	recordStatus(d.log, d.store, ws, domain.VmStatusPaused)
+
+	return nil
+}
+
+func (d *DockerService) unpause(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Unpausing container for workspace: %s", ws.Slug)
+
+	_, err := d.do(ctx, http.MethodPost, "/containers/"+containerName(ws)+"/unpause", nil, nil, nil)
+	if err != nil {
+		d.log.Error("Failed to unpause container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	recordStatus(d.log, d.store, ws, domain.VmStatusRunning)
+
+	return nil
+}
+
+// Delete removes the container along with its anonymous volumes.
+func (d *DockerService) Delete(ctx context.Context, ws *domain.Workspace) error {
+	d.log.Info("Deleting container for workspace: %s", ws.Slug)
+
+	query := url.Values{"force": {"true"}, "v": {"true"}}
+	status, err := d.do(ctx, http.MethodDelete, "/containers/"+containerName(ws), query, nil, nil)
+	if status == http.StatusNotFound {
+		d.log.Info("Container %s already gone", containerName(ws))
+		return nil
+	}
+
+	if err != nil {
+		d.log.Error("Failed to delete container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	d.store.AddEvent(domain.NewEvent(domain.EventContainerStatus, ws.Owner, fmt.Sprintf("container %s deleted", containerName(ws))))
+
+	return nil
+}
+
+func (d *DockerService) Info(ctx context.Context, ws *domain.Workspace) (*domain.VmInfo, error) {
+	container := &dockerContainer{}
+
+	status, err := d.do(ctx, http.MethodGet, "/containers/"+containerName(ws)+"/json", nil, nil, container)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		d.log.Error("Failed to inspect container %s: %v", containerName(ws), err)
+		return nil, err
+	}
+
+	ret := &domain.VmInfo{
+		VMID:   ws.VMID,
+		Type:   domain.VmTypeDocker,
+		Status: dockerStatus(container.State.Status),
+		Name:   strings.TrimPrefix(container.Name, "/"),
+		CPUs:   int(container.HostConfig.NanoCpus / 1e9),
+		MaxMem: uint64(container.HostConfig.Memory),
+	}
+
+	if ret.Status != domain.VmStatusRunning {
+		return ret, nil
+	}
+
+	ret.Uptime = int64(time.Since(container.State.StartedAt).Seconds())
+
+	stats := &dockerStats{}
+	query := url.Values{"stream": {"false"}}
+	if _, err := d.do(ctx, http.MethodGet, "/containers/"+containerName(ws)+"/stats", query, nil, stats); err != nil {
+		d.log.Warn("Failed to read stats of container %s: %v", containerName(ws), err)
+	}
+	ret.Mem = stats.MemoryStats.Usage
+
+	return ret, nil
+}
+
+func (d *DockerService) Endpoint(ws *domain.Workspace, port int) string {
+	return net.JoinHostPort(ws.IP, strconv.Itoa(port))
+}
+
+// image resolves the workspace template to an image, docker.image by default.
+func (d *DockerService) image(ws *domain.Workspace) (string, error) {
+	_, template, ok := d.workspace.Load().Template(ws.Template)
+	if ok && template.Image != "" {
+		return template.Image, nil
+	}
+
+	if d.cfg.Image == "" {
+		return "", fmt.Errorf("no image configured for template %q", ws.Template)
+	}
+
+	return d.cfg.Image, nil
+}
+
+// ensureNetwork creates the workspace network from the IP pool unless it already
+// exists. Once it is known to exist it is not checked again.
+func (d *DockerService) ensureNetwork(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.networkReady {
+		return nil
+	}
+
+	status, err := d.do(ctx, http.MethodGet, "/networks/"+d.cfg.Network, nil, nil, nil)
+	if status == http.StatusNotFound {
+		pool := d.workspace.Load()
+		d.log.Info("Creating network %s for %s", d.cfg.Network, pool.IPPool)
+
+		body := map[string]any{
+			"Name":   d.cfg.Network,
+			"Driver": "bridge",
+			"IPAM": map[string]any{
+				"Config": []map[string]string{{
+					"Subnet":  pool.IPPool,
+					"Gateway": pool.Gateway,
+				}},
+			},
+			"Labels": map[string]string{"csl.managed": "true"},
+		}
+
+		_, err = d.do(ctx, http.MethodPost, "/networks/create", nil, body, nil)
+	}
+
+	if err != nil {
+		d.log.Error("Failed to set up network %s: %v", d.cfg.Network, err)
+		return err
+	}
+
+	d.networkReady = true
+
+	return nil
+}
+
+func (d *DockerService) pull(ctx context.Context, image string) error {
+	d.log.Info("Pulling image %s", image)
+
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+
+	query := url.Values{"fromImage": {name}, "tag": {tag}}
+	if _, err := d.do(ctx, http.MethodPost, "/images/create", query, nil, pullStream{}); err != nil {
+		d.log.Error("Failed to pull image %s: %v", image, err)
+		return err
+	}
+
+	return nil
+}
+
+// create sets up the container with the workspace resources and its allocated
+// address on the workspace network.
+func (d *DockerService) create(ctx context.Context, ws *domain.Workspace, boot *domain.Bootstrap, image string) error {
+	d.log.Info("Creating container %s from %s", containerName(ws), image)
+
+	body := map[string]any{
+		"Image":    image,
+		"Hostname": ws.Hostname(),
+		"Env":      bootstrapEnv(boot),
+		"Labels": map[string]string{
+			"csl.managed": "true",
+			"csl.slug":    ws.Slug,
+			"csl.owner":   ws.Owner,
+		},
+		"HostConfig": map[string]any{
+			"Memory":        int64(ws.Resources.Memory) * 1024 * 1024,
+			"NanoCpus":      int64(ws.Resources.Cores) * 1e9,
+			"RestartPolicy": map[string]string{"Name": "unless-stopped"},
+		},
+		"NetworkingConfig": map[string]any{
+			"EndpointsConfig": map[string]any{
+				d.cfg.Network: map[string]any{
+					"IPAMConfig": map[string]string{"IPv4Address": ws.IP},
+				},
+			},
+		},
+	}
+
+	query := url.Values{"name": {containerName(ws)}}
+	if _, err := d.do(ctx, http.MethodPost, "/containers/create", query, body, nil); err != nil {
+		d.log.Error("Failed to create container %s: %v", containerName(ws), err)
+		return err
+	}
+
+	d.store.AddEvent(domain.NewEvent(domain.EventContainerStatus, ws.Owner, fmt.Sprintf("container %s created from %s", containerName(ws), image)))
+
+	return nil
+}
+
+// do calls the Engine API, decoding the response into out when given. Errors carry
+// the message Docker returned; the status is returned as well so callers can
+// tell a missing object apart.
+func (d *DockerService) do(ctx context.Context, method, path string, query url.Values, body, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	target := "http://docker/" + dockerAPIVersion + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg := &dockerError{}
+		json.NewDecoder(resp.Body).Decode(msg)
+		return resp.StatusCode, fmt.Errorf("docker %s %s: %s (%d)", method, path, msg.Message, resp.StatusCode)
+	}
+
+	if stream, ok := out.(dockerStream); ok {
+		if err := stream.consume(resp.Body); err != nil {
+			return resp.StatusCode, fmt.Errorf("docker %s %s: %v", method, path, err)
+		}
+		return resp.StatusCode, nil
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, err
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// bootstrapEnv passes boot the way code-server images take it: PASSWORD for
+// code-server and PUBLIC_KEY for images running sshd. Git reads the identity from
+// its GIT_* variables, and CSL_* carry everything for custom entrypoints.
+func bootstrapEnv(boot *domain.Bootstrap) []string {
+	keys := strings.Join(boot.SSHKeys, "\n")
+
+	ret := []string{
+		"CSL_OWNER=" + boot.Owner,
+		"CSL_AUTH=" + boot.Auth,
+		"CSL_SSH_KEYS=" + keys,
+		"PUBLIC_KEY=" + keys,
+		"GIT_AUTHOR_NAME=" + boot.GitName,
+		"GIT_COMMITTER_NAME=" + boot.GitName,
+	}
+
+	if boot.GitEmail != "" {
+		ret = append(ret, "GIT_AUTHOR_EMAIL="+boot.GitEmail, "GIT_COMMITTER_EMAIL="+boot.GitEmail)
+	}
+
+	if boot.Password != "" {
+		ret = append(ret, "PASSWORD="+boot.Password)
+	}
+
+	return ret
+}
+
+func containerName(ws *domain.Workspace) string {
+	return "csl-" + ws.Slug
+}
+
+func dockerStatus(state string) domain.VmStatus {
+	switch state {
+	case "running":
+		return domain.VmStatusRunning
+	case "paused":
+		return domain.VmStatusPaused
+	case "created", "exited", "dead":
+		return domain.VmStatusStopped
+	case "restarting":
+		return domain.VmStatusStarting
+	case "removing":
+		return domain.VmStatusStopping
+	default:
+		return domain.VmStatusUnknown
+	}
+}
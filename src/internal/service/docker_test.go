@@ -0,0 +1,75 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestDocker serves handler on a Docker socket in a temporary directory.
+func newTestDocker(t *testing.T, handler http.HandlerFunc) *DockerService {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go http.Serve(ln, handler)
+
+	return NewDockerService(&config.DockerConfig{Socket: socket, Network: "launcher"}, &config.WorkspaceConfig{}, nil)
+}
+
+func TestPullReportsStreamedError(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		err    string
+	}{
+		{
+			name:   "pulled",
+			stream: `{"status":"Pulling from codercom/code-server"}{"status":"Download complete"}`,
+		},
+		{
+			name:   "error detail",
+			stream: `{"status":"Pulling from codercom/code-server"}{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown: tag 9"}{"error":"later"}`,
+			err:    "manifest unknown",
+		},
+		{
+			name:   "error only",
+			stream: `{"status":"Downloading"}` + "\n" + `{"error":"no space left on device"}`,
+			err:    "no space left on device",
+		},
+		{
+			name:   "truncated",
+			stream: `{"status":"Downl`,
+			err:    "unexpected EOF",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pulled string
+			docker := newTestDocker(t, func(w http.ResponseWriter, r *http.Request) {
+				pulled = r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+				fmt.Fprint(w, test.stream)
+			})
+
+			err := docker.pull(t.Context(), "codercom/code-server:4")
+			if pulled != "codercom/code-server:4" {
+				t.Errorf("pulled %q, want codercom/code-server:4", pulled)
+			}
+
+			if test.err == "" && err != nil {
+				t.Errorf("pull = %v, want success", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("pull = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Placer picks the cluster node new workspace containers are cloned to.
+type Placer struct {
+	log     *logger.Logger
+	proxmox *ProxmoxService
+	next    int
+	mu      sync.Mutex
+}
+
+func NewPlacer(proxmox *ProxmoxService) *Placer {
+	return &Placer{
+		log:     logger.NewLogger("Placer"),
+		proxmox: proxmox,
+	}
+}
+
+// Place returns the node for a new workspace of user according to the configured
+// strategy, or the configured node when placement is off.
+func (p *Placer) Place(ctx context.Context, user *domain.User) (string, error) {
+	cfg := p.proxmox.Config()
+	if cfg.Placement == nil {
+		return cfg.Node, nil
+	}
+
+	nodes, err := p.candidates(ctx, cfg.Placement)
+	if err != nil {
+		return "", err
+	}
+
+	var node string
+
+	switch cfg.Placement.Strategy {
+	case config.PlacementRoundRobin:
+		node = p.roundRobin(nodes)
+	case config.PlacementPinned:
+		node = pinned(user, nodes)
+	default:
+		node = leastMemory(nodes)
+	}
+
+	p.log.Info("Placing workspace of %s on node %s (%s)", user.Key(), node, cfg.Placement.Strategy)
+
+	return node, nil
+}
+
+// candidates lists the online nodes with memory left that cfg allows, sorted by
+// name.
+func (p *Placer) candidates(ctx context.Context, cfg *config.PlacementConfig) ([]*domain.NodeInfo, error) {
+	nodes, err := p.proxmox.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*domain.NodeInfo{}
+	for _, node := range nodes {
+		if !node.Online() || node.FreeMem() == 0 {
+			continue
+		}
+
+		if len(cfg.Nodes) > 0 && !slices.Contains(cfg.Nodes, node.Node) {
+			continue
+		}
+
+		ret = append(ret, node)
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no online node with free memory available for placement")
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Node < ret[j].Node
+	})
+
+	return ret, nil
+}
+
+func (p *Placer) roundRobin(nodes []*domain.NodeInfo) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	node := nodes[p.next%len(nodes)]
+	p.next++
+
+	return node.Node
+}
+
+func leastMemory(nodes []*domain.NodeInfo) string {
+	best := nodes[0]
+	for _, node := range nodes[1:] {
+		if node.FreeMem() > best.FreeMem() {
+			best = node
+		}
+	}
+
+	return best.Node
+}
+
+// pinned keeps a user on the node named in their user entry, or else on a node
+// derived from their key so it stays the same across workspaces and restarts.
+func pinned(user *domain.User, nodes []*domain.NodeInfo) string {
+	for _, node := range nodes {
+		if node.Node == user.Node {
+			return node.Node
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(user.Key()))
+
+	return nodes[int(h.Sum32()%uint32(len(nodes)))].Node
+}
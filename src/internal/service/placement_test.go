@@ -0,0 +1,138 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/fake"
+	"testing"
+)
+
+// newTestPlacer switches the Proxmox backend of env to placement and returns a
+// placer on it.
+func newTestPlacer(t *testing.T, env *testEnv, placement *config.PlacementConfig) *Placer {
+	t.Helper()
+
+	proxmox := env.provisioner.Backend().(*ProxmoxService)
+	cfg := *proxmox.Config()
+	cfg.Placement = placement
+
+	apply, err := proxmox.PrepareReload(&cfg, proxmox.workspace.Load())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	apply()
+
+	return NewPlacer(proxmox)
+}
+
+func TestPlacement(t *testing.T) {
+	pinnedUser := &domain.User{Provider: "github", Login: "octocat", Node: "pve3"}
+
+	tests := []struct {
+		name      string
+		placement *config.PlacementConfig
+		user      *domain.User
+		used      map[string]uint64
+		offline   []string
+		want      []string
+	}{
+		{
+			name:      "least memory",
+			placement: &config.PlacementConfig{Strategy: config.PlacementLeastMemory},
+			used:      map[string]uint64{"pve1": 32 << 30, "pve2": 8 << 30, "pve3": 16 << 30},
+			want:      []string{"pve2", "pve2"},
+		},
+		{
+			name:      "least memory skips an offline node",
+			placement: &config.PlacementConfig{Strategy: config.PlacementLeastMemory},
+			used:      map[string]uint64{"pve1": 32 << 30, "pve2": 8 << 30, "pve3": 16 << 30},
+			offline:   []string{"pve2"},
+			want:      []string{"pve3"},
+		},
+		{
+			name:      "least memory within the allowed nodes",
+			placement: &config.PlacementConfig{Strategy: config.PlacementLeastMemory, Nodes: []string{"pve1", "pve3"}},
+			used:      map[string]uint64{"pve1": 32 << 30, "pve3": 16 << 30},
+			want:      []string{"pve3"},
+		},
+		{
+			name:      "round robin spreads over the nodes",
+			placement: &config.PlacementConfig{Strategy: config.PlacementRoundRobin},
+			want:      []string{"pve1", "pve2", "pve3", "pve1"},
+		},
+		{
+			name:      "round robin skips a full node",
+			placement: &config.PlacementConfig{Strategy: config.PlacementRoundRobin},
+			used:      map[string]uint64{"pve2": fake.NodeMemory},
+			want:      []string{"pve1", "pve3", "pve1"},
+		},
+		{
+			name:      "pinned to the user's node",
+			placement: &config.PlacementConfig{Strategy: config.PlacementPinned},
+			user:      pinnedUser,
+			want:      []string{"pve3", "pve3"},
+		},
+		{
+			name:      "pinned falls back when the user's node is offline",
+			placement: &config.PlacementConfig{Strategy: config.PlacementPinned},
+			user:      pinnedUser,
+			offline:   []string{"pve3"},
+			want:      []string{"pve2", "pve2"},
+		},
+		{
+			name:      "pinned falls back when the user's node is full",
+			placement: &config.PlacementConfig{Strategy: config.PlacementPinned},
+			user:      pinnedUser,
+			used:      map[string]uint64{"pve3": fake.NodeMemory},
+			want:      []string{"pve2", "pve2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t, "pve1", "pve2", "pve3")
+			for node, used := range test.used {
+				env.pve.SetNodeMemory(node, used)
+			}
+			for _, node := range test.offline {
+				env.pve.SetNodeOnline(node, false)
+			}
+
+			user := test.user
+			if user == nil {
+				user = env.user
+			}
+
+			placer := newTestPlacer(t, env, test.placement)
+			for i, want := range test.want {
+				node, err := placer.Place(t.Context(), user)
+				if err != nil {
+					t.Fatalf("place #%d: %v", i, err)
+				}
+				if node != want {
+					t.Errorf("place #%d = %s, want %s", i, node, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPlacementWithoutNodes(t *testing.T) {
+	env := newTestEnv(t, "pve1", "pve2")
+	env.pve.SetNodeOnline("pve1", false)
+	env.pve.SetNodeMemory("pve2", fake.NodeMemory)
+
+	placer := newTestPlacer(t, env, &config.PlacementConfig{Strategy: config.PlacementLeastMemory})
+	if node, err := placer.Place(t.Context(), env.user); err == nil {
+		t.Errorf("place = %s, want an error with every node offline or full", node)
+	}
+}
+
+func TestPlacementOff(t *testing.T) {
+	env := newTestEnv(t, "pve1", "pve2")
+
+	placer := newTestPlacer(t, env, nil)
+	if node, err := placer.Place(t.Context(), env.user); err != nil || node != "pve" {
+		t.Errorf("place = %s, %v, want the configured node pve", node, err)
+	}
+}
@@ -0,0 +1,535 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrJobInProgress        = errors.New("workspace is being provisioned")
+	ErrWorkspaceUnavailable = errors.New("workspace unavailable")
+	ErrShuttingDown         = errors.New("launcher is shutting down")
+)
+
+type Provisioner struct {
+	log       *logger.Logger
+	cfg       atomic.Pointer[config.WorkspaceConfig]
+	backend   WorkspaceBackend
+	caddy     *Caddy
+	allocator *Allocator
+	placer    *Placer
+	store     *store.Store
+	lookup    func(owner string) (*domain.User, bool)
+	readiness *ReadinessChecker
+	jobs      map[string]*domain.Job
+	// reserved holds owner, size and node of the workspace each unfinished job
+	// starts, counted against the quota from the moment the job is created.
+	reserved map[string]*domain.Workspace
+	// ctx is cancelled when a shutdown stops waiting for the jobs in running.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	running  sync.WaitGroup
+	draining bool
+	mu       sync.Mutex
+}
+
+// NewProvisioner builds the provisioner; placer may be nil when the backend has no
+// nodes to choose from. lookup resolves a workspace owner to its user when the
+// reconciler brings a workspace back up, and fails for an owner no longer allowed,
+// whose routes the reconciler then removes.
+func NewProvisioner(cfg *config.WorkspaceConfig, backend WorkspaceBackend, caddy *Caddy, allocator *Allocator, placer *Placer, st *store.Store, lookup func(owner string) (*domain.User, bool), readyTimeout int) *Provisioner {
+	ret := &Provisioner{
+		log:       logger.NewLogger("Provisioner"),
+		backend:   backend,
+		caddy:     caddy,
+		allocator: allocator,
+		placer:    placer,
+		store:     st,
+		lookup:    lookup,
+		readiness: NewReadinessChecker(readyTimeout),
+		jobs:      map[string]*domain.Job{},
+		reserved:  map[string]*domain.Workspace{},
+	}
+
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
+	ret.cfg.Store(cfg)
+
+	return ret
+}
+
+// Config returns the workspace catalog, profiles and quota currently in effect.
+func (p *Provisioner) Config() *config.WorkspaceConfig {
+	return p.cfg.Load()
+}
+
+// Reload switches the catalog, profiles and quota used from now on.
+func (p *Provisioner) Reload(cfg *config.WorkspaceConfig) {
+	p.cfg.Store(cfg)
+}
+
+func (p *Provisioner) Backend() WorkspaceBackend {
+	return p.backend
+}
+
+// Heartbeat returns when code-server in ws last saw activity.
+func (p *Provisioner) Heartbeat(ctx context.Context, ws *domain.Workspace) (time.Time, error) {
+	return p.readiness.Heartbeat(ctx, p.caddy.Upstream(ws))
+}
+
+// Readiness returns the outcome of the last readiness probe of workspace slug.
+func (p *Provisioner) Readiness(slug string) (domain.Readiness, bool) {
+	return p.readiness.Get(slug)
+}
+
+// Start launches a provisioning job for the user's workspace called name, or joins
+// the one already in progress. Jobs are keyed by the workspace slug, the same name
+// used for its subdomain. template only matters when the workspace is created.
+// It fails with ErrQuotaExceeded when starting the workspace would exceed a quota,
+// and with ErrShuttingDown once Shutdown was called. ctx only bounds the placement
+// of a new workspace: jobs outlive the request that started them and only a
+// shutdown cancels them.
+func (p *Provisioner) Start(ctx context.Context, user *domain.User, name, template string) (domain.Job, error) {
+	if name != domain.DefaultWorkspace {
+		if err := domain.ValidateWorkspaceName(name); err != nil {
+			return domain.Job{}, fmt.Errorf("%w: %v", ErrWorkspaceUnavailable, err)
+		}
+	}
+
+	slug := domain.WorkspaceSlug(user, name)
+
+	node, err := p.targetNode(ctx, user, slug)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.draining {
+		return domain.Job{}, ErrShuttingDown
+	}
+
+	if job, ok := p.jobs[slug]; ok && !job.Done() {
+		if job.Owner != user.Key() {
+			return domain.Job{}, fmt.Errorf("%w: %s is taken", ErrWorkspaceUnavailable, slug)
+		}
+
+		p.log.Debug("Joining provisioning job for workspace %s in phase %s", slug, job.Phase)
+		return *job, nil
+	}
+
+	if ws, ok := p.allocator.Get(slug); ok && ws.Owner != user.Key() {
+		return domain.Job{}, fmt.Errorf("%w: %s is taken", ErrWorkspaceUnavailable, slug)
+	}
+
+	reservation := p.candidate(user, slug, template, node)
+	if err := p.reserve(reservation); err != nil {
+		p.log.Warn("Refusing to start workspace %s: %v", slug, err)
+		p.store.AddEvent(domain.NewEvent(domain.EventQuotaExceeded, user.Key(), err.Error()))
+		return domain.Job{}, err
+	}
+
+	job := p.begin(user, name, slug, reservation)
+
+	p.log.Info("Starting provisioning job for workspace %s of user %s", slug, user.Key())
+	go func() {
+		defer p.running.Done()
+		p.run(p.ctx, user, name, template, node)
+	}()
+
+	return *job, nil
+}
+
+// begin registers the job for workspace slug with the quota it reserves. Until the
+// job is done, others starting the workspace join it and the reservation counts
+// against the quota. The caller holds p.mu and calls p.running.Done once the job
+// has run.
+func (p *Provisioner) begin(user *domain.User, name, slug string, reservation *domain.Workspace) *domain.Job {
+	job := domain.NewJob(user, name)
+	p.jobs[slug] = job
+	p.reserved[slug] = reservation
+	p.running.Add(1)
+
+	return job
+}
+
+// Shutdown refuses new jobs and waits for those in flight. When ctx is done first
+// they are cancelled, and Shutdown returns ctx.Err() once they have given up.
+func (p *Provisioner) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.log.Info("All provisioning jobs finished")
+		return nil
+	case <-ctx.Done():
+		p.log.Warn("Cancelling provisioning jobs still in flight")
+		p.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (p *Provisioner) Status(slug string) (domain.Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job, ok := p.jobs[slug]
+	if !ok {
+		return domain.Job{}, false
+	}
+
+	return *job, true
+}
+
+func (p *Provisioner) run(ctx context.Context, user *domain.User, name, template, node string) {
+	slug := domain.WorkspaceSlug(user, name)
+	report := &jobReporter{provisioner: p, slug: slug}
+
+	ws, err := p.allocator.Allocate(ctx, user, name, template)
+	if err != nil {
+		p.fail(slug, err)
+		return
+	}
+
+	if err := p.prepareClone(ctx, user, ws, node); err != nil {
+		p.fail(slug, err)
+		return
+	}
+
+	err = p.backend.Ensure(ctx, ws, domain.NewBootstrap(user, ws), report)
+	if err != nil {
+		p.fail(slug, err)
+		return
+	}
+
+	report.Phase(domain.JobPhaseRouting)
+	if ws.RouteDisabled {
+		p.setRouteDisabled(ws, false)
+	}
+	err = p.caddy.Insert(ctx, ws)
+	if err != nil {
+		p.fail(slug, err)
+		return
+	}
+
+	report.Phase(domain.JobPhaseWaiting)
+	err = p.readiness.Wait(ctx, slug, p.caddy.Upstream(ws))
+	if err != nil {
+		p.fail(slug, err)
+		return
+	}
+
+	recordDesired(p.log, p.store, ws, domain.DesiredRunning)
+
+	p.update(slug, func(job *domain.Job) {
+		job.Phase = domain.JobPhaseReady
+		job.URL = "https://" + p.caddy.Subdomain(ws)
+	})
+
+	p.log.Info("Workspace %s ready for user %s", slug, user.Key())
+	p.store.AddEvent(domain.NewEvent(domain.EventProvisionReady, user.Key(), p.caddy.Subdomain(ws)))
+}
+
+// Delete removes the workspace container and route and releases its VMID and IP.
+func (p *Provisioner) Delete(ctx context.Context, ws *domain.Workspace) error {
+	if job, running := p.Status(ws.Slug); running && !job.Done() {
+		return fmt.Errorf("workspace %s: %w", ws.Slug, ErrJobInProgress)
+	}
+
+	if err := p.caddy.Remove(ctx, ws.Slug, p.caddy.Subdomain(ws)); err != nil {
+		p.log.Error("Failed to remove route of workspace %s: %v", ws.Slug, err)
+		return err
+	}
+
+	if err := p.backend.Delete(ctx, ws); err != nil {
+		p.log.Error("Failed to delete workspace %s: %v", ws.Slug, err)
+		return err
+	}
+	p.readiness.Forget(ws.Slug)
+
+	return p.allocator.Release(ws.Slug)
+}
+
+// RemoveRoute takes the route of the workspace down and keeps it down: the
+// reconciler does not restore it until the workspace is next started.
+func (p *Provisioner) RemoveRoute(ctx context.Context, ws *domain.Workspace) error {
+	p.setRouteDisabled(ws, true)
+
+	if err := p.caddy.Remove(ctx, ws.Slug, p.caddy.Subdomain(ws)); err != nil {
+		p.log.Error("Failed to remove route of workspace %s: %v", ws.Slug, err)
+		return err
+	}
+
+	return nil
+}
+
+func (p *Provisioner) setRouteDisabled(ws *domain.Workspace, disabled bool) {
+	ws.RouteDisabled = disabled
+
+	err := p.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		stored.RouteDisabled = disabled
+	})
+	if err != nil {
+		p.log.Warn("Failed to record route state of workspace %s: %v", ws.Slug, err)
+	}
+}
+
+// Stop shuts the workspace down and keeps it down: the reconciler leaves it stopped.
+func (p *Provisioner) Stop(ctx context.Context, ws *domain.Workspace) error {
+	recordDesired(p.log, p.store, ws, domain.DesiredStopped)
+	p.readiness.Forget(ws.Slug)
+	return p.backend.Stop(ctx, ws)
+}
+
+// Hibernate suspends the workspace, which the reconciler leaves suspended.
+func (p *Provisioner) Hibernate(ctx context.Context, ws *domain.Workspace) error {
+	recordDesired(p.log, p.store, ws, domain.DesiredHibernated)
+	p.readiness.Forget(ws.Slug)
+	return p.backend.Hibernate(ctx, ws)
+}
+
+// Restart reboots a running workspace, or starts it when it is down, and follows
+// it back up in a provisioning job as Start does.
+func (p *Provisioner) Restart(ctx context.Context, user *domain.User, ws *domain.Workspace) (domain.Job, error) {
+	if job, running := p.Status(ws.Slug); running && !job.Done() {
+		return job, fmt.Errorf("workspace %s: %w", ws.Slug, ErrJobInProgress)
+	}
+
+	info, err := p.backend.Info(ctx, ws)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	if info != nil && info.Status == domain.VmStatusRunning {
+		p.readiness.Forget(ws.Slug)
+
+		if err := p.backend.Restart(ctx, ws); err != nil {
+			p.log.Error("Failed to restart workspace %s: %v", ws.Slug, err)
+			return domain.Job{}, err
+		}
+	}
+
+	return p.Start(ctx, user, ws.Name, ws.Template)
+}
+
+// Reclone throws the container away, keeping VMID and IP, and provisions a fresh
+// clone of its template. The job is registered before the container is deleted, so
+// the workspace cannot be started or recloned again in between and the fresh clone
+// keeps its place in the quota.
+func (p *Provisioner) Reclone(ctx context.Context, user *domain.User, ws *domain.Workspace) (domain.Job, error) {
+	node, err := p.targetNode(ctx, user, ws.Slug)
+	if err != nil {
+		return domain.Job{}, err
+	}
+
+	// The fresh clone has to fit in the quota before the old one is thrown away,
+	// whatever the stored status says.
+	fresh := &domain.Workspace{Owner: ws.Owner, Slug: ws.Slug, Node: node}
+	_, fresh.Resources = resourcesFor(p.Config(), user, ws.Template)
+
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return domain.Job{}, ErrShuttingDown
+	}
+
+	if job, ok := p.jobs[ws.Slug]; ok && !job.Done() {
+		p.mu.Unlock()
+		return *job, fmt.Errorf("workspace %s: %w", ws.Slug, ErrJobInProgress)
+	}
+
+	if err := p.reserve(fresh); err != nil {
+		p.mu.Unlock()
+		p.log.Warn("Refusing to reclone workspace %s: %v", ws.Slug, err)
+		return domain.Job{}, err
+	}
+
+	job := *p.begin(user, ws.Name, ws.Slug, fresh)
+	p.mu.Unlock()
+
+	p.log.Info("Recloning workspace %s of user %s", ws.Slug, user.Key())
+	if err := p.backend.Delete(ctx, ws); err != nil {
+		// Failing the job releases its reservation.
+		p.fail(ws.Slug, fmt.Errorf("delete before reclone: %w", err))
+		p.running.Done()
+		return domain.Job{}, err
+	}
+
+	go func() {
+		defer p.running.Done()
+		p.run(p.ctx, user, ws.Name, ws.Template, node)
+	}()
+
+	return job, nil
+}
+
+// targetNode returns the node workspace slug lives on, or places it when it has
+// none yet. It is empty when the backend has no nodes to choose from.
+func (p *Provisioner) targetNode(ctx context.Context, user *domain.User, slug string) (string, error) {
+	if ws, ok := p.allocator.Get(slug); ok && ws.Node != "" {
+		return ws.Node, nil
+	}
+
+	if p.placer == nil {
+		return "", nil
+	}
+
+	return p.placer.Place(ctx, user)
+}
+
+// candidate describes the workspace a job for slug starts: the stored workspace
+// when there is one, sized from the user's profile until its container is cloned.
+func (p *Provisioner) candidate(user *domain.User, slug, template, node string) *domain.Workspace {
+	ret := &domain.Workspace{Owner: user.Key(), Slug: slug}
+	if stored, ok := p.allocator.Get(slug); ok {
+		ret = stored
+	}
+
+	ret.Node = node
+	if ret.Resources.Memory == 0 {
+		_, ret.Resources = resourcesFor(p.Config(), user, template)
+	}
+
+	return ret
+}
+
+// reserve checks starting candidate against the configured quota. Running
+// workspaces count with what they hold and unfinished jobs with their reservation,
+// so jobs started at the same time cannot both take the last of a quota. A
+// candidate already running commits nothing new. The caller holds p.mu.
+func (p *Provisioner) reserve(candidate *domain.Workspace) error {
+	quota := p.Config().Quota
+	if quota == nil || candidate.Status == domain.VmStatusRunning {
+		return nil
+	}
+
+	workspaces, err := p.store.ListWorkspaces()
+	if err != nil {
+		return err
+	}
+
+	usage := domain.NewUsage()
+	for _, ws := range workspaces {
+		if _, pending := p.reserved[ws.Slug]; pending || ws.Slug == candidate.Slug {
+			continue
+		}
+
+		if ws.Status == domain.VmStatusRunning {
+			usage.Add(ws)
+		}
+	}
+
+	for slug, reservation := range p.reserved {
+		if slug != candidate.Slug {
+			usage.Add(reservation)
+		}
+	}
+
+	return checkQuota(quota, usage, candidate)
+}
+
+// prepareClone sizes a workspace whose container is about to be cloned from the
+// user's current resource profile, puts it on node and gives it a code-server
+// password when those are enabled. The fresh clone may fetch its set-up again.
+// Existing containers keep the size, node and password they have.
+func (p *Provisioner) prepareClone(ctx context.Context, user *domain.User, ws *domain.Workspace, node string) error {
+	info, err := p.backend.Info(ctx, ws)
+	if err != nil || info != nil {
+		return err
+	}
+
+	password := ""
+	if p.Config().CodeServerAuth == config.CodeServerAuthPassword {
+		password = randomPassword()
+	}
+
+	profile, res := resourcesFor(p.Config(), user, ws.Template)
+	ws.Profile = profile
+	ws.Resources = res
+	ws.Node = node
+	ws.Password = password
+	ws.BootstrappedAt = time.Time{}
+
+	return p.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		stored.Profile = profile
+		stored.Resources = res
+		stored.Node = node
+		stored.Password = password
+		stored.BootstrappedAt = time.Time{}
+	})
+}
+
+func randomPassword() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func (p *Provisioner) fail(slug string, err error) {
+	p.log.Error("Provisioning failed for workspace %s: %v", slug, err)
+	p.store.AddEvent(domain.NewEvent(domain.EventProvisionFailed, slug, err.Error()))
+
+	p.update(slug, func(job *domain.Job) {
+		job.Phase = domain.JobPhaseFailed
+		job.Error = err.Error()
+	})
+}
+
+func (p *Provisioner) update(slug string, apply func(job *domain.Job)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job, ok := p.jobs[slug]
+	if !ok {
+		return
+	}
+
+	apply(job)
+	job.UpdatedAt = time.Now()
+	if job.Done() {
+		delete(p.reserved, slug)
+	}
+	p.log.Debug("Provisioning job for workspace %s is now %s", slug, job.Phase)
+}
+
+// jobReporter records the progress of a backend on the provisioning job of slug.
+type jobReporter struct {
+	provisioner *Provisioner
+	slug        string
+}
+
+// Phase moves the job on and clears the task of the previous phase.
+func (r *jobReporter) Phase(phase domain.JobPhase) {
+	r.provisioner.update(r.slug, func(job *domain.Job) {
+		job.Phase = phase
+		job.Task = nil
+	})
+}
+
+func (r *jobReporter) Task(task domain.Task) {
+	r.provisioner.update(r.slug, func(job *domain.Job) {
+		job.Task = &task
+	})
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsJobs(t *testing.T) {
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	if err := env.provisioner.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if job, _ := env.provisioner.Status(slug); job.Phase != domain.JobPhaseReady {
+		t.Errorf("job after shutdown = %s (%s), want the running job finished", job.Phase, job.Error)
+	}
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("start after shutdown = %v, want ErrShuttingDown", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, slug)
+
+	reboot := fmt.Sprintf("POST /nodes/pve/lxc/%d/status/reboot", ws.VMID)
+	start := fmt.Sprintf("POST /nodes/pve/lxc/%d/status/start", ws.VMID)
+
+	if _, err := env.provisioner.Restart(t.Context(), env.user, ws); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	env.waitReady(t, slug)
+
+	if calls := env.pve.Calls(); !slices.Contains(calls, reboot) {
+		t.Errorf("calls = %v, want a reboot of the running container", calls)
+	}
+
+	// A stopped container is started instead.
+	if err := env.provisioner.Stop(t.Context(), ws); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	before := len(env.pve.Calls())
+	if _, err := env.provisioner.Restart(t.Context(), env.user, ws); err != nil {
+		t.Fatalf("restart of a stopped workspace: %v", err)
+	}
+	ws = env.waitReady(t, slug)
+
+	calls := env.pve.Calls()[before:]
+	if slices.Contains(calls, reboot) || !slices.Contains(calls, start) {
+		t.Errorf("calls = %v, want the stopped container started", calls)
+	}
+	if ws.Desired != domain.DesiredRunning {
+		t.Errorf("desired state after restart = %q, want running", ws.Desired)
+	}
+}
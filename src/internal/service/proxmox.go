@@ -4,43 +4,145 @@ import (
 	"code-server-launcher/internal/config"
 	"code-server-launcher/internal/domain"
 	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
 	"context"
-	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Telmate/proxmox-api-go/proxmox"
 )
 
+// connectTimeout bounds the login when the service is set up or reconfigured.
+const connectTimeout = 30 * time.Second
+
 type ProxmoxService struct {
-	config.ProxmoxConfig
-	log           *logger.Logger
-	apiURL        string
-	proxmoxClient *proxmox.Client
+	log       *logger.Logger
+	cfg       atomic.Pointer[config.ProxmoxConfig]
+	workspace atomic.Pointer[config.WorkspaceConfig]
+	api       atomic.Pointer[proxmoxAPI]
+	store     *store.Store
+	// authMu serializes replacing api, by a renewal or a reload.
+	authMu sync.Mutex
+}
+
+// proxmoxAPI is a connection to Proxmox: the library client, and a session sharing
+// its login for the task endpoints the client only offers as blocking calls. It is
+// never changed once in use; renewing the ticket swaps in a new connection.
+type proxmoxAPI struct {
+	client  *proxmox.Client
+	session *proxmox.Session
+	// loggedInAt is when the ticket was issued, zero when the login failed.
+	loggedInAt time.Time
+	// stale is set once the API rejected the ticket.
+	stale atomic.Bool
 }
 
-func NewProxmoxService(cfg *config.ProxmoxConfig) *ProxmoxService {
+func NewProxmoxService(cfg *config.ProxmoxConfig, workspace *config.WorkspaceConfig, st *store.Store) *ProxmoxService {
 	ret := &ProxmoxService{
-		log:           logger.NewLogger("ProxmoxService"),
-		apiURL:        "https://" + cfg.Host + "/api2/json",
-		ProxmoxConfig: *cfg,
+		log:   logger.NewLogger("ProxmoxService"),
+		store: st,
+	}
+
+	// A failed login is only logged here so the launcher can start while Proxmox is
+	// unreachable; the client is still usable once the API is back.
+	api, _ := ret.connect(context.Background(), cfg)
+	if api == nil {
+		return nil
+	}
+
+	ret.cfg.Store(cfg)
+	ret.workspace.Store(workspace)
+	ret.api.Store(api)
+
+	return ret
+}
+
+// Config returns the settings currently in effect; callers should read it once per
+// operation so a concurrent reload cannot mix old and new values.
+func (p *ProxmoxService) Config() *config.ProxmoxConfig {
+	return p.cfg.Load()
+}
+
+// PrepareReload logs in again when the connection details of cfg changed and
+// returns the switch to cfg and workspace, which cannot fail. Until it is called
+// the previous settings and client stay in use.
+func (p *ProxmoxService) PrepareReload(cfg *config.ProxmoxConfig, workspace *config.WorkspaceConfig) (func(), error) {
+	current := p.Config()
+
+	var api *proxmoxAPI
+	if cfg.Host != current.Host || cfg.Username != current.Username || cfg.Password != current.Password ||
+		cfg.TokenID != current.TokenID || cfg.TokenSecret != current.TokenSecret ||
+		cfg.CAFile != current.CAFile || cfg.Fingerprint != current.Fingerprint || cfg.InsecureTLS != current.InsecureTLS {
+		var err error
+		api, err = p.connect(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	ctx := context.Background()
+	apply := func() {
+		p.authMu.Lock()
+		defer p.authMu.Unlock()
+
+		if api != nil {
+			p.api.Store(api)
+		}
+		p.cfg.Store(cfg)
+		p.workspace.Store(workspace)
+		p.log.Info("Proxmox configuration reloaded")
+	}
+
+	return apply, nil
+}
+
+// client returns the API client, renewing its login ticket first when needed.
+func (p *ProxmoxService) client(ctx context.Context) *proxmox.Client {
+	p.renewTicket(ctx)
+
+	return p.api.Load().client
+}
 
-	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+// session returns the raw API session used to follow tasks, renewing the login
+// ticket first when needed.
+func (p *ProxmoxService) session(ctx context.Context) *proxmox.Session {
+	p.renewTicket(ctx)
+
+	return p.api.Load().session
+}
+
+func (p *ProxmoxService) connect(ctx context.Context, cfg *config.ProxmoxConfig) (*proxmoxAPI, error) {
+	tlsConfig, err := proxmoxTLSConfig(cfg)
+	if err != nil {
+		p.log.Error("Invalid TLS settings for Proxmox: %v", err)
+		return nil, err
+	}
+
+	if tlsConfig.InsecureSkipVerify && tlsConfig.VerifyConnection == nil {
+		p.log.Warn("TLS verification of Proxmox at %s is disabled", cfg.Host)
+	}
+
+	api := &proxmoxAPI{}
 
 	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
+		Transport: &unauthorizedWatcher{
+			next: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+			onUnauthorized: func() {
+				api.stale.Store(true)
+			},
 		},
 	}
 
-	var err error
+	apiURL := "https://" + cfg.Host + "/api2/json"
 
-	ret.proxmoxClient, err = proxmox.NewClient(
-		ret.apiURL,
+	client, err := proxmox.NewClient(
+		apiURL,
 		httpClient,
 		"",
 		tlsConfig,
@@ -49,109 +151,148 @@ func NewProxmoxService(cfg *config.ProxmoxConfig) *ProxmoxService {
 	)
 
 	if err != nil {
-		ret.log.Error("Failed to create Proxmox client: %v -> config: %v", err, cfg)
-		return nil
+		p.log.Error("Failed to create Proxmox client for %s: %v", cfg.Host, err)
+		return nil, err
 	}
 
-	err = ret.proxmoxClient.Login(ctx, cfg.Username, cfg.Password, "")
+	session, err := proxmox.NewSession(apiURL, httpClient, "", tlsConfig)
 	if err != nil {
-		ret.log.Error("Failed to login to Proxmox: %v", err)
-	} else {
-		ret.log.Info("Proxmox client created successfully")
+		p.log.Error("Failed to create Proxmox session for %s: %v", cfg.Host, err)
+		return nil, err
 	}
 
-	return ret
-}
+	api.client = client
+	api.session = session
 
-func (p *ProxmoxService) Run(user *domain.User) error {
-	p.log.Info("Running LXC for user: %d", user.ID)
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
 
-	status, err := p.getStatus(user)
+	err = p.authenticate(ctx, api, cfg)
+	if err != nil {
+		p.log.Error("Failed to login to Proxmox: %v", err)
+		return api, err
+	}
+
+	p.log.Info("Proxmox client created successfully")
 
+	return api, nil
+}
+
+// Ensure clones and configures the workspace container when it is missing and
+// starts or resumes it otherwise. Proxmox only takes SSH keys and passwords when
+// creating a container from an OS template, not when cloning, so the template
+// fetches boot from the launcher /bootstrap endpoint on first start instead.
+func (p *ProxmoxService) Ensure(ctx context.Context, ws *domain.Workspace, boot *domain.Bootstrap, report Reporter) error {
+	p.log.Info("Running LXC for workspace: %d", ws.VMID)
+
+	status, err := settledStatus(ctx, p.log, p, ws)
 	if err != nil {
 		p.log.Error("Failed to get LXC status: %v", err)
 		return err
 	}
 
-	if status == domain.VmStatusRunning {
-		p.log.Info("LXC container already exists for user: %d", user.ID)
-		return nil
-	}
-
-	if status == domain.VmStatusStopped || status == domain.VmStatusPaused || status == domain.VmStatusSuspended {
-		p.log.Info("LXC container already exists for user %d and is stopped", user.ID)
-		p.log.Info("Starting LXC container for user: %d", user.ID)
-		err := p.TurnOnContainer(user)
-		if err != nil {
-			p.log.Error("Failed to start LXC container: %v", err)
-			return err
+	switch domain.UpAction(status) {
+	case domain.LifecycleNone:
+		p.log.Info("LXC container already running for workspace: %d", ws.VMID)
+		if ws.Status != domain.VmStatusRunning {
+			p.recordStatus(ws, domain.VmStatusRunning)
 		}
 		return nil
+	case domain.LifecycleResume:
+		p.log.Info("LXC container for workspace %d is %s, resuming it", ws.VMID, status)
+		report.Phase(domain.JobPhaseStarting)
+		return p.resume(ctx, ws, report.Task)
+	case domain.LifecycleStart:
+		p.log.Info("Starting stopped LXC container for workspace: %d", ws.VMID)
+		report.Phase(domain.JobPhaseStarting)
+		return p.start(ctx, ws, report.Task)
+	case domain.LifecycleCreate:
+	default:
+		return fmt.Errorf("%w: LXC %d is %s", ErrUnexpectedState, ws.VMID, status)
 	}
 
-	err = p.CreateContainer(user)
+	report.Phase(domain.JobPhaseCloning)
+	targetRef, err := p.cloneContainer(ctx, ws, report.Task)
 
 	if err != nil {
 		p.log.Error("Failed to create LXC container: %v", err)
 		return err
 	}
 
-	p.log.Info("LXC container created successfully for user: %d", user.ID)
+	report.Phase(domain.JobPhaseConfiguring)
+	err = p.configureContainer(ctx, ws, targetRef)
 
-	err = p.TurnOnContainer(user)
 	if err != nil {
-		p.log.Error("Failed to start LXC container: %v", err)
+		p.log.Error("Failed to configure LXC container: %v", err)
 		return err
 	}
 
-	p.log.Info("LXC container started successfully for user: %d", user.ID)
+	p.log.Info("LXC container created successfully for workspace: %d", ws.VMID)
 
-	return nil
-}
+	report.Phase(domain.JobPhaseStarting)
+	err = p.start(ctx, ws, report.Task)
+	if err != nil {
+		p.log.Error("Failed to start LXC container: %v", err)
+		return err
+	}
+
+	p.log.Info("LXC container started successfully for workspace: %d", ws.VMID)
 
-func (p *ProxmoxService) Stop(user *domain.User) error {
-	p.log.Info("Stopping LXC for user: %d", user.ID)
 	return nil
 }
 
-func (p *ProxmoxService) Exists(user *domain.User) (bool, error) {
-	p.log.Debug("Checking if LXC exists for user: %d", user.ID)
+// Stop shuts the container down gracefully, unlike StopContainer which pulls the plug.
+func (p *ProxmoxService) Stop(ctx context.Context, ws *domain.Workspace) error {
+	p.log.Info("Stopping LXC for workspace: %d", ws.VMID)
 
-	info, err := p.GetInfo(user)
-
-	if err != nil || info == nil {
-		p.log.Info("LXC does not exist for user: %d -> %S", user.ID, err)
-		return false, err
+	err := p.changeStatus(ctx, ws, "shutdown", p.taskTimeout(), nil)
+	if err != nil {
+		p.log.Error("Failed to shut down LXC container: %v", err)
+		return err
 	}
 
-	return true, nil
+	p.log.Info("LXC container shut down for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusStopped)
+
+	return nil
 }
 
-func (p *ProxmoxService) getStatus(user *domain.User) (domain.VmStatus, error) {
-	p.log.Debug("Checking if LXC is running for user: %d", user.ID)
-	info, err := p.GetInfo(user)
+// Restart reboots the running container.
+func (p *ProxmoxService) Restart(ctx context.Context, ws *domain.Workspace) error {
+	p.log.Info("Restarting LXC container for workspace: %d", ws.VMID)
 
+	err := p.changeStatus(ctx, ws, "reboot", p.taskTimeout(), nil)
 	if err != nil {
-		p.log.Error("Failed to get LXC info: %v", err)
-		return domain.VmStatusUnknown, err
+		p.log.Error("Failed to restart LXC container: %v", err)
+		return err
 	}
 
-	if info == nil {
-		p.log.Info("LXC does not exist for user: %d", user.ID)
-		return domain.VmStatusMissing, nil
-	}
+	p.log.Info("LXC container restarted for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusRunning)
+
+	return nil
+}
 
-	return info.Status, nil
+func (p *ProxmoxService) Endpoint(ws *domain.Workspace, port int) string {
+	return net.JoinHostPort(ws.IP, strconv.Itoa(port))
 }
 
-func (p *ProxmoxService) GetInfo(user *domain.User) (*domain.VmInfo, error) {
-	p.log.Debug("Checking status of LXC for user: %d", user.ID)
+func (p *ProxmoxService) Info(ctx context.Context, ws *domain.Workspace) (*domain.VmInfo, error) {
+	p.log.Debug("Checking status of LXC for workspace: %d", ws.VMID)
 
-	ctx := context.Background()
+	exists, err := p.client(ctx).VMIdExists(ctx, proxmox.GuestID(ws.VMID))
+	if err != nil {
+		p.log.Error("Failed to check if VMID %d exists: %v", ws.VMID, err)
+		return nil, err
+	}
 
-	vmRef := proxmox.NewVmRef(proxmox.GuestID(user.ID))
+	if !exists {
+		return nil, nil
+	}
 
-	ret, err := p.proxmoxClient.GetVmInfo(ctx, vmRef)
+	vmRef := p.vmRef(ws)
+
+	ret, err := p.client(ctx).GetVmInfo(ctx, vmRef)
 
 	if err != nil {
 		p.log.Error("Failed to get VM list: %v", err)
@@ -168,131 +309,408 @@ func (p *ProxmoxService) GetInfo(user *domain.User) (*domain.VmInfo, error) {
 	return vm, nil
 }
 
-func (p *ProxmoxService) CreateContainer(user *domain.User) error {
-	p.log.Info("Creating LXC container for user: %d", user.ID)
+// cloneContainer clones the template of the workspace and waits for the clone task,
+// so the container is complete before it gets configured.
+func (p *ProxmoxService) cloneContainer(ctx context.Context, ws *domain.Workspace, report func(domain.Task)) (*proxmox.VmRef, error) {
+	p.log.Info("Creating LXC container for workspace: %d", ws.VMID)
+
+	conf := p.Config()
 
-	ctx := context.Background()
+	_, template, ok := p.workspace.Load().Template(ws.Template)
+	if !ok {
+		return nil, fmt.Errorf("template %q of workspace %s is not in the catalog", ws.Template, ws.Slug)
+	}
 
-	templateRef := proxmox.NewVmRef(proxmox.GuestID(p.TemplateID))
-	templateRef.SetNode(p.Node)
+	templateID := template.TemplateID
+	if templateID == 0 {
+		templateID = conf.TemplateID
+	}
 
-	newContainerName := fmt.Sprintf("codeserver-%s", user.Login)
-	guestId := (proxmox.GuestID)(user.ID)
+	templateNode := template.Node
+	if templateNode == "" {
+		templateNode = conf.Node
+	}
 
-	target := proxmox.CloneLxcTarget{
-		Full: &proxmox.CloneLxcFull{
-			Node:    (proxmox.NodeName)(p.Node),
-			ID:      &guestId,
-			Name:    &newContainerName,
-			Storage: &p.StorageName,
-		},
+	// Placement picks ws.Node beforehand; cloning to another node than the template's
+	// needs the template on shared storage.
+	targetNode := ws.Node
+	if targetNode == "" {
+		targetNode = templateNode
 	}
 
-	targetRef, err := templateRef.CloneLxc(ctx, target, p.proxmoxClient)
+	path := fmt.Sprintf("/nodes/%s/lxc/%d/clone", templateNode, templateID)
+	params := map[string]any{
+		"newid":    ws.VMID,
+		"hostname": ws.Hostname(),
+		"full":     true,
+		"storage":  conf.StorageName,
+		"target":   targetNode,
+	}
 
+	err := p.runTask(ctx, path, params, p.taskTimeout(), report)
 	if err != nil {
 		p.log.Error("Failed to clone LXC container: %v", err)
+		return nil, err
+	}
+
+	p.recordNode(ws, targetNode)
+
+	return p.vmRef(ws), nil
+}
+
+// vmRef addresses the workspace container on the node it was placed on. Without a
+// recorded node the client looks the guest up in the cluster resources.
+func (p *ProxmoxService) vmRef(ws *domain.Workspace) *proxmox.VmRef {
+	vmRef := proxmox.NewVmRef(proxmox.GuestID(ws.VMID))
+
+	if ws.Node != "" {
+		vmRef.SetNode(ws.Node)
+		vmRef.SetVmType(string(domain.VmTypeLXC))
+	}
+
+	return vmRef
+}
+
+func (p *ProxmoxService) recordNode(ws *domain.Workspace, node string) {
+	ws.Node = node
+
+	err := p.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		stored.Node = node
+	})
+	if err != nil {
+		p.log.Warn("Failed to record node of workspace %d: %v", ws.VMID, err)
+	}
+}
+
+// Nodes lists the cluster nodes with their current load.
+func (p *ProxmoxService) Nodes(ctx context.Context) ([]*domain.NodeInfo, error) {
+
+	resources, err := p.client(ctx).GetResourceList(ctx, "node")
+	if err != nil {
+		p.log.Error("Failed to list cluster nodes: %v", err)
+		return nil, err
+	}
+
+	ret := []*domain.NodeInfo{}
+	for _, resource := range resources {
+		raw, ok := resource.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		node, err := domain.ParseNodeInfo(raw)
+		if err != nil {
+			p.log.Warn("Skipping unreadable node resource: %v", err)
+			continue
+		}
+
+		ret = append(ret, node)
+	}
+
+	return ret, nil
+}
+
+// Migrate moves a workspace container to node. A running container is shut down,
+// moved and started again on node.
+func (p *ProxmoxService) Migrate(ctx context.Context, ws *domain.Workspace, node string) error {
+	p.log.Info("Migrating LXC container for workspace %d to node %s", ws.VMID, node)
+
+	info, err := p.Info(ctx, ws)
+	if err != nil {
 		return err
 	}
 
-	if targetRef == nil {
-		p.log.Error("Failed to clone LXC container: targetRef is nil")
-		return fmt.Errorf("failed to clone LXC container: targetRef is nil")
+	if info == nil {
+		return fmt.Errorf("LXC container %d does not exist", ws.VMID)
+	}
+
+	if info.Status != domain.VmStatusStopped && info.Status != domain.VmStatusRunning {
+		return fmt.Errorf("LXC container %d is %s, only stopped or running containers can be migrated", ws.VMID, info.Status)
+	}
+
+	if info.Node == node {
+		p.log.Info("LXC container %d is already on node %s", ws.VMID, node)
+		p.recordNode(ws, node)
+		return nil
+	}
+
+	params := map[string]any{"target": node}
+	if info.Status == domain.VmStatusRunning {
+		params["restart"] = 1
 	}
 
-	cfg, err := proxmox.NewConfigLxcFromApi(ctx, targetRef, p.proxmoxClient)
+	path := fmt.Sprintf("/nodes/%s/lxc/%d/migrate", info.Node, ws.VMID)
+	if err := p.runTask(ctx, path, params, p.taskTimeout(), nil); err != nil {
+		p.log.Error("Failed to migrate LXC container: %v", err)
+		return err
+	}
+
+	p.log.Info("LXC container %d migrated from %s to %s", ws.VMID, info.Node, node)
+	p.recordNode(ws, node)
+	p.store.AddEvent(domain.NewEvent(domain.EventMigrate, ws.Owner, fmt.Sprintf("%s: %s -> %s", ws.Slug, info.Node, node)))
+
+	return nil
+}
+
+func (p *ProxmoxService) configureContainer(ctx context.Context, ws *domain.Workspace, targetRef *proxmox.VmRef) error {
+	p.log.Info("Configuring LXC container for workspace: %d", ws.VMID)
+
+	conf := p.Config()
+	workspace := p.workspace.Load()
+
+	cfg, err := proxmox.NewConfigLxcFromApi(ctx, targetRef, p.client(ctx))
 	if err != nil {
 		p.log.Error("Failed to get LXC config: %v", err)
 		return err
 	}
 
-	cfg.Memory = p.MemSize
-	cfg.Cores = p.CPUCores
-	cfg.Networks = proxmox.QemuDevices{
-		0: {
-			"name":     "eth0",
-			"bridge":   p.NetworkInterface,
-			"firewall": true,
-			"ip":       fmt.Sprintf(p.BaseIP, user.ID),
-		},
+	cfg.Memory = workspace.MemSize
+	cfg.Cores = workspace.CPUCores
+	if ws.Resources.Memory > 0 {
+		cfg.Memory = ws.Resources.Memory
+	}
+	if ws.Resources.Cores > 0 {
+		cfg.Cores = ws.Resources.Cores
 	}
 
-	err = cfg.UpdateConfig(ctx, targetRef, p.proxmoxClient)
+	network := proxmox.QemuDevice{
+		"name":     "eth0",
+		"bridge":   conf.NetworkInterface,
+		"firewall": true,
+		"ip":       fmt.Sprintf("%s/%d", ws.IP, poolPrefix(workspace.IPPool)),
+	}
+
+	if workspace.Gateway != "" {
+		network["gw"] = workspace.Gateway
+	}
+
+	cfg.Networks = proxmox.QemuDevices{0: network}
+
+	err = cfg.UpdateConfig(ctx, targetRef, p.client(ctx))
 
 	if err != nil {
 		p.log.Error("Failed to update LXC config: %v", err)
 		return err
 	}
 
+	if err := p.enableIPFilter(ctx, ws, targetRef); err != nil {
+		return err
+	}
+
+	disk := workspace.StorageSize
+	if ws.Resources.Disk > 0 {
+		disk = ws.Resources.Disk
+	}
+
+	return p.resizeDisk(ctx, ws, targetRef, disk)
+}
+
+// enableIPFilter turns on the container firewall with IP filtering, so the
+// container can only send from the address given to net0. The launcher tells
+// containers apart by that address when serving /bootstrap. Filtering needs the
+// firewall enabled for the datacenter as well.
+func (p *ProxmoxService) enableIPFilter(ctx context.Context, ws *domain.Workspace, targetRef *proxmox.VmRef) error {
+	path := fmt.Sprintf("/nodes/%s/lxc/%d/firewall/options", targetRef.Node(), ws.VMID)
+	body := proxmox.ParamsToBody(map[string]any{"enable": 1, "ipfilter": 1})
+
+	if _, err := p.session(ctx).Put(ctx, path, nil, nil, &body); err != nil {
+		p.log.Error("Failed to enable IP filter of LXC %d: %v", ws.VMID, err)
+		return fmt.Errorf("PUT %s: %v", path, err)
+	}
+
 	return nil
 }
 
-func (p *ProxmoxService) HibernateVm(user *domain.User) error {
-	p.log.Info("Hibernating LXC container for user: %d", user.ID)
+// resizeDisk grows the root filesystem to size GB. Proxmox cannot shrink disks, so
+// a template already larger than that is left alone.
+func (p *ProxmoxService) resizeDisk(ctx context.Context, ws *domain.Workspace, targetRef *proxmox.VmRef, size int) error {
+	if size <= 0 {
+		return nil
+	}
 
-	ctx := context.Background()
-	vmRef := proxmox.NewVmRef(proxmox.GuestID(user.ID))
+	info, err := p.Info(ctx, ws)
+	if err != nil || info == nil {
+		return err
+	}
 
-	status, err := p.proxmoxClient.HibernateVm(ctx, vmRef)
+	if info.MaxDisk >= uint64(size)<<30 {
+		p.log.Debug("Root disk of LXC %d is already %d bytes, not resizing to %dG", ws.VMID, info.MaxDisk, size)
+		return nil
+	}
 
+	_, err = p.client(ctx).ResizeQemuDiskRaw(ctx, targetRef, "rootfs", fmt.Sprintf("%dG", size))
+	if err != nil {
+		p.log.Error("Failed to resize root disk of LXC %d: %v", ws.VMID, err)
+		return err
+	}
+
+	p.log.Info("Root disk of LXC %d resized to %dG", ws.VMID, size)
+
+	return nil
+}
+
+// UsedVMIDs lists every guest ID known to the cluster, so allocations never reuse one.
+func (p *ProxmoxService) UsedVMIDs(ctx context.Context) (map[int]bool, error) {
+
+	resources, err := p.client(ctx).GetResourceList(ctx, "vm")
+	if err != nil {
+		p.log.Error("Failed to list cluster VMs: %v", err)
+		return nil, err
+	}
+
+	ret := map[int]bool{}
+	for _, resource := range resources {
+		raw, ok := resource.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if vmid, ok := raw["vmid"].(float64); ok {
+			ret[int(vmid)] = true
+		}
+	}
+
+	return ret, nil
+}
+
+func (p *ProxmoxService) Delete(ctx context.Context, ws *domain.Workspace) error {
+	p.log.Info("Deleting LXC container for workspace: %d", ws.VMID)
+
+	info, err := p.Info(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	if info == nil {
+		p.log.Info("LXC container %d already gone", ws.VMID)
+		return nil
+	}
+
+	if info.Status == domain.VmStatusRunning {
+		if err := p.StopContainer(ctx, ws); err != nil {
+			return err
+		}
+	}
+
+	vmRef := p.vmRef(ws)
+
+	status, err := p.client(ctx).DeleteVm(ctx, vmRef)
+	if err != nil {
+		p.log.Error("Failed to delete LXC container: %v", err)
+		return err
+	}
+
+	p.log.Info("LXC container deleted for workspace: %d -> Status: %s", ws.VMID, status)
+	p.store.AddEvent(domain.NewEvent(domain.EventContainerStatus, ws.Owner, fmt.Sprintf("container %d deleted", ws.VMID)))
+
+	return nil
+}
+
+func (p *ProxmoxService) recordStatus(ws *domain.Workspace, status domain.VmStatus) {
+	recordStatus(p.log, p.store, ws, status)
+}
+
+func poolPrefix(ipPool string) int {
+	_, pool, err := net.ParseCIDR(ipPool)
+	if err != nil {
+		return 24
+	}
+
+	ones, _ := pool.Mask.Size()
+	return ones
+}
+
+func (p *ProxmoxService) Hibernate(ctx context.Context, ws *domain.Workspace) error {
+	p.log.Info("Hibernating LXC container for workspace: %d", ws.VMID)
+
+	err := p.changeStatus(ctx, ws, "suspend", p.taskTimeout(), nil)
 	if err != nil {
 		p.log.Error("Failed to hibernate LXC container: %v", err)
 		return err
 	}
 
-	p.log.Info("LXC container hibernated successfully for user: %d -> Status: %s", user.ID, status)
+	p.log.Info("LXC container hibernated successfully for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusSuspended)
 
 	return nil
 }
 
-func (p *ProxmoxService) StopContainer(user *domain.User) error {
-	p.log.Info("Stopping LXC container for user: %d", user.ID)
+func (p *ProxmoxService) resume(ctx context.Context, ws *domain.Workspace, report func(domain.Task)) error {
+	p.log.Info("Resuming LXC container for workspace: %d", ws.VMID)
 
-	ctx := context.Background()
-	vmRef := proxmox.NewVmRef(proxmox.GuestID(user.ID))
+	err := p.changeStatus(ctx, ws, "resume", p.startTimeout(), report)
+	if err != nil {
+		p.log.Error("Failed to resume LXC container: %v", err)
+		return err
+	}
 
-	status, err := p.proxmoxClient.StopVm(ctx, vmRef)
+	p.log.Info("LXC container resumed successfully for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusRunning)
 
+	return nil
+}
+
+func (p *ProxmoxService) StopContainer(ctx context.Context, ws *domain.Workspace) error {
+	p.log.Info("Stopping LXC container for workspace: %d", ws.VMID)
+
+	err := p.changeStatus(ctx, ws, "stop", p.taskTimeout(), nil)
 	if err != nil {
 		p.log.Error("Failed to stop LXC container: %v", err)
 		return err
 	}
 
-	p.log.Info("LXC container stopped successfully for user: %d -> Status: %s", user.ID, status)
+	p.log.Info("LXC container stopped successfully for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusStopped)
 
 	return nil
 }
 
-func (p *ProxmoxService) TurnOnContainer(user *domain.User) error {
-	p.log.Info("Turning on LXC container for user: %d", user.ID)
-
-	ctx := context.Background()
-	vmRef := proxmox.NewVmRef(proxmox.GuestID(user.ID))
+func (p *ProxmoxService) Start(ctx context.Context, ws *domain.Workspace) error {
+	return p.start(ctx, ws, nil)
+}
 
-	status, err := p.proxmoxClient.StartVm(ctx, vmRef)
+// start runs the start task of the container, which Proxmox ends once the
+// container is up, allowing it time_to_start seconds.
+func (p *ProxmoxService) start(ctx context.Context, ws *domain.Workspace, report func(domain.Task)) error {
+	p.log.Info("Turning on LXC container for workspace: %d", ws.VMID)
 
+	err := p.changeStatus(ctx, ws, "start", p.startTimeout(), report)
 	if err != nil {
 		p.log.Error("Failed to start LXC container: %v", err)
 		return err
 	}
 
-	p.log.Info("LXC container started successfully for user: %d -> Status: %s", user.ID, status)
+	p.log.Info("LXC container is running for workspace: %d", ws.VMID)
+	p.recordStatus(ws, domain.VmStatusRunning)
 
-	time.Sleep(5 * time.Second)
-	for i := 0; i < p.TimetoStart; i++ {
-		time.Sleep(time.Second)
-		info, err := p.GetInfo(user)
+	return nil
+}
+
+// changeStatus runs a status action such as start or shutdown on the workspace
+// container and waits at most timeout for its task.
+func (p *ProxmoxService) changeStatus(ctx context.Context, ws *domain.Workspace, action string, timeout time.Duration, report func(domain.Task)) error {
+	node := ws.Node
+	if node == "" {
+		info, err := p.Info(ctx, ws)
 		if err != nil {
-			p.log.Error("Failed to get LXC info: %v", err)
 			return err
 		}
-		if info.Status == domain.VmStatusRunning {
-			p.log.Info("LXC container is running for user: %d", user.ID)
-			return nil
+		if info == nil {
+			return fmt.Errorf("LXC container %d does not exist", ws.VMID)
 		}
 
-		p.log.Info("Waiting for LXC container to start for user: %d -> Status: %s", user.ID, info.Status)
+		node = info.Node
 	}
 
-	return fmt.Errorf("LXC container did not start in time for user: %d", user.ID)
+	path := fmt.Sprintf("/nodes/%s/lxc/%d/status/%s", node, ws.VMID, action)
+
+	return p.runTask(ctx, path, nil, timeout, report)
+}
+
+func (p *ProxmoxService) startTimeout() time.Duration {
+	return time.Duration(p.Config().TimetoStart) * time.Second
+}
+
+func (p *ProxmoxService) taskTimeout() time.Duration {
+	return time.Duration(p.Config().TaskTimeout) * time.Second
 }
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bytes"
+	"code-server-launcher/internal/config"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+// Proxmox tickets are valid for two hours; renew them well before that.
+const ticketLifetime = 90 * time.Minute
+
+// proxmoxTLSConfig verifies the Proxmox certificate against the system roots, a CA
+// bundle, or a pinned SHA-256 fingerprint of the leaf certificate.
+func proxmoxTLSConfig(cfg *config.ProxmoxConfig) (*tls.Config, error) {
+	ret := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", cfg.CAFile)
+		}
+
+		ret.RootCAs = pool
+	}
+
+	if cfg.Fingerprint != "" {
+		expected, err := config.ParseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// The pinned fingerprint replaces chain verification, so self-signed
+		// certificates as installed by Proxmox work without a CA bundle.
+		ret.InsecureSkipVerify = true
+		ret.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("proxmox presented no certificate")
+			}
+
+			actual := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(actual[:], expected) {
+				return fmt.Errorf("proxmox certificate fingerprint %X does not match the pinned one", actual)
+			}
+
+			return nil
+		}
+	} else if cfg.InsecureTLS {
+		ret.InsecureSkipVerify = true
+	}
+
+	return ret, nil
+}
+
+// unauthorizedWatcher reports API responses with status 401, which Proxmox sends
+// once the ticket of a session has expired or been revoked.
+type unauthorizedWatcher struct {
+	next           http.RoundTripper
+	onUnauthorized func()
+}
+
+func (u *unauthorizedWatcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && !strings.HasSuffix(req.URL.Path, "/access/ticket") {
+		u.onUnauthorized()
+	}
+
+	return resp, err
+}
+
+// authenticate sets the API token on api, or logs in with username and password
+// once and hands the ticket to both the client and the session.
+func (p *ProxmoxService) authenticate(ctx context.Context, api *proxmoxAPI, cfg *config.ProxmoxConfig) error {
+	if cfg.UsesToken() {
+		api.client.SetAPIToken(cfg.TokenID, cfg.TokenSecret)
+		api.session.SetAPIToken(cfg.TokenID, cfg.TokenSecret)
+		return nil
+	}
+
+	err := login(ctx, api.session, cfg.Username, cfg.Password)
+	if err != nil {
+		return err
+	}
+
+	// The client checks permissions by user name unless it is root@pam.
+	api.client.Username = cfg.Username
+	api.client.SetTicket(api.session.AuthTicket, api.session.CsrfToken)
+	api.loggedInAt = time.Now()
+
+	return nil
+}
+
+// login asks Proxmox for a ticket and sets it on session. Session.Login is not used
+// because it switches the library's global debug flag, racing with the requests
+// of the connection still in use.
+func login(ctx context.Context, session *proxmox.Session, username, password string) error {
+	body := proxmox.ParamsToBody(map[string]any{"username": username, "password": password})
+
+	resp, err := session.Post(ctx, "/access/ticket", nil, nil, &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		Data struct {
+			Ticket    string `json:"ticket"`
+			CsrfToken string `json:"CSRFPreventionToken"`
+			NeedTFA   int    `json:"NeedTFA"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("invalid login response: %v", err)
+	}
+
+	if data.Data.NeedTFA == 1 {
+		return fmt.Errorf("missing TFA code")
+	}
+
+	if data.Data.Ticket == "" {
+		return fmt.Errorf("invalid login response: no ticket")
+	}
+
+	session.AuthTicket = data.Data.Ticket
+	session.CsrfToken = data.Data.CsrfToken
+
+	return nil
+}
+
+// expired tells whether the ticket of api is about to expire or was rejected.
+func (api *proxmoxAPI) expired() bool {
+	return api.stale.Load() || time.Since(api.loggedInAt) >= ticketLifetime
+}
+
+// renewTicket logs in on a new connection when the current ticket is about to
+// expire or the API rejected it, and swaps it in for the next callers. Requests in
+// flight keep the connection they started with. API tokens do not expire, so
+// nothing is done for them.
+func (p *ProxmoxService) renewTicket(ctx context.Context) {
+	cfg := p.Config()
+	if cfg.UsesToken() || !p.api.Load().expired() {
+		return
+	}
+
+	p.authMu.Lock()
+	defer p.authMu.Unlock()
+
+	// Another caller may have renewed it while we waited for the lock, or a reload
+	// switched the settings.
+	if !p.api.Load().expired() {
+		return
+	}
+	cfg = p.Config()
+
+	p.log.Info("Renewing Proxmox ticket for %s", cfg.Username)
+	api, err := p.connect(ctx, cfg)
+	if err != nil {
+		return
+	}
+
+	p.api.Store(api)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTicketRenewalSwapsConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the client to retry rejected requests")
+	}
+
+	env := newTestEnv(t)
+	proxmox := env.provisioner.Backend().(*ProxmoxService)
+	first := proxmox.api.Load()
+
+	// Requests racing with renewals may fail on a ticket expired under them, but must
+	// never see a connection changed while in use; run with -race.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				proxmox.Nodes(t.Context())
+			}
+		}()
+	}
+
+	for range 5 {
+		env.pve.ExpireTickets()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	// The first request after expiry is rejected and flags the ticket, the next one
+	// runs on a new connection.
+	env.pve.ExpireTickets()
+	proxmox.Nodes(t.Context())
+
+	if _, err := proxmox.Nodes(t.Context()); err != nil {
+		t.Fatalf("nodes after renewal: %v", err)
+	}
+	if proxmox.api.Load() == first {
+		t.Error("ticket renewed on the connection in use")
+	}
+}
+
+func TestFingerprintPinning(t *testing.T) {
+	env := newTestEnv(t)
+	proxmox := env.provisioner.Backend().(*ProxmoxService)
+
+	// Proxmox shows fingerprints as colon-separated upper case hex.
+	var colons []string
+	for hex := strings.ToUpper(env.pve.Fingerprint()); hex != ""; hex = hex[2:] {
+		colons = append(colons, hex[:2])
+	}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		err         string
+	}{
+		{name: "pinned", fingerprint: env.pve.Fingerprint()},
+		{name: "colon separated", fingerprint: strings.Join(colons, ":")},
+		{name: "other certificate", fingerprint: strings.Repeat("ab", 32), err: "does not match the pinned one"},
+		{name: "not pinned", err: "certificate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := *proxmox.Config()
+			cfg.Fingerprint = test.fingerprint
+
+			_, err := proxmox.connect(t.Context(), &cfg)
+			if test.err == "" && err != nil {
+				t.Errorf("connect = %v, want the pinned certificate accepted", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("connect = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Telmate/proxmox-api-go/proxmox"
+)
+
+const (
+	taskPollInterval = time.Second
+	// taskLogLines is how much of the log of a failed task is kept.
+	taskLogLines = 20
+)
+
+// TaskError is returned for a Proxmox task that stopped with another exit status
+// than OK, along with the end of its log.
+type TaskError struct {
+	UPID       string
+	ExitStatus string
+	Log        []string
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("proxmox task %s failed: %s", taskType(e.UPID), e.ExitStatus)
+	if len(e.Log) > 0 {
+		msg += " (" + e.Log[len(e.Log)-1] + ")"
+	}
+
+	return msg
+}
+
+// runTask starts the task behind the endpoint at path and follows it until it
+// stops, timeout elapses or ctx is done, reporting its progress when report is not
+// nil.
+func (p *ProxmoxService) runTask(ctx context.Context, path string, params map[string]any, timeout time.Duration, report func(domain.Task)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	upid, err := p.startTask(ctx, path, params)
+	if err != nil {
+		return err
+	}
+
+	return p.waitTask(ctx, upid, report)
+}
+
+// startTask posts params to an endpoint that runs a Proxmox task and returns the
+// UPID of the task, without waiting for it.
+func (p *ProxmoxService) startTask(ctx context.Context, path string, params map[string]any) (string, error) {
+	body := proxmox.ParamsToBody(params)
+
+	resp, err := p.session(ctx).Post(ctx, path, nil, nil, &body)
+	if err != nil {
+		return "", fmt.Errorf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		Data string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("POST %s: decoding task: %v", path, err)
+	}
+
+	if !strings.HasPrefix(data.Data, "UPID:") {
+		return "", fmt.Errorf("POST %s: no task started, got %q", path, data.Data)
+	}
+
+	p.log.Debug("Started Proxmox task %s", data.Data)
+
+	return data.Data, nil
+}
+
+// waitTask polls the status of task upid until it stops, and fails with a
+// *TaskError when it did not end OK. Errors reading the status are retried until
+// ctx is done; the task itself keeps running in Proxmox then.
+func (p *ProxmoxService) waitTask(ctx context.Context, upid string, report func(domain.Task)) error {
+	task := domain.Task{
+		UPID:      upid,
+		Type:      taskType(upid),
+		Status:    domain.TaskRunning,
+		StartedAt: time.Now(),
+	}
+
+	if report == nil {
+		report = func(domain.Task) {}
+	}
+	report(task)
+
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", taskNode(upid), url.PathEscape(upid))
+
+	for {
+		var status struct {
+			Data struct {
+				Status     string `json:"status"`
+				ExitStatus string `json:"exitstatus"`
+			} `json:"data"`
+		}
+
+		_, err := p.session(ctx).GetJSON(ctx, path, nil, nil, &status)
+		if err == nil && status.Data.Status == "stopped" {
+			task.Status = status.Data.ExitStatus
+			break
+		}
+
+		if err != nil {
+			p.log.Warn("Failed to read status of Proxmox task %s: %v", upid, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxmox task %s did not finish: %w", upid, ctx.Err())
+		case <-time.After(taskPollInterval):
+		}
+	}
+
+	if task.Status == "OK" || strings.HasPrefix(task.Status, "WARNINGS") {
+		p.log.Debug("Proxmox task %s finished: %s", upid, task.Status)
+		report(task)
+		return nil
+	}
+
+	task.Log = p.taskLog(ctx, upid)
+	report(task)
+
+	return &TaskError{UPID: upid, ExitStatus: task.Status, Log: task.Log}
+}
+
+// taskLog returns the last lines of the log of task upid, or nil when it cannot be
+// read.
+func (p *ProxmoxService) taskLog(ctx context.Context, upid string) []string {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/log", taskNode(upid), url.PathEscape(upid))
+	params := url.Values{"limit": {"10000"}}
+
+	var log struct {
+		Data []struct {
+			N int    `json:"n"`
+			T string `json:"t"`
+		} `json:"data"`
+	}
+
+	if _, err := p.session(ctx).GetJSON(ctx, path, &params, nil, &log); err != nil {
+		p.log.Warn("Failed to read log of Proxmox task %s: %v", upid, err)
+		return nil
+	}
+
+	lines := log.Data
+	if len(lines) > taskLogLines {
+		lines = lines[len(lines)-taskLogLines:]
+	}
+
+	ret := make([]string, 0, len(lines))
+	for _, line := range lines {
+		ret = append(ret, line.T)
+	}
+
+	return ret
+}
+
+// taskNode and taskType read the node and the task type, such as vzstart, from a
+// UPID of the form UPID:node:pid:pstart:starttime:type:id:user:.
+func taskNode(upid string) string {
+	return upidField(upid, 1)
+}
+
+func taskType(upid string) string {
+	return upidField(upid, 5)
+}
+
+func upidField(upid string, n int) string {
+	fields := strings.Split(upid, ":")
+	if len(fields) <= n {
+		return ""
+	}
+
+	return fields[n]
+}
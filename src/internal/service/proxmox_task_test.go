@@ -0,0 +1,95 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailedTaskSurfacesLog(t *testing.T) {
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+
+	env.pve.FailTask("vzstart", "startup for container failed", "lxc-start 200: no space left on device")
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	var job domain.Job
+	deadline := time.Now().Add(10 * time.Second)
+	for !job.Done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish, last: %+v", job)
+		}
+		time.Sleep(50 * time.Millisecond)
+		job, _ = env.provisioner.Status(slug)
+	}
+
+	if job.Phase != domain.JobPhaseFailed || !strings.Contains(job.Error, "startup for container failed") {
+		t.Fatalf("job = %s with error %q, want failed with the task exit status", job.Phase, job.Error)
+	}
+	if job.Task == nil || job.Task.Type != "vzstart" || job.Task.Status != "startup for container failed" {
+		t.Fatalf("job task = %+v, want the failed vzstart task", job.Task)
+	}
+	if !strings.Contains(strings.Join(job.Task.Log, "\n"), "no space left on device") {
+		t.Errorf("task log = %q, want the log of the failed task", job.Task.Log)
+	}
+
+	// The clone ran to completion before the start failed, so starting is enough.
+	ws, _ := env.provisioner.allocator.Get(slug)
+
+	env.pve.FailTask("vzstart", "startup for container failed")
+	var taskErr *TaskError
+	if err := env.provisioner.Backend().Start(t.Context(), ws); !errors.As(err, &taskErr) || taskErr.ExitStatus != "startup for container failed" {
+		t.Fatalf("start = %v, want a *TaskError with the exit status", err)
+	}
+
+	if err := env.provisioner.Backend().Start(t.Context(), ws); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Status != "running" {
+		t.Errorf("container %d is %s, want running", ws.VMID, guest.Status)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t, "pve", "pve2")
+	proxmox := env.provisioner.Backend().(*ProxmoxService)
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, env.user.Slug())
+
+	// A running container is moved with a restart migration.
+	if err := proxmox.Migrate(t.Context(), ws, "pve2"); err != nil {
+		t.Fatalf("migrate of a running container: %v", err)
+	}
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Node != "pve2" || guest.Status != "running" {
+		t.Errorf("container %d is %s on %s, want running on pve2", ws.VMID, guest.Status, guest.Node)
+	}
+	if stored, _ := env.provisioner.allocator.Get(ws.Slug); stored.Node != "pve2" {
+		t.Errorf("stored node = %q, want pve2", stored.Node)
+	}
+
+	if err := env.provisioner.Stop(t.Context(), ws); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := proxmox.Migrate(t.Context(), ws, "pve"); err != nil {
+		t.Fatalf("migrate of a stopped container: %v", err)
+	}
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Node != "pve" {
+		t.Errorf("container %d is on %s, want pve", ws.VMID, guest.Node)
+	}
+
+	if err := proxmox.Migrate(t.Context(), ws, "pve9"); err == nil {
+		t.Error("migrate to an unknown node succeeded")
+	}
+}
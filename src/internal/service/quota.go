@@ -0,0 +1,66 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"errors"
+	"fmt"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// resourcesFor sizes a workspace of user from the user's resource profile, or else
+// from the profile of the template it is cloned from.
+func resourcesFor(cfg *config.WorkspaceConfig, user *domain.User, template string) (string, domain.Resources) {
+	profileName := user.Profile
+	if profileName == "" {
+		if _, tpl, ok := cfg.Template(template); ok {
+			profileName = tpl.Profile
+		}
+	}
+
+	name, profile := cfg.Profile(profileName)
+
+	return name, domain.Resources{
+		Memory: profile.MemSize,
+		Cores:  profile.CPUCores,
+		Disk:   profile.StorageSize,
+	}
+}
+
+// checkQuota verifies that starting candidate keeps usage within quota, counting
+// its resources against the node it runs on. candidate must not be part of usage.
+func checkQuota(quota *config.QuotaConfig, usage *domain.Usage, candidate *domain.Workspace) error {
+	if quota == nil {
+		return nil
+	}
+
+	res := candidate.Resources
+	committed := usage.PerNode[candidate.Node]
+
+	if quota.MaxRunning > 0 && usage.Running+1 > quota.MaxRunning {
+		return fmt.Errorf("%w: %d workspaces are already running, the limit is %d", ErrQuotaExceeded, usage.Running, quota.MaxRunning)
+	}
+
+	if quota.MaxRunningPerUser > 0 && usage.PerOwner[candidate.Owner]+1 > quota.MaxRunningPerUser {
+		return fmt.Errorf("%w: you already have %d running workspaces, the limit is %d", ErrQuotaExceeded, usage.PerOwner[candidate.Owner], quota.MaxRunningPerUser)
+	}
+
+	if quota.MaxMemory > 0 && committed.Memory+res.Memory > quota.MaxMemory {
+		return fmt.Errorf("%w: %d MB of memory requested, only %d MB left%s", ErrQuotaExceeded, res.Memory, max(quota.MaxMemory-committed.Memory, 0), onNode(candidate.Node))
+	}
+
+	if quota.MaxCores > 0 && committed.Cores+res.Cores > quota.MaxCores {
+		return fmt.Errorf("%w: %d CPU cores requested, only %d left%s", ErrQuotaExceeded, res.Cores, max(quota.MaxCores-committed.Cores, 0), onNode(candidate.Node))
+	}
+
+	return nil
+}
+
+func onNode(node string) string {
+	if node == "" {
+		return ""
+	}
+
+	return " on node " + node
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"context"
+	"errors"
+	"testing"
+)
+
+// setQuota switches the provisioner of env to quota.
+func setQuota(env *testEnv, quota *config.QuotaConfig) {
+	cfg := *env.provisioner.Config()
+	cfg.Quota = quota
+	env.provisioner.Reload(&cfg)
+}
+
+func TestQuotaCountsPendingJobs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+	setQuota(env, &config.QuotaConfig{MaxRunningPerUser: 1})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		env.provisioner.Shutdown(ctx)
+	})
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// The first job has not cloned anything yet, its reservation holds the quota.
+	if _, err := env.provisioner.Start(t.Context(), env.user, "data", ""); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("second start = %v, want ErrQuotaExceeded", err)
+	}
+
+	// Joining the job in progress needs no quota.
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Errorf("start of the same workspace = %v, want the job joined", err)
+	}
+}
+
+func TestQuotaPerNode(t *testing.T) {
+	env := newTestEnv(t)
+	setQuota(env, &config.QuotaConfig{MaxMemory: 3072, MaxCores: 4})
+
+	running := &domain.Workspace{
+		Owner:     "github:alice",
+		Slug:      "alice",
+		Node:      "pve",
+		Status:    domain.VmStatusRunning,
+		Resources: domain.Resources{Memory: 2048, Cores: 2},
+	}
+	if err := env.provisioner.store.SaveWorkspace(running); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	env.provisioner.reserved["bob"] = &domain.Workspace{
+		Owner:     "github:bob",
+		Slug:      "bob",
+		Node:      "pve2",
+		Resources: domain.Resources{Memory: 1024, Cores: 4},
+	}
+
+	tests := []struct {
+		node string
+		res  domain.Resources
+		ok   bool
+	}{
+		{node: "pve", res: domain.Resources{Memory: 1024, Cores: 2}, ok: true},
+		{node: "pve", res: domain.Resources{Memory: 2048, Cores: 1}},
+		{node: "pve2", res: domain.Resources{Memory: 2048, Cores: 0}, ok: true},
+		{node: "pve2", res: domain.Resources{Memory: 1024, Cores: 1}},
+		{node: "pve3", res: domain.Resources{Memory: 3072, Cores: 4}, ok: true},
+	}
+
+	for _, test := range tests {
+		candidate := &domain.Workspace{Owner: env.user.Key(), Slug: env.user.Slug(), Node: test.node, Resources: test.res}
+
+		err := env.provisioner.reserve(candidate)
+		if test.ok && err != nil {
+			t.Errorf("%+v on %s = %v, want it to fit", test.res, test.node, err)
+		}
+		if !test.ok && !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%+v on %s = %v, want ErrQuotaExceeded", test.res, test.node, err)
+		}
+	}
+}
+
+func TestRecloneChecksQuotaFirst(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, env.user.Slug())
+
+	// The fresh clone is sized from the profile, larger than the memory left.
+	setQuota(env, &config.QuotaConfig{MaxMemory: 512})
+
+	if _, err := env.provisioner.Reclone(t.Context(), env.user, ws); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("reclone = %v, want ErrQuotaExceeded", err)
+	}
+
+	if _, ok := env.pve.Guest(ws.VMID); !ok {
+		t.Error("container deleted although the reclone was refused")
+	}
+}
+
+// deleteHook hands the deletion of a workspace to delete.
+type deleteHook struct {
+	WorkspaceBackend
+	delete func(ws *domain.Workspace) error
+}
+
+func (b *deleteHook) Delete(ctx context.Context, ws *domain.Workspace) error {
+	return b.delete(ws)
+}
+
+// saveRunning stores the default workspace of env's user as running, without a
+// container behind it.
+func saveRunning(t *testing.T, env *testEnv) *domain.Workspace {
+	ws := &domain.Workspace{
+		Owner:  env.user.Key(),
+		Name:   domain.DefaultWorkspace,
+		Slug:   env.user.Slug(),
+		Node:   "pve",
+		VMID:   200,
+		IP:     "127.0.0.1",
+		Status: domain.VmStatusRunning,
+	}
+	if err := env.provisioner.store.SaveWorkspace(ws); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	return ws
+}
+
+func TestRecloneHoldsWorkspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the cancelled job to give up")
+	}
+
+	env := newTestEnv(t)
+	setQuota(env, &config.QuotaConfig{MaxRunningPerUser: 1})
+	ws := saveRunning(t, env)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		env.provisioner.Shutdown(ctx)
+	})
+
+	deleting := make(chan struct{})
+	deleted := make(chan struct{})
+	env.provisioner.backend = &deleteHook{
+		WorkspaceBackend: env.provisioner.backend,
+		delete: func(*domain.Workspace) error {
+			close(deleting)
+			<-deleted
+			return nil
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := env.provisioner.Reclone(t.Context(), env.user, ws)
+		done <- err
+	}()
+	<-deleting
+
+	// While the old container goes away, the workspace belongs to the reclone.
+	if job, ok := env.provisioner.Status(ws.Slug); !ok || job.Done() {
+		t.Errorf("job during reclone = %+v (%v), want one in progress", job, ok)
+	}
+	if _, err := env.provisioner.Reclone(t.Context(), env.user, ws); !errors.Is(err, ErrJobInProgress) {
+		t.Errorf("second reclone = %v, want ErrJobInProgress", err)
+	}
+	if _, err := env.provisioner.Start(t.Context(), env.user, "data", ""); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("start during reclone = %v, want ErrQuotaExceeded", err)
+	}
+
+	close(deleted)
+	if err := <-done; err != nil {
+		t.Fatalf("reclone: %v", err)
+	}
+}
+
+func TestFailedRecloneReleasesQuota(t *testing.T) {
+	env := newTestEnv(t)
+	setQuota(env, &config.QuotaConfig{MaxRunningPerUser: 1})
+	ws := saveRunning(t, env)
+
+	env.provisioner.backend = &deleteHook{
+		WorkspaceBackend: env.provisioner.backend,
+		delete: func(*domain.Workspace) error {
+			return errors.New("delete refused")
+		},
+	}
+
+	if _, err := env.provisioner.Reclone(t.Context(), env.user, ws); err == nil {
+		t.Fatal("reclone succeeded although the delete failed")
+	}
+
+	if job, ok := env.provisioner.Status(ws.Slug); !ok || job.Phase != domain.JobPhaseFailed {
+		t.Errorf("job after failed reclone = %+v (%v), want it failed", job, ok)
+	}
+
+	env.provisioner.mu.Lock()
+	reserved := len(env.provisioner.reserved)
+	env.provisioner.mu.Unlock()
+	if reserved != 0 {
+		t.Errorf("%d reservations left after the failed reclone, want none", reserved)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthPath is served by code-server without a login.
+const healthPath = "/healthz"
+
+const (
+	probeTimeout = 2 * time.Second
+	// The delay between probes doubles from probeInitialDelay up to probeMaxDelay.
+	probeInitialDelay = 250 * time.Millisecond
+	probeMaxDelay     = 5 * time.Second
+)
+
+const (
+	probeStageTCP  = "tcp"
+	probeStageHTTP = "http"
+)
+
+// ReadinessChecker probes code-server in workspaces, first with a TCP connect to
+// the upstream and then with a GET of its health endpoint, and remembers the last
+// outcome per workspace.
+type ReadinessChecker struct {
+	log     *logger.Logger
+	client  *http.Client
+	timeout time.Duration
+	results map[string]domain.Readiness
+	mu      sync.Mutex
+}
+
+// NewReadinessChecker builds a checker that gives up on a workspace after timeout
+// seconds.
+func NewReadinessChecker(timeout int) *ReadinessChecker {
+	return &ReadinessChecker{
+		log: logger.NewLogger("Readiness"),
+		client: &http.Client{
+			Timeout: probeTimeout,
+			// A redirect means something other than code-server answered.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		timeout: time.Duration(timeout) * time.Second,
+		results: map[string]domain.Readiness{},
+	}
+}
+
+// Wait probes the upstream addr of workspace slug, backing off between attempts,
+// until code-server answers, the timeout elapses or ctx is done.
+func (c *ReadinessChecker) Wait(ctx context.Context, slug, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	delay := probeInitialDelay
+	result := domain.Readiness{}
+
+	for {
+		result.Attempts++
+		result.CheckedAt = time.Now()
+		result.Stage, result.Error = "", ""
+
+		stage, err := c.probe(ctx, addr)
+		if err == nil {
+			result.Ready = true
+			c.record(slug, result)
+			c.log.Debug("Upstream %s of workspace %s ready after %d attempts", addr, slug, result.Attempts)
+			return nil
+		}
+
+		result.Stage, result.Error = stage, err.Error()
+		c.record(slug, result)
+		c.log.Debug("Waiting for upstream %s of workspace %s: %s: %v", addr, slug, stage, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("code-server at %s not ready after %d attempts: %s: %v", addr, result.Attempts, stage, err)
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, probeMaxDelay)
+	}
+}
+
+// probe runs the checks once and returns the stage that failed.
+func (c *ReadinessChecker) probe(ctx context.Context, addr string) (string, error) {
+	dialer := &net.Dialer{Timeout: probeTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return probeStageTCP, err
+	}
+	conn.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+healthPath, nil)
+	if err != nil {
+		return probeStageHTTP, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return probeStageHTTP, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return probeStageHTTP, fmt.Errorf("GET %s: %s", healthPath, resp.Status)
+	}
+
+	return "", nil
+}
+
+// Heartbeat returns when code-server at addr last saw activity, as reported by its
+// health endpoint. code-server keeps beating while a browser is connected, also
+// over a single long-lived WebSocket. It is zero when code-server never beat.
+func (c *ReadinessChecker) Heartbeat(ctx context.Context, addr string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+healthPath, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("GET %s: %s", healthPath, resp.Status)
+	}
+
+	var health struct {
+		LastHeartbeat int64 `json:"lastHeartbeat"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return time.Time{}, fmt.Errorf("GET %s: %v", healthPath, err)
+	}
+
+	if health.LastHeartbeat <= 0 {
+		return time.Time{}, nil
+	}
+
+	return time.UnixMilli(health.LastHeartbeat), nil
+}
+
+// Get returns the last outcome recorded for workspace slug.
+func (c *ReadinessChecker) Get(slug string) (domain.Readiness, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.results[slug]
+	return result, ok
+}
+
+// Forget drops what is known of workspace slug, once it no longer runs.
+func (c *ReadinessChecker) Forget(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.results, slug)
+}
+
+func (c *ReadinessChecker) record(slug string, result domain.Readiness) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.results[slug] = result
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadinessWaitsForHealthz(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPath || calls.Add(1) < 3 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"alive"}`))
+	}))
+	defer upstream.Close()
+
+	checker := NewReadinessChecker(10)
+	addr := upstream.Listener.Addr().String()
+
+	if err := checker.Wait(t.Context(), "octocat", addr); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	result, ok := checker.Get("octocat")
+	if !ok || !result.Ready || result.Attempts != 3 {
+		t.Errorf("readiness = %+v, want ready after 3 attempts", result)
+	}
+
+	checker.Forget("octocat")
+	if _, ok := checker.Get("octocat"); ok {
+		t.Error("readiness still recorded after Forget")
+	}
+}
+
+func TestReadinessRecordsFailedStage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	checker := NewReadinessChecker(1)
+
+	err = checker.Wait(t.Context(), "octocat", addr)
+	if err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("wait = %v, want a not ready error", err)
+	}
+
+	result, _ := checker.Get("octocat")
+	if result.Ready || result.Stage != probeStageTCP || result.Attempts < 2 {
+		t.Errorf("readiness = %+v, want failing at the tcp stage after retries", result)
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"code-server-launcher/internal/store"
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultIdleCheckInterval = time.Minute
+
+type Reaper struct {
+	log         *logger.Logger
+	provisioner *Provisioner
+	store       *store.Store
+	policy      domain.IdlePolicy
+	interval    time.Duration
+	lookup      func(owner string) (*domain.User, bool)
+	activity    map[string]time.Time
+	mu          sync.Mutex
+}
+
+// NewReaper builds the idle reaper, which stops workspaces through provisioner
+// like their owner would; lookup resolves a workspace owner to its user so
+// per-user idle overrides can be applied.
+func NewReaper(cfg *config.IdleConfig, provisioner *Provisioner, st *store.Store, lookup func(owner string) (*domain.User, bool)) *Reaper {
+	ret := &Reaper{
+		log:         logger.NewLogger("IdleReaper"),
+		provisioner: provisioner,
+		store:       st,
+		lookup:      lookup,
+		activity:    map[string]time.Time{},
+	}
+
+	ret.Reload(cfg)
+
+	return ret
+}
+
+// Reload replaces the default idle policy. A new check interval only takes effect
+// after a restart since the ticker is already running.
+func (r *Reaper) Reload(cfg *config.IdleConfig) {
+	policy := domain.IdlePolicy{
+		Action: domain.IdleActionStop,
+	}
+	interval := defaultIdleCheckInterval
+
+	if cfg != nil {
+		policy.Timeout = time.Duration(cfg.Timeout) * time.Minute
+
+		if cfg.Action != "" {
+			policy.Action = domain.IdleAction(cfg.Action)
+		}
+
+		if cfg.CheckInterval > 0 {
+			interval = time.Duration(cfg.CheckInterval) * time.Second
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.policy = policy
+	if r.interval == 0 {
+		r.interval = interval
+	}
+}
+
+// Touch records activity on the workspace slug. It only updates memory; the
+// timestamp is persisted on the next check.
+func (r *Reaper) Touch(slug string) {
+	r.record(slug, time.Now())
+}
+
+func (r *Reaper) record(slug string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if at.After(r.activity[slug]) {
+		r.activity[slug] = at
+	}
+}
+
+// Run checks for idle workspaces every interval until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	r.log.Info("Idle reaper started, checking every %s", r.interval)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check(ctx)
+		}
+	}
+}
+
+func (r *Reaper) Check(ctx context.Context) {
+	workspaces, err := r.store.ListWorkspaces()
+	if err != nil {
+		r.log.Error("Failed to list workspaces: %v", err)
+		return
+	}
+
+	for _, ws := range workspaces {
+		r.flushActivity(ws)
+
+		if ws.Status != domain.VmStatusRunning {
+			continue
+		}
+
+		user, _ := r.lookup(ws.Owner)
+		policy := r.defaultPolicy().PolicyFor(user)
+		if !policy.Enabled() {
+			continue
+		}
+
+		if time.Since(ws.LastUsedAt) < policy.Timeout {
+			continue
+		}
+
+		// Forward auth only sees the requests opening a session; code-server sees it
+		// going on, also over a single long-lived WebSocket.
+		r.heartbeat(ctx, ws)
+
+		idle := time.Since(ws.LastUsedAt)
+		if idle < policy.Timeout {
+			continue
+		}
+
+		r.log.Info("Workspace %s idle for %s, applying %s", ws.Slug, idle.Round(time.Second), policy.Action)
+
+		// As for the owner, the reconciler then leaves it down.
+		switch policy.Action {
+		case domain.IdleActionHibernate:
+			err = r.provisioner.Hibernate(ctx, ws)
+		default:
+			err = r.provisioner.Stop(ctx, ws)
+		}
+
+		if err != nil {
+			r.log.Error("Failed to %s idle workspace %s: %v", policy.Action, ws.Slug, err)
+		}
+	}
+}
+
+// heartbeat records the last heartbeat of code-server in ws as activity.
+func (r *Reaper) heartbeat(ctx context.Context, ws *domain.Workspace) {
+	last, err := r.provisioner.Heartbeat(ctx, ws)
+	if err != nil {
+		r.log.Warn("Failed to read heartbeat of workspace %s: %v", ws.Slug, err)
+		return
+	}
+
+	r.record(ws.Slug, last)
+	r.flushActivity(ws)
+}
+
+func (r *Reaper) defaultPolicy() domain.IdlePolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.policy
+}
+
+func (r *Reaper) flushActivity(ws *domain.Workspace) {
+	r.mu.Lock()
+	last, ok := r.activity[ws.Slug]
+	delete(r.activity, ws.Slug)
+	r.mu.Unlock()
+
+	if !ok || !last.After(ws.LastUsedAt) {
+		return
+	}
+
+	ws.LastUsedAt = last
+
+	err := r.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+		if last.After(stored.LastUsedAt) {
+			stored.LastUsedAt = last
+		}
+	})
+	if err != nil {
+		r.log.Warn("Failed to record activity of workspace %s: %v", ws.Slug, err)
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"testing"
+	"time"
+)
+
+func TestReaperStopsIdleWorkspace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, slug)
+
+	if readiness, ok := env.provisioner.Readiness(slug); !ok || !readiness.Ready {
+		t.Fatalf("readiness after provisioning = %+v, want ready", readiness)
+	}
+
+	st := env.provisioner.store
+	err := st.UpdateWorkspace(slug, func(stored *domain.Workspace) {
+		stored.LastUsedAt = time.Now().Add(-time.Hour)
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	reaper := NewReaper(&config.IdleConfig{Timeout: 30}, env.provisioner, st, func(string) (*domain.User, bool) {
+		return env.user, true
+	})
+	reaper.Check(t.Context())
+
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Status != "stopped" {
+		t.Errorf("container %d is %s, want the idle workspace stopped", ws.VMID, guest.Status)
+	}
+
+	if _, ok := env.provisioner.Readiness(slug); ok {
+		t.Error("reaped workspace still has its readiness")
+	}
+
+	if stored, _ := env.provisioner.allocator.Get(slug); stored.Desired != domain.DesiredStopped {
+		t.Errorf("desired state after reaping = %q, want stopped", stored.Desired)
+	}
+}
+
+func TestReaperKeepsActiveSession(t *testing.T) {
+	env := newTestEnv(t)
+	st := env.provisioner.store
+
+	// The browser went through forward auth an hour ago and kept its WebSocket open.
+	ws := &domain.Workspace{
+		Owner:      env.user.Key(),
+		Slug:       env.user.Slug(),
+		VMID:       200,
+		IP:         "127.0.0.1",
+		Status:     domain.VmStatusRunning,
+		Desired:    domain.DesiredRunning,
+		LastUsedAt: time.Now().Add(-time.Hour),
+	}
+	if err := st.SaveWorkspace(ws); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	env.heartbeat.Store(time.Now().Add(-time.Minute).UnixMilli())
+
+	reaper := NewReaper(&config.IdleConfig{Timeout: 30}, env.provisioner, st, func(string) (*domain.User, bool) {
+		return env.user, true
+	})
+	reaper.Check(t.Context())
+
+	stored, _ := env.provisioner.allocator.Get(ws.Slug)
+	if stored.Desired != domain.DesiredRunning {
+		t.Errorf("desired state = %q, want the active workspace left running", stored.Desired)
+	}
+	if time.Since(stored.LastUsedAt) > 2*time.Minute {
+		t.Errorf("last used at %s, want the heartbeat recorded", stored.LastUsedAt)
+	}
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"code-server-launcher/internal/domain"
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultReconcileInterval = time.Minute
+
+// RunReconciler reconciles now and then every interval, or every minute when it
+// is not positive, until ctx is done.
+func (p *Provisioner) RunReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+
+	p.log.Info("Reconciler started, checking every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Reconcile(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile compares every workspace with its container and route and fixes the
+// drift: the stored status and node follow the backend, workspaces their owner
+// left running are started again, running ones get their route back and routes
+// of workspaces that no longer exist or whose owner is no longer allowed are
+// removed. Containers in a transient state are left for the next pass, as are
+// workspaces with a job in progress.
+func (p *Provisioner) Reconcile(ctx context.Context) {
+	workspaces, err := p.store.ListWorkspaces()
+	if err != nil {
+		p.log.Error("Failed to list workspaces to reconcile: %v", err)
+		return
+	}
+
+	known := map[string]bool{}
+	for _, ws := range workspaces {
+		known[ws.Slug] = true
+
+		if job, ok := p.Status(ws.Slug); ok && !job.Done() {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.reconcile(ctx, ws)
+	}
+
+	p.removeOrphanRoutes(ctx, known)
+}
+
+func (p *Provisioner) reconcile(ctx context.Context, ws *domain.Workspace) {
+	info, err := p.backend.Info(ctx, ws)
+	if err != nil {
+		p.log.Error("Failed to reconcile workspace %s: %v", ws.Slug, err)
+		return
+	}
+
+	status := domain.VmStatusMissing
+	if info != nil {
+		status = info.Status
+
+		if info.Node != "" && info.Node != ws.Node {
+			p.log.Info("Workspace %s is on node %s, store said %s", ws.Slug, info.Node, ws.Node)
+			err = p.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+				stored.Node = info.Node
+			})
+			if err != nil {
+				p.log.Error("Failed to update workspace %s: %v", ws.Slug, err)
+			}
+			ws.Node = info.Node
+		}
+	}
+
+	if status != ws.Status {
+		p.log.Info("Workspace %s is %s, store said %s", ws.Slug, status, ws.Status)
+		err = p.store.UpdateWorkspace(ws.Slug, func(stored *domain.Workspace) {
+			stored.Status = status
+		})
+		if err != nil {
+			p.log.Error("Failed to update workspace %s: %v", ws.Slug, err)
+		}
+		p.store.AddEvent(domain.NewEvent(domain.EventReconcile, ws.Owner, fmt.Sprintf("status %s -> %s", ws.Status, status)))
+		ws.Status = status
+	}
+
+	user, allowed := p.lookup(ws.Owner)
+	if !allowed {
+		p.revokeRoute(ctx, ws)
+	}
+
+	switch domain.UpAction(status) {
+	case domain.LifecycleWait:
+		p.log.Info("Workspace %s is %s, waiting for it to settle", ws.Slug, status)
+		return
+	case domain.LifecycleFail:
+		p.log.Error("Workspace %s is %s, it needs an administrator", ws.Slug, status)
+		return
+	case domain.LifecycleNone:
+		if allowed && !ws.RouteDisabled {
+			p.restoreRoute(ctx, ws)
+		}
+		return
+	}
+
+	if ws.Desired != domain.DesiredRunning {
+		return
+	}
+
+	// A lost container would come back as a blank clone, so that is left to the owner.
+	if status == domain.VmStatusMissing {
+		p.log.Warn("Container of workspace %s is gone, not cloning it again", ws.Slug)
+		return
+	}
+
+	if !allowed {
+		p.log.Warn("Not restarting workspace %s, owner %s is not allowed", ws.Slug, ws.Owner)
+		return
+	}
+
+	p.log.Info("Workspace %s should be running but is %s, starting it", ws.Slug, status)
+	p.store.AddEvent(domain.NewEvent(domain.EventReconcile, ws.Owner, fmt.Sprintf("restarting %s workspace %s", status, ws.Slug)))
+
+	if _, err := p.Start(ctx, user, ws.Name, ws.Template); err != nil {
+		p.log.Error("Failed to restart workspace %s: %v", ws.Slug, err)
+	}
+}
+
+func (p *Provisioner) restoreRoute(ctx context.Context, ws *domain.Workspace) {
+	exists, err := p.caddy.ExistsRoute(ctx, ws)
+	if err != nil || exists {
+		return
+	}
+
+	p.log.Info("Restoring missing route of workspace %s", ws.Slug)
+	if err := p.caddy.Insert(ctx, ws); err != nil {
+		p.log.Error("Failed to restore route of workspace %s: %v", ws.Slug, err)
+	}
+}
+
+// revokeRoute takes down the route of a workspace whose owner is no longer allowed,
+// so the workspace cannot be reached until the owner is allowed again.
+func (p *Provisioner) revokeRoute(ctx context.Context, ws *domain.Workspace) {
+	host := p.caddy.Subdomain(ws)
+
+	exists, err := p.caddy.ExistsRoute(ctx, ws)
+	if err != nil {
+		return
+	}
+	if !exists {
+		idx, err := p.caddy.untaggedIndex(ctx, host)
+		if err != nil || idx < 0 {
+			return
+		}
+	}
+
+	p.log.Info("Removing route %s, owner %s is not allowed", host, ws.Owner)
+	p.store.AddEvent(domain.NewEvent(domain.EventReconcile, ws.Owner, "owner not allowed, removing route "+host))
+
+	if err := p.caddy.Remove(ctx, ws.Slug, host); err != nil {
+		p.log.Error("Failed to remove route %s: %v", host, err)
+	}
+}
+
+// removeOrphanRoutes deletes the launcher's routes whose workspace is not in
+// known. Only routes carrying the launcher's @id are its own; untagged routes
+// may be sites sharing the base domain, such as the launcher itself, and are kept.
+func (p *Provisioner) removeOrphanRoutes(ctx context.Context, known map[string]bool) {
+	routes, err := p.caddy.GetRoutes(ctx)
+	if err != nil {
+		p.log.Error("Failed to list routes to reconcile: %v", err)
+		return
+	}
+
+	for _, route := range routes {
+		var host string
+		if len(route.Match) > 0 && len(route.Match[0].Host) > 0 {
+			host = route.Match[0].Host[0]
+		}
+
+		slug, ok := SlugFromRouteID(route.ID)
+		if !ok || known[slug] {
+			continue
+		}
+
+		// Workspaces allocated since the list was read are still being provisioned.
+		if job, ok := p.Status(slug); ok && !job.Done() {
+			continue
+		}
+
+		p.log.Info("Removing orphan route %s", host)
+		if err := p.caddy.Remove(ctx, slug, host); err != nil {
+			p.log.Error("Failed to remove orphan route %s: %v", host, err)
+		}
+	}
+}
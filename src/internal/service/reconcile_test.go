@@ -0,0 +1,269 @@
+package service
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/fake"
+	"code-server-launcher/internal/store"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTemplateID = 9000
+
+type testEnv struct {
+	pve         *fake.Proxmox
+	caddy       *fake.Caddy
+	provisioner *Provisioner
+	user        *domain.User
+	// revoked makes the owner lookup fail, as for a user no longer allowed.
+	revoked atomic.Bool
+	// heartbeat is the last heartbeat in Unix milliseconds code-server reports.
+	heartbeat atomic.Int64
+}
+
+// newTestEnv wires the Proxmox backend, Caddy and the provisioner to the fakes. The
+// first pool address is 127.0.0.1, where a listener stands in for code-server and
+// reports the heartbeat set in the environment. The
+// fake cluster is made of nodes, a single "pve" node by default.
+func newTestEnv(t *testing.T, nodes ...string) *testEnv {
+	pve := fake.NewProxmox(nodes...)
+	t.Cleanup(pve.Close)
+	pve.AddTemplate(testTemplateID)
+
+	caddy := fake.NewCaddy()
+	t.Cleanup(caddy.Close)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	env := &testEnv{
+		pve:   pve,
+		caddy: caddy,
+		user:  domain.NewUser("octocat"),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status":"alive","lastHeartbeat":%d}`, env.heartbeat.Load())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "code-server")
+	})
+	go http.Serve(ln, mux)
+
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	cfg := &config.ProxmoxConfig{
+		Host:             pve.Host(),
+		Node:             "pve",
+		Username:         pve.Username,
+		Password:         pve.Password,
+		Fingerprint:      pve.Fingerprint(),
+		TemplateID:       testTemplateID,
+		StorageName:      "local-lvm",
+		NetworkInterface: "vmbr0",
+		TimetoStart:      5,
+		TaskTimeout:      60,
+	}
+
+	workspace := &config.WorkspaceConfig{
+		MemSize:        1024,
+		CPUCores:       2,
+		VMIDRangeStart: 200,
+		VMIDRangeEnd:   299,
+		IPPool:         "127.0.0.0/24",
+		Gateway:        "127.0.0.254",
+		CodeServerAuth: config.CodeServerAuthNone,
+	}
+
+	backend := NewProxmoxService(cfg, workspace, st)
+	if backend == nil {
+		t.Fatal("failed to connect to the fake Proxmox")
+	}
+
+	caddyHost, caddyPort := caddy.Addr()
+	caddyService := NewCaddyService(&config.CaddyConfig{
+		ServerConfig: config.ServerConfig{Host: caddyHost, Port: caddyPort, RequestTimeout: 10},
+		ServerName:   "srv0",
+		BaseURL:      "code.test",
+		UpstreamPort: ln.Addr().(*net.TCPAddr).Port,
+		AuthUpstream: "127.0.0.1:8080",
+	}, backend, st)
+
+	allocator, err := NewAllocator(workspace, backend, st)
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+
+	lookup := func(owner string) (*domain.User, bool) {
+		return env.user, owner == env.user.Key() && !env.revoked.Load()
+	}
+	env.provisioner = NewProvisioner(workspace, backend, caddyService, allocator, nil, st, lookup, 10)
+
+	return env
+}
+
+func (e *testEnv) waitReady(t *testing.T, slug string) *domain.Workspace {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		job, ok := e.provisioner.Status(slug)
+		if ok && job.Phase == domain.JobPhaseFailed {
+			t.Fatalf("provisioning %s failed: %s", slug, job.Error)
+		}
+		if ok && job.Phase == domain.JobPhaseReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workspace %s not ready, last job: %+v", slug, job)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ws, ok := e.provisioner.allocator.Get(slug)
+	if !ok {
+		t.Fatalf("workspace %s not stored", slug)
+	}
+
+	return ws
+}
+
+func (e *testEnv) routeHosts(t *testing.T) map[string]bool {
+	t.Helper()
+
+	var routes []Route
+	if err := e.caddy.Routes("srv0", &routes); err != nil {
+		t.Fatalf("routes: %v", err)
+	}
+
+	ret := map[string]bool{}
+	for _, route := range routes {
+		for _, match := range route.Match {
+			for _, host := range match.Host {
+				ret[host] = true
+			}
+		}
+	}
+
+	return ret
+}
+
+func TestReconcileRestartsAndCleansUp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, slug)
+
+	if ws.Desired != domain.DesiredRunning {
+		t.Fatalf("desired state after provisioning = %q, want running", ws.Desired)
+	}
+
+	// Drift: the container died and a route of a deleted workspace was left behind,
+	// next to an untagged site on the base domain that the launcher does not own.
+	env.pve.SetStatus(ws.VMID, "stopped")
+	untagged := Route{Match: []RouteMatch{{Host: []string{"ghost.code.test"}}}, Handle: []RouteHandler{{Handler: "reverse_proxy"}}}
+	tagged := Route{ID: RouteID("gone"), Match: []RouteMatch{{Host: []string{"gone.code.test"}}}, Handle: []RouteHandler{{Handler: "reverse_proxy"}}}
+	foreign := Route{Match: []RouteMatch{{Host: []string{"wiki.example.com"}}}, Handle: []RouteHandler{{Handler: "reverse_proxy"}}}
+	env.caddy.AddRoute("srv0", untagged)
+	env.caddy.AddRoute("srv0", tagged)
+	env.caddy.AddRoute("srv0", foreign)
+
+	env.provisioner.Reconcile(t.Context())
+	env.waitReady(t, slug)
+
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Status != "running" {
+		t.Errorf("container %d is %s after reconcile, want running", ws.VMID, guest.Status)
+	}
+
+	hosts := env.routeHosts(t)
+	if hosts["gone.code.test"] {
+		t.Errorf("routes after reconcile = %v, want the orphan route removed", hosts)
+	}
+	if !hosts["ghost.code.test"] || !hosts["wiki.example.com"] || !hosts[slug+".code.test"] {
+		t.Errorf("routes after reconcile = %v, want the workspace and untagged routes kept", hosts)
+	}
+
+	// A workspace the owner stopped stays stopped.
+	if err := env.provisioner.Stop(t.Context(), ws); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	env.provisioner.Reconcile(t.Context())
+
+	if job, _ := env.provisioner.Status(slug); !job.Done() {
+		t.Errorf("reconcile started job %+v for a workspace stopped by its owner", job)
+	}
+	if guest, _ := env.pve.Guest(ws.VMID); guest.Status != "stopped" {
+		t.Errorf("container %d is %s, want it left stopped", ws.VMID, guest.Status)
+	}
+
+	// The route goes away once the owner is no longer allowed; the workspace stays.
+	env.revoked.Store(true)
+	env.provisioner.Reconcile(t.Context())
+
+	if hosts := env.routeHosts(t); hosts[slug+".code.test"] {
+		t.Errorf("routes after revoking the owner = %v, want the workspace route removed", hosts)
+	}
+	if _, ok := env.provisioner.allocator.Get(slug); !ok {
+		t.Error("workspace of the revoked owner was released")
+	}
+}
+
+func TestReconcileKeepsRemovedRoute(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the container start delay")
+	}
+
+	env := newTestEnv(t)
+	slug := env.user.Slug()
+	host := slug + ".code.test"
+
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws := env.waitReady(t, slug)
+
+	if err := env.provisioner.RemoveRoute(t.Context(), ws); err != nil {
+		t.Fatalf("remove route: %v", err)
+	}
+
+	env.provisioner.Reconcile(t.Context())
+
+	if hosts := env.routeHosts(t); hosts[host] {
+		t.Errorf("routes after reconcile = %v, want the removed route left down", hosts)
+	}
+
+	// Starting the workspace again brings the route back for good.
+	if _, err := env.provisioner.Start(t.Context(), env.user, domain.DefaultWorkspace, ""); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	ws = env.waitReady(t, slug)
+
+	if ws.RouteDisabled {
+		t.Error("route still disabled after a start")
+	}
+	if hosts := env.routeHosts(t); !hosts[host] {
+		t.Errorf("routes after start = %v, want %s", hosts, host)
+	}
+}
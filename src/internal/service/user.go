@@ -4,59 +4,82 @@ import (
 	"code-server-launcher/internal/config"
 	"code-server-launcher/internal/domain"
 	"code-server-launcher/internal/logger"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type UserService struct {
-	githubUrl   string
-	userListUrl string
-	log         *logger.Logger
+	cfg atomic.Pointer[config.AppConfig]
+	log *logger.Logger
 }
 
 func NewUserService(config *config.AppConfig) *UserService {
-	return &UserService{
-		githubUrl:   config.Github.GithubUrl,
-		userListUrl: config.UserListUrl,
-		log:         logger.NewLogger("UserService"),
+	ret := &UserService{
+		log: logger.NewLogger("UserService"),
 	}
+
+	ret.cfg.Store(config)
+
+	return ret
+}
+
+// Reload switches the user list and key sources used by the next LoadUsers.
+func (s *UserService) Reload(config *config.AppConfig) {
+	s.cfg.Store(config)
 }
 
-func (s *UserService) LoadUsers() (*domain.UserList, error) {
-	resp, err := http.Get(s.userListUrl)
+// LoadUsers fetches the user list, filling in missing GitHub keys. The whole load
+// is bounded by server.request_timeout. A list that cannot be read or parsed is an
+// error, never an empty list.
+func (s *UserService) LoadUsers(ctx context.Context) (*domain.UserList, error) {
+	cfg := s.cfg.Load()
+	userListUrl := cfg.UserListUrl
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Server.RequestTimeout)*time.Second)
+	defer cancel()
+
+	resp, err := s.get(ctx, userListUrl)
 	if err != nil {
-		s.log.Error("Failed to get JSON file: %v from %s", err, s.userListUrl)
+		s.log.Error("Failed to get JSON file: %v from %s", err, userListUrl)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		s.log.Error("Fail to get JSON file: %s, status code: %d", s.userListUrl, resp.StatusCode)
+		s.log.Error("Fail to get JSON file: %s, status code: %d", userListUrl, resp.StatusCode)
+		return nil, fmt.Errorf("user list %s returned status %d", userListUrl, resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		s.log.Error("Failed to read response body: %v", err)
+		return nil, fmt.Errorf("failed to read user list %s: %v", userListUrl, err)
 	}
 
 	users := domain.NewUserList()
 
-	err = json.Unmarshal(body, &users)
+	err = json.Unmarshal(body, users)
 
 	if err != nil {
 		s.log.Error("Failed to unmarshal JSON: %v", err)
+		return nil, fmt.Errorf("invalid user list %s: %v", userListUrl, err)
 	}
 
 	if len(users.Users) == 0 {
-		s.log.Error("No users found in JSON file: %s", s.userListUrl)
+		s.log.Error("No users found in JSON file: %s", userListUrl)
 	}
 
-	s.log.Info("Users loaded from JSON file: %s -> %v", s.userListUrl, users.Users)
+	s.log.Info("Users loaded from JSON file: %s -> %v", userListUrl, users.Users)
 
 	for _, user := range users.Users {
-		if user.PubKey == "" {
+		if user.PubKey == "" && user.GetProvider() == domain.DefaultProvider {
 			s.log.Debug("User %s has no public key, getting from github", user.Login)
-			pubKey, err := s.getPubKeyFromGithub(user.Login)
+			pubKey, err := s.getPubKeyFromGithub(ctx, user.Login)
 			if err != nil {
 				s.log.Error("Failed to get public key from github: %v", err)
 				continue
@@ -72,12 +95,14 @@ func (s *UserService) LoadUsers() (*domain.UserList, error) {
 		}
 	}
 
-	s.log.Info("Users loaded from JSON file: %s -> %v", s.userListUrl, users.Users)
+	s.log.Info("Users loaded from JSON file: %s -> %v", userListUrl, users.Users)
 	return users, nil
 }
 
-func (s *UserService) getPubKeyFromGithub(user string) (string, error) {
-	resp, err := http.Get(s.githubUrl + user)
+func (s *UserService) getPubKeyFromGithub(ctx context.Context, user string) (string, error) {
+	githubUrl := s.cfg.Load().Github.GithubUrl
+
+	resp, err := s.get(ctx, githubUrl+user)
 	if err != nil {
 		s.log.Error("Failed to get public key from github: %v", err)
 		return "", err
@@ -85,7 +110,7 @@ func (s *UserService) getPubKeyFromGithub(user string) (string, error) {
 
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		s.log.Error("Failed to get public key from github: %s - %s, status code: %d", s.githubUrl, user, resp.StatusCode)
+		s.log.Error("Failed to get public key from github: %s - %s, status code: %d", githubUrl, user, resp.StatusCode)
 		return "", err
 	}
 
@@ -98,3 +123,12 @@ func (s *UserService) getPubKeyFromGithub(user string) (string, error) {
 
 	return string(body), nil
 }
+
+func (s *UserService) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,210 @@
+package session
+
+import (
+	"code-server-launcher/internal/config"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookie = "csl_session"
+	StateCookie   = "csl_oauth_state"
+	ReturnCookie  = "csl_return"
+
+	defaultTTL = 8 * time.Hour
+	stateTTL   = 10 * time.Minute
+)
+
+type Manager struct {
+	log          *logger.Logger
+	secret       []byte
+	ttl          time.Duration
+	cookieDomain string
+	secure       bool
+}
+
+func NewManager(cfg *config.SessionConfig) *Manager {
+	ret := &Manager{
+		log:    logger.NewLogger("SessionManager"),
+		ttl:    defaultTTL,
+		secure: true,
+	}
+
+	if cfg != nil {
+		ret.secret = []byte(cfg.Secret)
+		ret.cookieDomain = cfg.CookieDomain
+		ret.secure = !cfg.InsecureCookies
+
+		if cfg.TTL > 0 {
+			ret.ttl = time.Duration(cfg.TTL) * time.Minute
+		}
+	}
+
+	if len(ret.secret) == 0 {
+		ret.log.Warn("No session secret configured, using a random one: sessions will not survive a restart")
+		ret.secret = []byte(randomToken(32))
+	}
+
+	return ret
+}
+
+// NewState creates a random OAuth state and keeps it, along with the identity provider
+// being used, in a short-lived cookie for VerifyState.
+func (m *Manager) NewState(w http.ResponseWriter, provider string) string {
+	state := randomToken(32)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookie,
+		Value:    state + "." + provider,
+		Path:     "/",
+		MaxAge:   int(stateTTL.Seconds()),
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return state
+}
+
+// VerifyState checks the callback state against the cookie and returns the provider name.
+func (m *Manager) VerifyState(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie(StateCookie)
+	if err != nil {
+		return "", fmt.Errorf("missing OAuth state cookie")
+	}
+
+	m.clear(w, StateCookie, "")
+
+	expected, provider, _ := strings.Cut(cookie.Value, ".")
+
+	state := r.URL.Query().Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return "", fmt.Errorf("OAuth state mismatch")
+	}
+
+	return provider, nil
+}
+
+// SetReturnTo remembers where the browser should land once the login flow completes.
+func (m *Manager) SetReturnTo(w http.ResponseWriter, target string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ReturnCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(target)),
+		Path:     "/",
+		MaxAge:   int(stateTTL.Seconds()),
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (m *Manager) PopReturnTo(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(ReturnCookie)
+	if err != nil {
+		return ""
+	}
+
+	m.clear(w, ReturnCookie, "")
+
+	target, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return ""
+	}
+
+	return string(target)
+}
+
+func (m *Manager) Create(w http.ResponseWriter, provider, login string) error {
+	session := domain.NewSession(provider, login, m.ttl)
+
+	payload, err := json.Marshal(session)
+	if err != nil {
+		m.log.Error("Failed to marshal session: %v", err)
+		return err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    encoded + "." + m.sign(encoded),
+		Path:     "/",
+		Domain:   m.cookieDomain,
+		Expires:  session.ExpiresAt,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+func (m *Manager) Get(r *http.Request) (*domain.Session, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, fmt.Errorf("no session cookie")
+	}
+
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(m.sign(encoded))) {
+		return nil, fmt.Errorf("invalid session signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session encoding: %v", err)
+	}
+
+	session := &domain.Session{}
+	if err := json.Unmarshal(payload, session); err != nil {
+		return nil, fmt.Errorf("invalid session payload: %v", err)
+	}
+
+	if session.Expired() {
+		return nil, fmt.Errorf("session expired for user %s", session.Login)
+	}
+
+	return session, nil
+}
+
+func (m *Manager) Destroy(w http.ResponseWriter) {
+	m.clear(w, SessionCookie, m.cookieDomain)
+}
+
+func (m *Manager) clear(w http.ResponseWriter, name string, cookieDomain string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		Domain:   cookieDomain,
+		MaxAge:   -1,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (m *Manager) sign(value string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomToken(size int) string {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,128 @@
+package session
+
+import (
+	"code-server-launcher/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cookieRequest returns a request carrying the cookies set on rec.
+func cookieRequest(rec *httptest.ResponseRecorder, target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	return req
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	m := NewManager(&config.SessionConfig{Secret: "test-secret"})
+
+	rec := httptest.NewRecorder()
+	if err := m.Create(rec, "gitlab", "Octocat"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	sess, err := m.Get(cookieRequest(rec, "/"))
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if sess.UserKey() != "gitlab:octocat" {
+		t.Errorf("session user = %s, want gitlab:octocat", sess.UserKey())
+	}
+}
+
+func TestSessionRejectsTampering(t *testing.T) {
+	m := NewManager(&config.SessionConfig{Secret: "test-secret"})
+
+	rec := httptest.NewRecorder()
+	if err := m.Create(rec, "github", "octocat"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	value := rec.Result().Cookies()[0].Value
+	payload, signature, _ := strings.Cut(value, ".")
+
+	// Another valid session, whose payload gets paired with the first signature.
+	other := httptest.NewRecorder()
+	m.Create(other, "github", "admin")
+	otherPayload, _, _ := strings.Cut(other.Result().Cookies()[0].Value, ".")
+
+	forged := NewManager(&config.SessionConfig{Secret: "other-secret"})
+	forgedRec := httptest.NewRecorder()
+	forged.Create(forgedRec, "github", "octocat")
+
+	tests := map[string]string{
+		"swapped payload": otherPayload + "." + signature,
+		"altered sig":     payload + "." + strings.Repeat("A", len(signature)),
+		"missing sig":     payload,
+		"other secret":    forgedRec.Result().Cookies()[0].Value,
+		"garbage":         "not-a-session",
+		"empty sig":       payload + ".",
+	}
+
+	for name, cookie := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: cookie})
+
+		if sess, err := m.Get(req); err == nil {
+			t.Errorf("%s: got session %+v, want an error", name, sess)
+		}
+	}
+
+	if _, err := m.Get(httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Error("request without cookie got a session")
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	m := NewManager(&config.SessionConfig{Secret: "test-secret"})
+	m.ttl = -time.Minute
+
+	rec := httptest.NewRecorder()
+	if err := m.Create(rec, "github", "octocat"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if _, err := m.Get(cookieRequest(rec, "/")); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("get = %v, want an expired session error", err)
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	m := NewManager(&config.SessionConfig{Secret: "test-secret"})
+
+	rec := httptest.NewRecorder()
+	state := m.NewState(rec, "gitlab")
+
+	provider, err := m.VerifyState(httptest.NewRecorder(), cookieRequest(rec, "/callback?state="+state))
+	if err != nil || provider != "gitlab" {
+		t.Fatalf("verify = %q, %v, want gitlab", provider, err)
+	}
+
+	if _, err := m.VerifyState(httptest.NewRecorder(), cookieRequest(rec, "/callback?state=forged")); err == nil {
+		t.Error("mismatched state was accepted")
+	}
+
+	if _, err := m.VerifyState(httptest.NewRecorder(), cookieRequest(rec, "/callback")); err == nil {
+		t.Error("empty state was accepted")
+	}
+
+	noCookie := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	if _, err := m.VerifyState(httptest.NewRecorder(), noCookie); err == nil {
+		t.Error("state without cookie was accepted")
+	}
+
+	// The state cookie is single use.
+	verify := httptest.NewRecorder()
+	m.VerifyState(verify, cookieRequest(rec, "/callback?state="+state))
+	cleared := verify.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != StateCookie || cleared[0].MaxAge >= 0 {
+		t.Errorf("cookies after verify = %+v, want the state cookie cleared", cleared)
+	}
+}
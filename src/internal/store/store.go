@@ -0,0 +1,309 @@
+package store
+
+import (
+	"bytes"
+	"code-server-launcher/internal/domain"
+	"code-server-launcher/internal/logger"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket      = []byte("users")
+	workspacesBucket = []byte("workspaces")
+	routesBucket     = []byte("routes")
+	eventsBucket     = []byte("events")
+)
+
+// eventRetention is how many audit events are kept; older ones are pruned as new
+// ones are added.
+const eventRetention = 10000
+
+type Store struct {
+	log       *logger.Logger
+	db        *bolt.DB
+	maxEvents int
+}
+
+func NewStore(path string) (*Store, error) {
+	ret := &Store{
+		log:       logger.NewLogger("Store"),
+		maxEvents: eventRetention,
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		ret.log.Error("Failed to open store %s: %v", path, err)
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, workspacesBucket, routesBucket, eventsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %v", bucket, err)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		ret.log.Error("Failed to initialize store %s: %v", path, err)
+		return nil, err
+	}
+
+	ret.db = db
+	ret.log.Info("Store opened at %s", path)
+
+	return ret, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) SaveUser(user *domain.User) error {
+	return s.put(usersBucket, user.Key(), user)
+}
+
+func (s *Store) DeleteUser(key string) error {
+	return s.delete(usersBucket, key)
+}
+
+func (s *Store) ListUsers() ([]*domain.User, error) {
+	ret := []*domain.User{}
+	err := s.list(usersBucket, func(data []byte) error {
+		user := &domain.User{}
+		if err := json.Unmarshal(data, user); err != nil {
+			return err
+		}
+		ret = append(ret, user)
+		return nil
+	})
+
+	return ret, err
+}
+
+// SaveWorkspace stores ws under its slug, which is unique across users since it
+// names the workspace subdomain.
+func (s *Store) SaveWorkspace(ws *domain.Workspace) error {
+	return s.put(workspacesBucket, ws.Slug, ws)
+}
+
+func (s *Store) GetWorkspace(slug string) (*domain.Workspace, error) {
+	ws := &domain.Workspace{}
+	found, err := s.get(workspacesBucket, slug, ws)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func (s *Store) ListWorkspaces() ([]*domain.Workspace, error) {
+	ret := []*domain.Workspace{}
+	err := s.list(workspacesBucket, func(data []byte) error {
+		ws := &domain.Workspace{}
+		if err := json.Unmarshal(data, ws); err != nil {
+			return err
+		}
+		ret = append(ret, ws)
+		return nil
+	})
+
+	return ret, err
+}
+
+func (s *Store) ListWorkspacesOf(owner string) ([]*domain.Workspace, error) {
+	workspaces, err := s.ListWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*domain.Workspace{}
+	for _, ws := range workspaces {
+		if ws.Owner == owner {
+			ret = append(ret, ws)
+		}
+	}
+
+	return ret, nil
+}
+
+// UpdateWorkspace applies fn to the stored workspace slug inside one transaction.
+func (s *Store) UpdateWorkspace(slug string, fn func(ws *domain.Workspace)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(workspacesBucket)
+
+		data := bucket.Get([]byte(slug))
+		if data == nil {
+			return fmt.Errorf("workspace %s not found", slug)
+		}
+
+		ws := &domain.Workspace{}
+		if err := json.Unmarshal(data, ws); err != nil {
+			return err
+		}
+
+		fn(ws)
+
+		data, err := json.Marshal(ws)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(slug), data)
+	})
+}
+
+func (s *Store) DeleteWorkspace(slug string) error {
+	return s.delete(workspacesBucket, slug)
+}
+
+func (s *Store) SaveRoute(route *domain.RouteRecord) error {
+	return s.put(routesBucket, route.Slug, route)
+}
+
+func (s *Store) ListRoutes() ([]*domain.RouteRecord, error) {
+	ret := []*domain.RouteRecord{}
+	err := s.list(routesBucket, func(data []byte) error {
+		route := &domain.RouteRecord{}
+		if err := json.Unmarshal(data, route); err != nil {
+			return err
+		}
+		ret = append(ret, route)
+		return nil
+	})
+
+	return ret, err
+}
+
+func (s *Store) DeleteRoute(slug string) error {
+	return s.delete(routesBucket, slug)
+}
+
+// AddEvent appends an audit event, dropping the oldest ones beyond the retention.
+// Failures are only logged so auditing never breaks the operation being audited.
+func (s *Store) AddEvent(event *domain.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		s.log.Error("Failed to marshal event: %v", err)
+		return
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if err := bucket.Put(eventKey(seq), data); err != nil {
+			return err
+		}
+
+		if seq <= uint64(s.maxEvents) {
+			return nil
+		}
+
+		cutoff := eventKey(seq - uint64(s.maxEvents))
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, cutoff) <= 0; k, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		s.log.Error("Failed to store event %s for %s: %v", event.Kind, event.Subject, err)
+	}
+}
+
+// ListEvents returns up to limit events, newest first.
+func (s *Store) ListEvents(limit int) ([]*domain.Event, error) {
+	ret := []*domain.Event{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for k, v := cursor.Last(); k != nil && len(ret) < limit; k, v = cursor.Prev() {
+			event := &domain.Event{}
+			if err := json.Unmarshal(v, event); err != nil {
+				return err
+			}
+			ret = append(ret, event)
+		}
+		return nil
+	})
+
+	return ret, err
+}
+
+// eventKey orders events by sequence number in the events bucket.
+func eventKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	return key
+}
+
+func (s *Store) put(bucket []byte, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+
+	if err != nil {
+		s.log.Error("Failed to save %s/%s: %v", bucket, key, err)
+	}
+
+	return err
+}
+
+func (s *Store) get(bucket []byte, key string, value interface{}) (bool, error) {
+	var data []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucket).Get([]byte(key)); v != nil {
+			data = append([]byte{}, v...)
+		}
+		return nil
+	})
+
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(data, value)
+}
+
+func (s *Store) list(bucket []byte, fn func(data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+func (s *Store) delete(bucket []byte, key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+
+	if err != nil {
+		s.log.Error("Failed to delete %s/%s: %v", bucket, key, err)
+	}
+
+	return err
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"code-server-launcher/internal/domain"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	st, err := NewStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	return st
+}
+
+func TestUsers(t *testing.T) {
+	st := newTestStore(t)
+
+	for _, login := range []string{"alice", "bob"} {
+		if err := st.SaveUser(domain.NewUser(login)); err != nil {
+			t.Fatalf("save %s: %v", login, err)
+		}
+	}
+
+	if err := st.DeleteUser("github:alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	users, err := st.ListUsers()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(users) != 1 || users[0].Key() != "github:bob" {
+		t.Errorf("users = %v, want only bob", users)
+	}
+}
+
+func TestWorkspacesBySlug(t *testing.T) {
+	st := newTestStore(t)
+	alice := domain.NewUser("alice")
+
+	for _, ws := range []*domain.Workspace{
+		{Owner: alice.Key(), Name: domain.DefaultWorkspace, Slug: "alice", VMID: 200},
+		{Owner: alice.Key(), Name: "data", Slug: "data---alice", VMID: 201},
+		{Owner: "github:bob", Name: domain.DefaultWorkspace, Slug: "bob", VMID: 202},
+	} {
+		if err := st.SaveWorkspace(ws); err != nil {
+			t.Fatalf("save %s: %v", ws.Slug, err)
+		}
+	}
+
+	err := st.UpdateWorkspace("data---alice", func(ws *domain.Workspace) {
+		ws.Status = domain.VmStatusRunning
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	ws, err := st.GetWorkspace("data---alice")
+	if err != nil || ws == nil || ws.Status != domain.VmStatusRunning || ws.VMID != 201 {
+		t.Fatalf("get = %+v, %v, want the updated workspace", ws, err)
+	}
+
+	if err := st.UpdateWorkspace("ghost", func(*domain.Workspace) {}); err == nil {
+		t.Error("update of a missing workspace succeeded")
+	}
+
+	if ws, err := st.GetWorkspace("ghost"); ws != nil || err != nil {
+		t.Errorf("get of a missing workspace = %+v, %v, want nil", ws, err)
+	}
+
+	owned, err := st.ListWorkspacesOf(alice.Key())
+	if err != nil || len(owned) != 2 {
+		t.Errorf("workspaces of alice = %v, %v, want two", owned, err)
+	}
+
+	if err := st.DeleteWorkspace("alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if all, _ := st.ListWorkspaces(); len(all) != 2 {
+		t.Errorf("workspaces after delete = %d, want 2", len(all))
+	}
+}
+
+func TestEventRetention(t *testing.T) {
+	st := newTestStore(t)
+	st.maxEvents = 3
+
+	for i := range 5 {
+		st.AddEvent(domain.NewEvent(domain.EventLogin, "github:alice", fmt.Sprintf("login %d", i)))
+	}
+
+	events, err := st.ListEvents(10)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	var messages []string
+	for _, event := range events {
+		messages = append(messages, event.Message)
+	}
+
+	if fmt.Sprint(messages) != "[login 4 login 3 login 2]" {
+		t.Errorf("events = %v, want the three newest, newest first", messages)
+	}
+
+	if events, _ := st.ListEvents(1); len(events) != 1 || events[0].Message != "login 4" {
+		t.Errorf("limited events = %v, want the newest one", events)
+	}
+}